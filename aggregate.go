@@ -0,0 +1,124 @@
+package vector
+
+import (
+	"fmt"
+
+	"zombiezen.com/go/sqlite"
+)
+
+type aggregateKind int
+
+const (
+	aggregateSum aggregateKind = iota
+	aggregateAvg
+	aggregateMin
+	aggregateMax
+)
+
+// vectorAggregateFunc returns the SQL aggregate named name that combines
+// vectors element-wise. Inputs may be any float blob vector_distance
+// accepts, or quantized blobs, which are dequantized first. The sum and
+// average also work as window functions.
+func vectorAggregateFunc(name string, cfg *config, kind aggregateKind) *sqlite.FunctionImpl {
+	return &sqlite.FunctionImpl{
+		NArgs:         1,
+		Deterministic: true,
+		MakeAggregate: func(ctx sqlite.Context) (sqlite.AggregateFunction, error) {
+			return &vectorAggregate{cfg: cfg, name: name, kind: kind}, nil
+		},
+	}
+}
+
+// vectorAggregate accumulates in float64 so that long sums and averages do
+// not lose precision, and so that window inverses cancel exactly enough.
+type vectorAggregate struct {
+	cfg   *config
+	name  string
+	kind  aggregateKind
+	n     int64
+	acc   []float64
+	model string
+}
+
+// decode decodes one row's vector and checks its model against the rows
+// seen so far.
+func (a *vectorAggregate) decode(arg sqlite.Value) ([]float32, error) {
+	v, model, err := a.cfg.decodeTagged(arg.Blob())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", a.name, err)
+	}
+	if err := checkModels(a.model, model); err != nil {
+		return nil, fmt.Errorf("%s: %v", a.name, err)
+	}
+	if model != "" {
+		a.model = model
+	}
+	return v, nil
+}
+
+func (a *vectorAggregate) Step(ctx sqlite.Context, args []sqlite.Value) error {
+	if args[0].Type() == sqlite.TypeNull {
+		return nil
+	}
+	v, err := a.decode(args[0])
+	if err != nil {
+		return err
+	}
+	if a.acc == nil {
+		a.acc = make([]float64, len(v))
+		for i, f := range v {
+			a.acc[i] = float64(f)
+		}
+		a.n = 1
+		return nil
+	}
+	a.n++
+	for i, f := range v {
+		x := float64(f)
+		switch a.kind {
+		case aggregateMin:
+			a.acc[i] = min(a.acc[i], x)
+		case aggregateMax:
+			a.acc[i] = max(a.acc[i], x)
+		default:
+			a.acc[i] += x
+		}
+	}
+	return nil
+}
+
+func (a *vectorAggregate) WindowInverse(ctx sqlite.Context, args []sqlite.Value) error {
+	if a.kind == aggregateMin || a.kind == aggregateMax {
+		return fmt.Errorf("%s: not supported as a window function", a.name)
+	}
+	if args[0].Type() == sqlite.TypeNull {
+		return nil
+	}
+	v, err := a.decode(args[0])
+	if err != nil {
+		return err
+	}
+	a.n--
+	for i, f := range v {
+		a.acc[i] -= float64(f)
+	}
+	return nil
+}
+
+// WindowValue returns the aggregate as a float32 blob, or NULL if there
+// were no vectors.
+func (a *vectorAggregate) WindowValue(ctx sqlite.Context) (sqlite.Value, error) {
+	if a.n == 0 {
+		return sqlite.Value{}, nil
+	}
+	v := make([]float32, len(a.acc))
+	for i, x := range a.acc {
+		if a.kind == aggregateAvg {
+			x /= float64(a.n)
+		}
+		v[i] = float32(x)
+	}
+	return sqlite.BlobValue(Float32ToBlob(v)), nil
+}
+
+func (a *vectorAggregate) Finalize(ctx sqlite.Context) {}
@@ -0,0 +1,78 @@
+package vector
+
+import (
+	"testing"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestVectorAggregates(t *testing.T) {
+	conn := openTestConn(t)
+	if err := Register(conn, 2, WithQuantRange(-8, 8)); err != nil {
+		t.Fatal(err)
+	}
+	err := sqlitex.ExecuteScript(conn, `
+		CREATE TABLE clicks (user_id INTEGER, embedding BLOB);
+		INSERT INTO clicks VALUES
+			(1, vector_encode('[1,-2]')),
+			(1, vector_to_f16(vector_encode('[3,4]'))),
+			(1, NULL),
+			(2, vector_quantize(vector_encode('[8,-8]'))),
+			(3, NULL);
+	`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT vector_to_json(vector_sum(embedding)) FROM clicks WHERE user_id = 1", "[4,2]"},
+		{"SELECT vector_to_json(vector_avg(embedding)) FROM clicks WHERE user_id = 1", "[2,1]"},
+		{"SELECT vector_to_json(vector_min(embedding)) FROM clicks WHERE user_id = 1", "[1,-2]"},
+		{"SELECT vector_to_json(vector_max(embedding)) FROM clicks WHERE user_id = 1", "[3,4]"},
+		{"SELECT vector_to_json(vector_avg(embedding)) FROM clicks WHERE user_id = 2", "[8,-8]"},
+		{"SELECT vector_avg(embedding) IS NULL FROM clicks WHERE user_id = 3", "1"},
+		{"SELECT vector_sum(embedding) IS NULL FROM clicks WHERE user_id = 4", "1"},
+		{"SELECT group_concat(v, ' ') FROM (SELECT vector_to_json(vector_avg(embedding)) AS v FROM clicks GROUP BY user_id ORDER BY user_id)", "[2,1] [8,-8]"},
+		{
+			"SELECT group_concat(v, ' ') FROM (SELECT vector_to_json(vector_sum(embedding) OVER (ORDER BY rowid ROWS BETWEEN 1 PRECEDING AND CURRENT ROW)) AS v FROM clicks WHERE user_id = 1)",
+			"[1,-2] [4,2] [3,4]",
+		},
+	}
+	for _, tt := range tests {
+		var got string
+		err := sqlitex.ExecuteTransient(conn, tt.query, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				got = stmt.ColumnText(0)
+				return nil
+			},
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.query, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestVectorAggregateModels(t *testing.T) {
+	cfg := &config{name: "vector", dim: 2}
+	a := &vectorAggregate{cfg: cfg, name: "vector_avg", kind: aggregateAvg}
+	tagA, _ := TypedToBlob([]float32{1, 2}, ElementFloat32, "a")
+	tagB, _ := TypedToBlob([]float32{1, 2}, ElementFloat32, "b")
+	if _, err := a.decode(sqlite.BlobValue(tagA)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.decode(sqlite.BlobValue(Float32ToBlob([]float32{1, 2}))); err != nil {
+		t.Errorf("decode rejected an untagged vector: %v", err)
+	}
+	if _, err := a.decode(sqlite.BlobValue(tagB)); err == nil {
+		t.Error("decode accepted vectors from different models")
+	}
+	if _, err := a.decode(sqlite.BlobValue(Float32ToBlob([]float32{1, 2, 3}))); err == nil {
+		t.Error("decode accepted a vector of the wrong dimension")
+	}
+}
@@ -0,0 +1,167 @@
+package vector
+
+import (
+	"fmt"
+	"math"
+
+	"zombiezen.com/go/sqlite"
+)
+
+// Vector arithmetic functions accept any float blob of the configured
+// dimension that vector_distance accepts and return float32 blobs.
+
+// decodeFloatArgs decodes the arguments of the SQL function name as float
+// blobs of the configured dimension. Typed blobs from different models are
+// rejected, as by vector_distance.
+func (cfg *config) decodeFloatArgs(name string, blobs ...[]byte) ([][]float32, error) {
+	vs := make([][]float32, len(blobs))
+	model := ""
+	for i, b := range blobs {
+		v, m, err := cfg.decodeFloats(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		if err := checkModels(model, m); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		if m != "" {
+			model = m
+		}
+		vs[i] = v
+	}
+	return vs, nil
+}
+
+// elementwiseFunc returns a SQL function named name that applies op to the
+// corresponding values of two vectors.
+func elementwiseFunc(name string, cfg *config, op func(x, y float32) float32) *sqlite.FunctionImpl {
+	return &sqlite.FunctionImpl{
+		NArgs:         2,
+		Deterministic: true,
+		Scalar: func(ctx sqlite.Context, args []sqlite.Value) (sqlite.Value, error) {
+			if args[0].Type() == sqlite.TypeNull || args[1].Type() == sqlite.TypeNull {
+				return sqlite.Value{}, nil
+			}
+			vs, err := cfg.decodeFloatArgs(name, args[0].Blob(), args[1].Blob())
+			if err != nil {
+				return sqlite.Value{}, err
+			}
+			a, b := vs[0], vs[1]
+			for i := range a {
+				a[i] = op(a[i], b[i])
+			}
+			return sqlite.BlobValue(Float32ToBlob(a)), nil
+		},
+	}
+}
+
+// scaleFunc returns the vector_scale SQL function.
+func scaleFunc(cfg *config) *sqlite.FunctionImpl {
+	name := cfg.funcName("_scale")
+	return &sqlite.FunctionImpl{
+		NArgs:         2,
+		Deterministic: true,
+		Scalar: func(ctx sqlite.Context, args []sqlite.Value) (sqlite.Value, error) {
+			if args[0].Type() == sqlite.TypeNull || args[1].Type() == sqlite.TypeNull {
+				return sqlite.Value{}, nil
+			}
+			vs, err := cfg.decodeFloatArgs(name, args[0].Blob())
+			if err != nil {
+				return sqlite.Value{}, err
+			}
+			v, factor := vs[0], args[1].Float()
+			for i := range v {
+				v[i] = float32(float64(v[i]) * factor)
+			}
+			return sqlite.BlobValue(Float32ToBlob(v)), nil
+		},
+	}
+}
+
+// normalizeFunc returns the vector_normalize SQL function. A zero vector has
+// no direction and is returned unchanged.
+func normalizeFunc(cfg *config) *sqlite.FunctionImpl {
+	name := cfg.funcName("_normalize")
+	return &sqlite.FunctionImpl{
+		NArgs:         1,
+		Deterministic: true,
+		Scalar: func(ctx sqlite.Context, args []sqlite.Value) (sqlite.Value, error) {
+			if args[0].Type() == sqlite.TypeNull {
+				return sqlite.Value{}, nil
+			}
+			vs, err := cfg.decodeFloatArgs(name, args[0].Blob())
+			if err != nil {
+				return sqlite.Value{}, err
+			}
+			v := vs[0]
+			if n := norm(v); n != 0 {
+				for i := range v {
+					v[i] = float32(float64(v[i]) / n)
+				}
+			}
+			return sqlite.BlobValue(Float32ToBlob(v)), nil
+		},
+	}
+}
+
+// normFunc returns the vector_norm SQL function.
+func normFunc(cfg *config) *sqlite.FunctionImpl {
+	name := cfg.funcName("_norm")
+	return &sqlite.FunctionImpl{
+		NArgs:         1,
+		Deterministic: true,
+		Scalar: func(ctx sqlite.Context, args []sqlite.Value) (sqlite.Value, error) {
+			if args[0].Type() == sqlite.TypeNull {
+				return sqlite.Value{}, nil
+			}
+			vs, err := cfg.decodeFloatArgs(name, args[0].Blob())
+			if err != nil {
+				return sqlite.Value{}, err
+			}
+			return sqlite.FloatValue(norm(vs[0])), nil
+		},
+	}
+}
+
+// dotFunc returns the vector_dot SQL function: the inner product itself,
+// unlike vector_distance_dot, which negates it for ordering.
+func dotFunc(cfg *config) *sqlite.FunctionImpl {
+	name := cfg.funcName("_dot")
+	return &sqlite.FunctionImpl{
+		NArgs:         2,
+		Deterministic: true,
+		Scalar: func(ctx sqlite.Context, args []sqlite.Value) (sqlite.Value, error) {
+			if args[0].Type() == sqlite.TypeNull || args[1].Type() == sqlite.TypeNull {
+				return sqlite.Value{}, nil
+			}
+			vs, err := cfg.decodeFloatArgs(name, args[0].Blob(), args[1].Blob())
+			if err != nil {
+				return sqlite.Value{}, err
+			}
+			return sqlite.FloatValue(dot(vs[0], vs[1])), nil
+		},
+	}
+}
+
+// dimsFunc returns the vector_dims SQL function.
+func dimsFunc(cfg *config) *sqlite.FunctionImpl {
+	name := cfg.funcName("_dims")
+	return &sqlite.FunctionImpl{
+		NArgs:         1,
+		Deterministic: true,
+		Scalar: func(ctx sqlite.Context, args []sqlite.Value) (sqlite.Value, error) {
+			if args[0].Type() == sqlite.TypeNull {
+				return sqlite.Value{}, nil
+			}
+			vs, err := cfg.decodeFloatArgs(name, args[0].Blob())
+			if err != nil {
+				return sqlite.Value{}, err
+			}
+			return sqlite.IntegerValue(int64(len(vs[0]))), nil
+		},
+	}
+}
+
+func norm(v []float32) float64 {
+	return math.Sqrt(dot(v, v))
+}
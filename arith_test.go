@@ -0,0 +1,137 @@
+package vector
+
+import (
+	"math"
+	"testing"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestVectorArithmetic(t *testing.T) {
+	conn := openTestConn(t)
+	if err := Register(conn, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	vectorTests := []struct {
+		name  string
+		query string
+		want  []float32
+	}{
+		{"add", "SELECT vector_add(vector_encode('[1,2,3]'), vector_encode('[4,5,6]'))", []float32{5, 7, 9}},
+		{"sub", "SELECT vector_sub(vector_encode('[1,2,3]'), vector_encode('[4,5,6]'))", []float32{-3, -3, -3}},
+		{"scale", "SELECT vector_scale(vector_encode('[1,2,3]'), -0.5)", []float32{-0.5, -1, -1.5}},
+		{"normalize", "SELECT vector_normalize(vector_encode('[3,0,4]'))", []float32{0.6, 0, 0.8}},
+		{"normalize zero", "SELECT vector_normalize(vector_encode('[0,0,0]'))", []float32{0, 0, 0}},
+		{"analogy", "SELECT vector_add(vector_sub(vector_encode('[1,1,0]'), vector_encode('[1,0,0]')), vector_encode('[0,0,1]'))", []float32{0, 1, 1}},
+		{"half-precision input", "SELECT vector_add(vector_to_f16(vector_encode('[1,2,3]')), vector_encode('[1,1,1]'))", []float32{2, 3, 4}},
+	}
+	for _, tt := range vectorTests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []byte
+			err := sqlitex.ExecuteTransient(conn, tt.query, &sqlitex.ExecOptions{
+				ResultFunc: func(stmt *sqlite.Stmt) error {
+					got = make([]byte, stmt.ColumnLen(0))
+					stmt.ColumnBytes(0, got)
+					return nil
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			v, err := BlobToFloat32(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(v) != len(tt.want) {
+				t.Fatalf("%s = %v, want %v", tt.query, v, tt.want)
+			}
+			for i := range v {
+				if math.Abs(float64(v[i]-tt.want[i])) > 1e-6 {
+					t.Fatalf("%s = %v, want %v", tt.query, v, tt.want)
+				}
+			}
+		})
+	}
+
+	scalarTests := []struct {
+		name  string
+		query string
+		want  float64
+	}{
+		{"norm", "SELECT vector_norm(vector_encode('[3,0,4]'))", 5},
+		{"dot", "SELECT vector_dot(vector_encode('[1,2,3]'), vector_encode('[4,5,6]'))", 32},
+		{"dims", "SELECT vector_dims(vector_encode('[1,2,3]'))", 3},
+		{"normalized norm", "SELECT vector_norm(vector_normalize(vector_encode('[1,2,3]')))", 1},
+	}
+	for _, tt := range scalarTests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got float64
+			err := sqlitex.ExecuteTransient(conn, tt.query, &sqlitex.ExecOptions{
+				ResultFunc: func(stmt *sqlite.Stmt) error {
+					got = stmt.ColumnFloat(0)
+					return nil
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(got-tt.want) > 1e-6 {
+				t.Errorf("%s = %v, want %v", tt.query, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("NULL inputs return NULL", func(t *testing.T) {
+		for _, query := range []string{
+			"SELECT vector_add(NULL, vector_encode('[1,2,3]'))",
+			"SELECT vector_sub(vector_encode('[1,2,3]'), NULL)",
+			"SELECT vector_scale(vector_encode('[1,2,3]'), NULL)",
+			"SELECT vector_scale(NULL, 2)",
+			"SELECT vector_normalize(NULL)",
+			"SELECT vector_norm(NULL)",
+			"SELECT vector_dot(NULL, NULL)",
+			"SELECT vector_dims(NULL)",
+		} {
+			var isNull bool
+			err := sqlitex.ExecuteTransient(conn, query, &sqlitex.ExecOptions{
+				ResultFunc: func(stmt *sqlite.Stmt) error {
+					isNull = stmt.ColumnType(0) == sqlite.TypeNull
+					return nil
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !isNull {
+				t.Errorf("%s is not NULL", query)
+			}
+		}
+	})
+}
+
+func TestDecodeFloatArgs(t *testing.T) {
+	cfg := &config{name: "vector", dim: 3}
+	a, _ := TypedToBlob([]float32{1, 2, 3}, ElementFloat32, "a")
+	b, _ := TypedToBlob([]float32{1, 2, 3}, ElementFloat32, "b")
+	plain := Float32ToBlob([]float32{1, 2, 3})
+
+	tests := []struct {
+		name    string
+		args    [][]byte
+		wantErr bool
+	}{
+		{"float32", [][]byte{plain, plain}, false},
+		{"same model", [][]byte{a, plain, a}, false},
+		{"different models", [][]byte{a, plain, b}, true},
+		{"wrong dimension", [][]byte{plain, Float32ToBlob([]float32{1, 2})}, true},
+		{"quantized", [][]byte{quantize([]float32{1, 2, 3}, -1, 1)}, true},
+	}
+	for _, tt := range tests {
+		_, err := cfg.decodeFloatArgs("vector_add", tt.args...)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: decodeFloatArgs error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
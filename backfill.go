@@ -0,0 +1,332 @@
+package vector
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+const (
+	defaultBackfillBatchSize = 64
+	defaultBackfillInterval  = 30 * time.Second
+	// backfillCheckEvery is how many rows the scan for pending rows reads
+	// between checks of its context.
+	backfillCheckEvery = 1024
+)
+
+// A Backfiller fills a table's embedding column from its text column
+// outside of SQL, so that no transaction is held open while the Embedder
+// makes network requests. A row needs an embedding when its text is not
+// NULL and either its embedding is NULL or its text has changed since the
+// Backfiller embedded it.
+//
+// Each pass scans the table for such rows, embeds them in batches and
+// writes each batch back in its own short transaction. A row whose text
+// changes between being read and being written is left for the next pass.
+// The SHA-256 hash of the text each embedding was made from is kept in the
+// <table>_<vector column>_backfill table, so a Backfiller stopped at any
+// point resumes where it left off. Embeddings already present when the
+// Backfiller first sees a row are assumed to be current.
+//
+// Conn is used only by the Backfiller while it runs, so it should be a
+// dedicated connection to the database.
+type Backfiller struct {
+	Conn         *sqlite.Conn
+	Embedder     Embedder
+	Table        string
+	TextColumn   string
+	VectorColumn string
+	Dim          int // dimension every embedding must have
+
+	// BatchSize is the number of texts embedded at once, in a single
+	// EmbedBatch call if Embedder is a BatchEmbedder. It defaults to 64.
+	BatchSize int
+	// Interval is how long Run waits after a pass that writes nothing. It
+	// defaults to 30 seconds.
+	Interval time.Duration
+	// Progress, if not nil, is called after each batch is written.
+	Progress func(BackfillProgress)
+}
+
+// BackfillProgress reports the state of a Backfiller pass.
+type BackfillProgress struct {
+	Pending  int // rows found needing an embedding when the pass began
+	Embedded int // rows embedded and written so far
+	Skipped  int // rows changed or deleted before their embedding was written
+}
+
+type pendingRow struct {
+	id    int64
+	text  string
+	value any // the column value text was read from, to match on write
+}
+
+// Run runs passes until ctx is done, waiting Interval after any pass that
+// wrote nothing. It returns ctx.Err() once ctx is done, after
+// writing any batch already embedded, or the first error of a pass.
+func (b *Backfiller) Run(ctx context.Context) error {
+	for {
+		p, err := b.RunOnce(ctx)
+		if err != nil {
+			return err
+		}
+		if p.Embedded > 0 {
+			continue
+		}
+		interval := b.Interval
+		if interval <= 0 {
+			interval = defaultBackfillInterval
+		}
+		t := time.NewTimer(interval)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// RunOnce runs a single pass and returns its progress. Rows that change
+// while the pass runs are left for the next pass.
+func (b *Backfiller) RunOnce(ctx context.Context) (BackfillProgress, error) {
+	var p BackfillProgress
+	if b.Dim < 1 {
+		return p, fmt.Errorf("vector: backfill dimension must be >= 1, got %d", b.Dim)
+	}
+	if b.Embedder == nil {
+		return p, fmt.Errorf("vector: backfill needs an Embedder")
+	}
+	if err := b.createTable(); err != nil {
+		return p, err
+	}
+	pending, err := b.scan(ctx)
+	if err != nil {
+		return p, err
+	}
+	p.Pending = len(pending)
+	batchSize := b.BatchSize
+	if batchSize < 1 {
+		batchSize = defaultBackfillBatchSize
+	}
+	for start := 0; start < len(pending); start += batchSize {
+		if err := ctx.Err(); err != nil {
+			return p, err
+		}
+		ids := pending[start:min(start+batchSize, len(pending))]
+		batch, err := b.load(ids)
+		if err != nil {
+			return p, err
+		}
+		written := 0
+		if len(batch) > 0 {
+			vecs, err := b.embed(ctx, batch)
+			if err != nil {
+				return p, err
+			}
+			if written, err = b.write(batch, vecs); err != nil {
+				return p, err
+			}
+		}
+		p.Embedded += written
+		p.Skipped += len(ids) - written
+		if b.Progress != nil {
+			b.Progress(p)
+		}
+	}
+	return p, nil
+}
+
+func (b *Backfiller) hashTable() string {
+	return quoteIdent(b.Table + "_" + b.VectorColumn + "_backfill")
+}
+
+func (b *Backfiller) createTable() error {
+	err := sqlitex.ExecuteTransient(b.Conn,
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id INTEGER PRIMARY KEY, hash BLOB NOT NULL)", b.hashTable()), nil)
+	if err != nil {
+		return fmt.Errorf("vector: backfill: %v", err)
+	}
+	return nil
+}
+
+func textHash(text string) []byte {
+	h := sha256.Sum256([]byte(text))
+	return h[:]
+}
+
+// scan returns the IDs of the rows that need an embedding. It records the hash of
+// rows that already have an embedding but no recorded hash, and forgets
+// the hashes of deleted rows.
+func (b *Backfiller) scan(ctx context.Context) ([]int64, error) {
+	var pending []int64
+	var adopt []int64
+	var adoptHashes [][]byte
+	query := fmt.Sprintf("SELECT t.rowid, t.%s, t.%s IS NULL, h.hash FROM %s AS t LEFT JOIN %s AS h ON h.id = t.rowid WHERE t.%[1]s IS NOT NULL",
+		quoteIdent(b.TextColumn), quoteIdent(b.VectorColumn), quoteIdent(b.Table), b.hashTable())
+	n := 0
+	err := sqlitex.ExecuteTransient(b.Conn, query, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			if n++; n%backfillCheckEvery == 0 {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+			}
+			id, text := stmt.ColumnInt64(0), stmt.ColumnText(1)
+			h := textHash(text)
+			missing := stmt.ColumnBool(2)
+			switch {
+			case stmt.ColumnType(3) == sqlite.TypeNull && !missing:
+				adopt = append(adopt, id)
+				adoptHashes = append(adoptHashes, h)
+			case missing:
+				pending = append(pending, id)
+			default:
+				recorded := make([]byte, stmt.ColumnLen(3))
+				stmt.ColumnBytes(3, recorded)
+				if !bytes.Equal(recorded, h) {
+					pending = append(pending, id)
+				}
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("vector: backfill: %w", err)
+	}
+	if err := b.recordHashes(adopt, adoptHashes); err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+// recordHashes records hashes for rows that already have embeddings and
+// removes the hashes of deleted rows in one transaction.
+func (b *Backfiller) recordHashes(ids []int64, hashes [][]byte) (err error) {
+	endFn, err := sqlitex.ImmediateTransaction(b.Conn)
+	if err != nil {
+		return fmt.Errorf("vector: backfill: %v", err)
+	}
+	defer endFn(&err)
+	for i, id := range ids {
+		err = sqlitex.Execute(b.Conn, fmt.Sprintf("INSERT OR REPLACE INTO %s (id, hash) VALUES (?, ?)", b.hashTable()),
+			&sqlitex.ExecOptions{Args: []any{id, hashes[i]}})
+		if err != nil {
+			return fmt.Errorf("vector: backfill: %v", err)
+		}
+	}
+	err = sqlitex.ExecuteTransient(b.Conn,
+		fmt.Sprintf("DELETE FROM %s WHERE id NOT IN (SELECT rowid FROM %s)", b.hashTable(), quoteIdent(b.Table)), nil)
+	if err != nil {
+		return fmt.Errorf("vector: backfill: %v", err)
+	}
+	return nil
+}
+
+// load reads the current text of the rows in ids, skipping rows that were
+// deleted or whose text is now NULL. Texts are read per batch rather than
+// during the scan so that a pass over a large table holds only row IDs.
+func (b *Backfiller) load(ids []int64) ([]pendingRow, error) {
+	rows := make([]pendingRow, 0, len(ids))
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE rowid = ? AND %[1]s IS NOT NULL", quoteIdent(b.TextColumn), quoteIdent(b.Table))
+	for _, id := range ids {
+		err := sqlitex.Execute(b.Conn, query, &sqlitex.ExecOptions{
+			Args: []any{id},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				// Read the value before the text: converting a blob to
+				// text changes the type sqlite reports for the column.
+				value := columnValue(stmt, 0)
+				rows = append(rows, pendingRow{id: id, text: stmt.ColumnText(0), value: value})
+				return nil
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("vector: backfill: %v", err)
+		}
+	}
+	return rows, nil
+}
+
+// columnValue returns column col of stmt as the Go value that binds back
+// to the same SQLite value, so a row can be matched on the value it held
+// even when the text column stores integers, reals or blobs.
+func columnValue(stmt *sqlite.Stmt, col int) any {
+	switch stmt.ColumnType(col) {
+	case sqlite.TypeInteger:
+		return stmt.ColumnInt64(col)
+	case sqlite.TypeFloat:
+		return stmt.ColumnFloat(col)
+	case sqlite.TypeBlob:
+		b := make([]byte, stmt.ColumnLen(col))
+		stmt.ColumnBytes(col, b)
+		return b
+	case sqlite.TypeNull:
+		return nil
+	}
+	return stmt.ColumnText(col)
+}
+
+func (b *Backfiller) embed(ctx context.Context, rows []pendingRow) ([][]float32, error) {
+	texts := make([]string, len(rows))
+	for i, r := range rows {
+		texts[i] = r.text
+	}
+	var vecs [][]float32
+	if be, ok := b.Embedder.(BatchEmbedder); ok {
+		var err error
+		if vecs, err = be.EmbedBatch(ctx, texts); err != nil {
+			return nil, fmt.Errorf("vector: backfill: %w", err)
+		}
+		if len(vecs) != len(texts) {
+			return nil, fmt.Errorf("vector: backfill: embedder returned %d vectors for %d texts", len(vecs), len(texts))
+		}
+	} else {
+		for _, text := range texts {
+			v, err := b.Embedder.Embed(ctx, text)
+			if err != nil {
+				return nil, fmt.Errorf("vector: backfill: %w", err)
+			}
+			vecs = append(vecs, v)
+		}
+	}
+	for _, v := range vecs {
+		if len(v) != b.Dim {
+			return nil, fmt.Errorf("vector: backfill: embedder returned dimension %d, expected %d", len(v), b.Dim)
+		}
+	}
+	return vecs, nil
+}
+
+// write stores a batch of embeddings in one transaction, skipping rows
+// whose text column no longer holds the value that was embedded, and
+// returns the number of rows written.
+func (b *Backfiller) write(rows []pendingRow, vecs [][]float32) (written int, err error) {
+	endFn, err := sqlitex.ImmediateTransaction(b.Conn)
+	if err != nil {
+		return 0, fmt.Errorf("vector: backfill: %v", err)
+	}
+	defer endFn(&err)
+	update := fmt.Sprintf("UPDATE %s SET %s = ? WHERE rowid = ? AND %s IS ?",
+		quoteIdent(b.Table), quoteIdent(b.VectorColumn), quoteIdent(b.TextColumn))
+	record := fmt.Sprintf("INSERT OR REPLACE INTO %s (id, hash) VALUES (?, ?)", b.hashTable())
+	for i, r := range rows {
+		err = sqlitex.Execute(b.Conn, update, &sqlitex.ExecOptions{Args: []any{Float32ToBlob(vecs[i]), r.id, r.value}})
+		if err != nil {
+			return 0, fmt.Errorf("vector: backfill: %v", err)
+		}
+		if b.Conn.Changes() == 0 {
+			continue
+		}
+		err = sqlitex.Execute(b.Conn, record, &sqlitex.ExecOptions{Args: []any{r.id, textHash(r.text)}})
+		if err != nil {
+			return 0, fmt.Errorf("vector: backfill: %v", err)
+		}
+		written++
+	}
+	return written, nil
+}
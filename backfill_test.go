@@ -0,0 +1,232 @@
+package vector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func setupBackfill(t *testing.T, emb Embedder) (*sqlite.Conn, *Backfiller) {
+	t.Helper()
+	conn := setupEmbedTable(t, 10)
+	err := sqlitex.ExecuteScript(conn, `
+		UPDATE docs SET embedding = vector_encode('[0,0]') WHERE rowid >= 9;
+		UPDATE docs SET body = NULL WHERE rowid = 8;
+	`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, &Backfiller{Conn: conn, Embedder: emb, Table: "docs", TextColumn: "body", VectorColumn: "embedding", Dim: 2, BatchSize: 3}
+}
+
+func embeddingsJSON(t *testing.T, conn *sqlite.Conn) []string {
+	t.Helper()
+	var got []string
+	err := sqlitex.ExecuteTransient(conn, "SELECT coalesce(vector_to_json(embedding), 'NULL') FROM docs ORDER BY rowid", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			got = append(got, stmt.ColumnText(0))
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestBackfiller(t *testing.T) {
+	emb := &lengthEmbedder{}
+	conn, b := setupBackfill(t, emb)
+	var progress []BackfillProgress
+	b.Progress = func(p BackfillProgress) { progress = append(progress, p) }
+
+	p, err := b.RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (BackfillProgress{Pending: 7, Embedded: 7}); p != want {
+		t.Errorf("RunOnce = %+v, want %+v", p, want)
+	}
+	if want := []int{3, 3, 1}; !slices.Equal(emb.batches, want) {
+		t.Errorf("batches = %v, want %v", emb.batches, want)
+	}
+	if len(progress) != 3 || progress[0].Embedded != 3 || progress[2].Embedded != 7 {
+		t.Errorf("progress = %+v", progress)
+	}
+	want := []string{"[1,1]", "[2,1]", "[3,1]", "[4,1]", "[5,1]", "[6,1]", "[7,1]", "NULL", "[0,0]", "[0,0]"}
+	if got := embeddingsJSON(t, conn); !slices.Equal(got, want) {
+		t.Errorf("embeddings = %v, want %v", got, want)
+	}
+
+	// Nothing to do, even for a new Backfiller.
+	b2 := *b
+	if p, err := b2.RunOnce(context.Background()); err != nil || p.Pending != 0 {
+		t.Errorf("second RunOnce = %+v, %v, want nothing pending", p, err)
+	}
+
+	// Changed text is stale, including rows that had embeddings before the
+	// first pass.
+	err = sqlitex.ExecuteScript(conn, `
+		UPDATE docs SET body = 'yy' WHERE rowid = 2;
+		UPDATE docs SET body = 'zzzzz' WHERE rowid = 9;
+		DELETE FROM docs WHERE rowid = 10;
+	`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := b.RunOnce(context.Background()); err != nil || p != (BackfillProgress{Pending: 2, Embedded: 2}) {
+		t.Errorf("RunOnce after edits = %+v, %v, want 2 embedded", p, err)
+	}
+	want = []string{"[1,1]", "[2,1]", "[3,1]", "[4,1]", "[5,1]", "[6,1]", "[7,1]", "NULL", "[5,1]"}
+	if got := embeddingsJSON(t, conn); !slices.Equal(got, want) {
+		t.Errorf("embeddings = %v, want %v", got, want)
+	}
+	var hashes int
+	err = sqlitex.ExecuteTransient(conn, "SELECT count(*) FROM docs_embedding_backfill", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			hashes = stmt.ColumnInt(0)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashes != 8 {
+		t.Errorf("%d recorded hashes, want 8 after the delete", hashes)
+	}
+}
+
+// editingEmbedder changes row 1's text while its batch is being embedded.
+type editingEmbedder struct {
+	lengthEmbedder
+	conn *sqlite.Conn
+	done bool
+}
+
+func (e *editingEmbedder) EmbedBatch(ctx context.Context, texts []string) ([][]float32, error) {
+	if !e.done {
+		e.done = true
+		if err := sqlitex.ExecuteTransient(e.conn, "UPDATE docs SET body = 'changed' WHERE rowid = 1", nil); err != nil {
+			return nil, err
+		}
+	}
+	return e.lengthEmbedder.EmbedBatch(ctx, texts)
+}
+
+func TestBackfillerConcurrentEdit(t *testing.T) {
+	emb := &editingEmbedder{}
+	conn, b := setupBackfill(t, emb)
+	emb.conn = conn
+	p, err := b.RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (BackfillProgress{Pending: 7, Embedded: 6, Skipped: 1}); p != want {
+		t.Errorf("RunOnce = %+v, want %+v", p, want)
+	}
+	if got := embeddingsJSON(t, conn)[0]; got != "NULL" {
+		t.Errorf("row 1 embedding = %s, want NULL until the next pass", got)
+	}
+	if p, err := b.RunOnce(context.Background()); err != nil || p != (BackfillProgress{Pending: 1, Embedded: 1}) {
+		t.Errorf("next RunOnce = %+v, %v", p, err)
+	}
+	if got := embeddingsJSON(t, conn)[0]; got != fmt.Sprintf("[%d,1]", len("changed")) {
+		t.Errorf("row 1 embedding = %s", got)
+	}
+}
+
+func TestBackfillerRun(t *testing.T) {
+	emb := &lengthEmbedder{}
+	conn, b := setupBackfill(t, emb)
+	b.Interval = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	b.Progress = func(p BackfillProgress) {
+		if p.Embedded == p.Pending {
+			cancel()
+		}
+	}
+	if err := b.Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Run = %v, want context.Canceled", err)
+	}
+	if got := embeddingsJSON(t, conn)[6]; got != "[7,1]" {
+		t.Errorf("row 7 embedding = %s, want [7,1]: the last batch should be written before Run returns", got)
+	}
+}
+
+func TestBackfillerNonTextColumn(t *testing.T) {
+	conn, b := setupBackfill(t, &lengthEmbedder{})
+	err := sqlitex.ExecuteScript(conn, `
+		UPDATE docs SET body = 42 WHERE rowid = 1;
+		UPDATE docs SET body = 2.5 WHERE rowid = 2;
+		UPDATE docs SET body = x'616263' WHERE rowid = 3;
+	`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := b.RunOnce(context.Background()); err != nil || p != (BackfillProgress{Pending: 7, Embedded: 7}) {
+		t.Errorf("RunOnce = %+v, %v, want all 7 embedded", p, err)
+	}
+	if got, want := embeddingsJSON(t, conn)[:3], []string{"[2,1]", "[3,1]", "[3,1]"}; !slices.Equal(got, want) {
+		t.Errorf("embeddings = %v, want %v", got, want)
+	}
+	if p, err := b.RunOnce(context.Background()); err != nil || p.Pending != 0 {
+		t.Errorf("second RunOnce = %+v, %v, want nothing pending", p, err)
+	}
+}
+
+// churningEmbedder changes row 1's text on every call, so its embedding can
+// never be written.
+type churningEmbedder struct {
+	lengthEmbedder
+	conn  *sqlite.Conn
+	calls int
+}
+
+func (e *churningEmbedder) EmbedBatch(ctx context.Context, texts []string) ([][]float32, error) {
+	e.calls++
+	err := sqlitex.Execute(e.conn, "UPDATE docs SET body = ? WHERE rowid = 1", &sqlitex.ExecOptions{Args: []any{fmt.Sprint("churn ", e.calls)}})
+	if err != nil {
+		return nil, err
+	}
+	return e.lengthEmbedder.EmbedBatch(ctx, texts)
+}
+
+func TestBackfillerRunWaitsWhenNothingIsWritten(t *testing.T) {
+	emb := &churningEmbedder{}
+	conn, b := setupBackfill(t, emb)
+	emb.conn = conn
+	if _, err := b.RunOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	emb.calls = 0
+
+	// Row 1 is pending on every pass but never written, so Run must sleep
+	// between passes rather than retry it immediately.
+	b.Interval = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := b.Run(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Run = %v, want context.DeadlineExceeded", err)
+	}
+	if emb.calls != 1 {
+		t.Errorf("embedder called %d times, want 1 before waiting out Interval", emb.calls)
+	}
+}
+
+func TestBackfillerErrors(t *testing.T) {
+	_, b := setupBackfill(t, &mockEmbedder{vec: []float32{1, 2, 3}})
+	if _, err := b.RunOnce(context.Background()); err == nil || !strings.Contains(err.Error(), "dimension 3, expected 2") {
+		t.Errorf("err = %v, want a dimension error", err)
+	}
+	b.Dim = 0
+	if _, err := b.RunOnce(context.Background()); err == nil {
+		t.Error("RunOnce accepted dimension 0")
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"math/rand"
 	"testing"
+
+	"zombiezen.com/go/sqlite"
 )
 
 func randomFloat32s(n int) []float32 {
@@ -30,12 +32,13 @@ func BenchmarkL2Distance(b *testing.B) {
 
 func BenchmarkQuantize(b *testing.B) {
 	for _, dim := range []int{384, 768, 1536} {
+		cfg := &config{dim: dim, quantMin: -1.0, quantMax: 1.0, quantEnabled: true}
 		v := randomFloat32s(dim)
 		b.Run("dim="+itoa(dim), func(b *testing.B) {
 			b.ReportAllocs()
 			b.ResetTimer()
 			for i := 0; i < b.N; i++ {
-				quantize(v, -1.0, 1.0)
+				cfg.quantize(v)
 			}
 		})
 	}
@@ -43,13 +46,80 @@ func BenchmarkQuantize(b *testing.B) {
 
 func BenchmarkDequantize(b *testing.B) {
 	for _, dim := range []int{384, 768, 1536} {
-		v := randomFloat32s(dim)
-		qblob := quantize(v, -1.0, 1.0)
+		cfg := &config{dim: dim, quantMin: -1.0, quantMax: 1.0, quantEnabled: true}
+		qblob := cfg.quantize(randomFloat32s(dim))
+		b.Run("dim="+itoa(dim), func(b *testing.B) {
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				cfg.dequantize(qblob)
+			}
+		})
+	}
+}
+
+func BenchmarkQuantDistance(b *testing.B) {
+	for _, m := range []Metric{MetricL2, MetricCosine, MetricDot} {
+		for _, dim := range []int{384, 768, 1536} {
+			cfg := &config{dim: dim, quantMin: -1.0, quantMax: 1.0, quantEnabled: true}
+			blobA := cfg.quantize(randomFloat32s(dim))
+			blobB := cfg.quantize(randomFloat32s(dim))
+			b.Run(m.String()+"/dim="+itoa(dim), func(b *testing.B) {
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					qa, ma, _ := cfg.parseQuant(blobA)
+					qb, mb, _ := cfg.parseQuant(blobB)
+					quantDistance(m, qa, ma, qb, mb)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkVectorDistanceQ measures vector_distance_q through SQL, so it
+// includes the cost of the function call and of reading its arguments.
+func BenchmarkVectorDistanceQ(b *testing.B) {
+	for _, dim := range []int{384, 768, 1536} {
+		b.Run("dim="+itoa(dim), func(b *testing.B) {
+			conn, err := sqlite.OpenConn(":memory:")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			if err := Register(conn, dim, WithQuantRange(-1.0, 1.0)); err != nil {
+				b.Fatal(err)
+			}
+			cfg := &config{dim: dim, quantMin: -1.0, quantMax: 1.0, quantEnabled: true}
+			stmt := conn.Prep("SELECT vector_distance_q(?1, ?2)")
+			stmt.BindBytes(1, cfg.quantize(randomFloat32s(dim)))
+			stmt.BindBytes(2, cfg.quantize(randomFloat32s(dim)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := stmt.Step(); err != nil {
+					b.Fatal(err)
+				}
+				stmt.Reset()
+			}
+		})
+	}
+}
+
+// BenchmarkQuantDistanceDequantize is the cost vector_distance_q paid before
+// it computed distances on the int8 levels.
+func BenchmarkQuantDistanceDequantize(b *testing.B) {
+	for _, dim := range []int{384, 768, 1536} {
+		cfg := &config{dim: dim, quantMin: -1.0, quantMax: 1.0, quantEnabled: true}
+		blobA := cfg.quantize(randomFloat32s(dim))
+		blobB := cfg.quantize(randomFloat32s(dim))
 		b.Run("dim="+itoa(dim), func(b *testing.B) {
 			b.ReportAllocs()
 			b.ResetTimer()
 			for i := 0; i < b.N; i++ {
-				dequantize(qblob, -1.0, 1.0)
+				va, _ := cfg.dequantize(blobA)
+				vb, _ := cfg.dequantize(blobB)
+				l2Squared(va, vb)
 			}
 		})
 	}
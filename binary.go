@@ -0,0 +1,111 @@
+package vector
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+
+	"zombiezen.com/go/sqlite"
+)
+
+// Binary quantization keeps one bit per dimension: bit i is set when
+// v[i] > 0. Bits are packed least significant first, so dimension i lives in
+// bit i%8 of byte i/8 after the header; unused bits of the last byte are
+// zero. The Hamming distance between two codes counts the dimensions whose
+// signs differ and is a cheap first-pass filter before rescoring the
+// survivors against their float32 vectors.
+
+const binaryVersion = 0x01
+
+func isBinaryBlob(b []byte) bool {
+	return len(b) >= 2 && b[0] == formatBinary && b[1] == binaryVersion
+}
+
+// binaryLen returns the byte length of a binary blob for dim dimensions.
+func binaryLen(dim int) int {
+	return 2 + (dim+7)/8
+}
+
+func quantizeBinary(v []float32) []byte {
+	b := make([]byte, binaryLen(len(v)))
+	b[0] = formatBinary
+	b[1] = binaryVersion
+	for i, f := range v {
+		if f > 0 {
+			b[2+i/8] |= 1 << (i % 8)
+		}
+	}
+	return b
+}
+
+// hamming returns the number of differing bits between two equal-length
+// bit-packed payloads, counting a uint64 word at a time.
+func hamming(a, b []byte) int {
+	n := 0
+	for len(a) >= 8 {
+		n += bits.OnesCount64(binary.LittleEndian.Uint64(a) ^ binary.LittleEndian.Uint64(b))
+		a, b = a[8:], b[8:]
+	}
+	for i := range a {
+		n += bits.OnesCount8(a[i] ^ b[i])
+	}
+	return n
+}
+
+// quantizeBinaryFunc returns the vector_quantize_binary SQL function.
+func quantizeBinaryFunc(cfg *config) *sqlite.FunctionImpl {
+	name := cfg.funcName("_quantize_binary")
+	return &sqlite.FunctionImpl{
+		NArgs:         1,
+		Deterministic: true,
+		Scalar: func(ctx sqlite.Context, args []sqlite.Value) (sqlite.Value, error) {
+			if args[0].Type() == sqlite.TypeNull {
+				return sqlite.Value{}, nil
+			}
+			blob := args[0].Blob()
+			expected := cfg.dim * 4
+			if len(blob) != expected {
+				if f := blobFormatName(blob); f != "" {
+					return sqlite.Value{}, fmt.Errorf("%s: input is %s, expected float32", name, f)
+				}
+				return sqlite.Value{}, fmt.Errorf("%s: expected %d bytes (dim=%d), got %d", name, expected, cfg.dim, len(blob))
+			}
+			floats, _ := BlobToFloat32(blob)
+			return sqlite.BlobValue(quantizeBinary(floats)), nil
+		},
+	}
+}
+
+// hammingDistanceFunc returns the vector_distance_hamming SQL function.
+func hammingDistanceFunc(cfg *config) *sqlite.FunctionImpl {
+	name := cfg.funcName("_distance_hamming")
+	return &sqlite.FunctionImpl{
+		NArgs:         2,
+		Deterministic: true,
+		Scalar: func(ctx sqlite.Context, args []sqlite.Value) (sqlite.Value, error) {
+			if args[0].Type() == sqlite.TypeNull || args[1].Type() == sqlite.TypeNull {
+				return sqlite.Value{}, nil
+			}
+			blobA := args[0].Blob()
+			blobB := args[1].Blob()
+			expected := binaryLen(cfg.dim)
+			for i, b := range [][]byte{blobA, blobB} {
+				input := "ab"[i]
+				if !isBinaryBlob(b) {
+					switch f := blobFormatName(b); {
+					case f != "":
+						return sqlite.Value{}, fmt.Errorf("%s: input %c is %s, expected binary-quantized", name, input, f)
+					case len(b) == cfg.dim*4:
+						return sqlite.Value{}, fmt.Errorf("%s: input %c is float32, use %s", name, input, cfg.funcName("_quantize_binary"))
+					default:
+						return sqlite.Value{}, fmt.Errorf("%s: input %c is not binary-quantized (missing magic bytes)", name, input)
+					}
+				}
+				if len(b) != expected {
+					return sqlite.Value{}, fmt.Errorf("%s: expected %d bytes (dim=%d), got %d", name, expected, cfg.dim, len(b))
+				}
+			}
+			return sqlite.IntegerValue(int64(hamming(blobA[2:], blobB[2:]))), nil
+		},
+	}
+}
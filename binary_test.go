@@ -0,0 +1,164 @@
+package vector
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestQuantizeBinary(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []float32
+		want  []byte
+	}{
+		{"signs", []float32{1, -1, 0.5, 0, -0.5, 2, 3, -3}, []byte{0x02, 0x01, 0b01100101}},
+		{"partial byte", []float32{1, 1, 1, 1, 1, 1, 1, 1, -1, 1}, []byte{0x02, 0x01, 0xff, 0b10}},
+		{"zero is unset", []float32{0}, []byte{0x02, 0x01, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := quantizeBinary(tt.input)
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("quantizeBinary(%v) = %08b, want %08b", tt.input, got, tt.want)
+			}
+			if len(got) != binaryLen(len(tt.input)) {
+				t.Errorf("len = %d, want binaryLen = %d", len(got), binaryLen(len(tt.input)))
+			}
+		})
+	}
+}
+
+func TestHamming(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	// 19 bytes exercise both the uint64 words and the trailing bytes.
+	a := make([]byte, 19)
+	b := make([]byte, 19)
+	rng.Read(a)
+	rng.Read(b)
+	want := 0
+	for i := range a {
+		for bit := 0; bit < 8; bit++ {
+			if (a[i]>>bit)&1 != (b[i]>>bit)&1 {
+				want++
+			}
+		}
+	}
+	if got := hamming(a, b); got != want {
+		t.Errorf("hamming = %d, want %d", got, want)
+	}
+	if got := hamming(a, a); got != 0 {
+		t.Errorf("hamming(a, a) = %d, want 0", got)
+	}
+}
+
+func TestBlobFormatName(t *testing.T) {
+	tests := []struct {
+		blob []byte
+		want string
+	}{
+		{[]byte{0x00, 0x01, 0x7f}, "int8-quantized"},
+		{[]byte{0x01, 0x01, 0x00}, "PQ-encoded"},
+		{[]byte{0x02, 0x01, 0x00}, "binary-quantized"},
+		{Float32ToBlob([]float32{1}), ""},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		if got := blobFormatName(tt.blob); got != tt.want {
+			t.Errorf("blobFormatName(%x) = %q, want %q", tt.blob, got, tt.want)
+		}
+	}
+}
+
+func TestVectorDistanceHamming(t *testing.T) {
+	conn := openTestConn(t)
+	if err := Register(conn, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("distance", func(t *testing.T) {
+		var dist int64
+		var typ sqlite.ColumnType
+		err := sqlitex.ExecuteTransient(conn,
+			"SELECT vector_distance_hamming(vector_quantize_binary(vector_encode('[1, -1, 1]')), vector_quantize_binary(vector_encode('[-1, -1, -1]')))",
+			&sqlitex.ExecOptions{
+				ResultFunc: func(stmt *sqlite.Stmt) error {
+					typ = stmt.ColumnType(0)
+					dist = stmt.ColumnInt64(0)
+					return nil
+				},
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ != sqlite.TypeInteger || dist != 2 {
+			t.Errorf("distance = %v (%v), want integer 2", dist, typ)
+		}
+	})
+
+	t.Run("NULL input", func(t *testing.T) {
+		var typ sqlite.ColumnType
+		err := sqlitex.ExecuteTransient(conn, "SELECT vector_distance_hamming(NULL, vector_quantize_binary(NULL))",
+			&sqlitex.ExecOptions{
+				ResultFunc: func(stmt *sqlite.Stmt) error {
+					typ = stmt.ColumnType(0)
+					return nil
+				},
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ != sqlite.TypeNull {
+			t.Errorf("type = %v, want NULL", typ)
+		}
+	})
+
+	t.Run("float32 input", func(t *testing.T) {
+		t.Skip("blocked on zombiezen/go/sqlite fix: resultError shadows err variable")
+		err := sqlitex.ExecuteTransient(conn,
+			"SELECT vector_distance_hamming(vector_encode('[1, 2, 3]'), vector_quantize_binary(vector_encode('[1, 2, 3]')))", nil)
+		if err == nil {
+			t.Fatal("expected error for float32 input, got nil")
+		}
+	})
+}
+
+func TestBinaryRescore(t *testing.T) {
+	const (
+		n   = 500
+		dim = 64
+		k   = 5
+	)
+	conn := openTestConn(t)
+	if err := Register(conn, dim); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlitex.ExecuteTransient(conn, "CREATE TABLE items (embedding BLOB, bits BLOB)", nil); err != nil {
+		t.Fatal(err)
+	}
+	vectors := insertRandomVectors(t, conn, "items", rand.New(rand.NewSource(1)), n, dim)
+	if err := sqlitex.ExecuteTransient(conn, "UPDATE items SET bits = vector_quantize_binary(embedding)", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Shortlist by Hamming distance, then rescore the shortlist exactly.
+	q := vectors[17]
+	got := queryKNN(t, conn, `
+		SELECT rowid FROM (
+			SELECT rowid, embedding FROM items
+			ORDER BY vector_distance_hamming(bits, vector_quantize_binary(?1))
+			LIMIT 50
+		)
+		ORDER BY vector_distance(embedding, ?1)
+		LIMIT ?2`, Float32ToBlob(q), k)
+	want := bruteForceKNN(vectors, q, k)
+	if len(got) != k || got[0] != 17 {
+		t.Fatalf("got %v, want row 17 first", got)
+	}
+	if r := recall(got, want); r < 0.6 {
+		t.Errorf("recall@%d after rescoring = %.2f, want >= 0.6 (got %v, want %v)", k, r, got, want)
+	}
+}
@@ -0,0 +1,232 @@
+package vector
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// WithEmbedCache caches the embeddings vector_embed and vector_embed_batch
+// produce in the named table of the main database, keyed by a SHA-256 hash
+// of model and the text, so identical text is only sent to the Embedder
+// once. model identifies the Embedder's model: change it when the model
+// changes so that stale embeddings are not reused. The table is created by
+// the first write. Lookups only read, so a cached text can be embedded on a
+// read-only connection; writes run on the connection, so they commit or roll
+// back with the statement that embeds the text.
+func WithEmbedCache(table, model string) Option {
+	return func(c *config) {
+		c.cache = &embedCache{table: table, model: model}
+	}
+}
+
+// embedCache is an embedding cache table:
+//
+//	CREATE TABLE <table> (
+//	    key       BLOB PRIMARY KEY, -- SHA-256 of model, a zero byte and the text
+//	    model     TEXT NOT NULL,
+//	    embedding BLOB NOT NULL,    -- float32 blob
+//	    used      INTEGER NOT NULL  -- Unix nanoseconds of the last use
+//	) WITHOUT ROWID
+//
+// hits and misses count lookups made through this registration. Hits do not
+// write: used records when each hit key was read, and the next put or evict
+// writes it back to the table.
+type embedCache struct {
+	table  string
+	model  string
+	hits   int64
+	misses int64
+	used   map[[sha256.Size]byte]int64
+}
+
+func (c *embedCache) quotedTable() string { return quoteIdent(c.table) }
+
+func (c *embedCache) key(text string) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write([]byte(c.model))
+	h.Write([]byte{0})
+	h.Write([]byte(text))
+	return [sha256.Size]byte(h.Sum(nil))
+}
+
+// createTable creates the cache table if it does not exist. It runs before
+// every write rather than once, since a rolled-back transaction can undo it.
+func (c *embedCache) createTable(conn *sqlite.Conn) error {
+	stmts := []string{
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (key BLOB PRIMARY KEY, model TEXT NOT NULL, embedding BLOB NOT NULL, used INTEGER NOT NULL) WITHOUT ROWID", c.quotedTable()),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (used)", quoteIdent(c.table+"_used"), c.quotedTable()),
+	}
+	for _, s := range stmts {
+		if err := sqlitex.Execute(conn, s, nil); err != nil {
+			return fmt.Errorf("embed cache: %v", err)
+		}
+	}
+	return nil
+}
+
+// get returns the cached embedding of text. An entry whose dimension is not
+// dim is treated as missing and is overwritten by the next put.
+func (c *embedCache) get(conn *sqlite.Conn, dim int, text string) ([]float32, bool, error) {
+	key := c.key(text)
+	var v []float32
+	err := sqlitex.Execute(conn, fmt.Sprintf("SELECT embedding FROM %s WHERE key = ?", c.quotedTable()), &sqlitex.ExecOptions{
+		Args: []any{key[:]},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			if stmt.ColumnLen(0) != dim*4 {
+				return nil
+			}
+			b := make([]byte, dim*4)
+			stmt.ColumnBytes(0, b)
+			v, _ = BlobToFloat32(b)
+			return nil
+		},
+	})
+	if err != nil {
+		exists, xerr := c.exists(conn)
+		if xerr != nil || exists {
+			return nil, false, fmt.Errorf("embed cache: %v", err)
+		}
+		// Nothing has been written yet.
+	}
+	if v == nil {
+		c.misses++
+		return nil, false, nil
+	}
+	c.hits++
+	if c.used == nil {
+		c.used = make(map[[sha256.Size]byte]int64)
+	}
+	c.used[key] = time.Now().UnixNano()
+	return v, true, nil
+}
+
+// exists reports whether the cache table exists.
+func (c *embedCache) exists(conn *sqlite.Conn) (bool, error) {
+	found := false
+	err := sqlitex.Execute(conn, "SELECT 1 FROM main.sqlite_schema WHERE type = 'table' AND name = ?", &sqlitex.ExecOptions{
+		Args: []any{c.table},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			found = true
+			return nil
+		},
+	})
+	return found, err
+}
+
+func (c *embedCache) put(conn *sqlite.Conn, text string, v []float32) error {
+	if err := c.createTable(conn); err != nil {
+		return err
+	}
+	if err := c.flushUsed(conn); err != nil {
+		return err
+	}
+	key := c.key(text)
+	err := sqlitex.Execute(conn, fmt.Sprintf("INSERT OR REPLACE INTO %s (key, model, embedding, used) VALUES (?, ?, ?, ?)", c.quotedTable()), &sqlitex.ExecOptions{
+		Args: []any{key[:], c.model, Float32ToBlob(v), time.Now().UnixNano()},
+	})
+	if err != nil {
+		return fmt.Errorf("embed cache: %v", err)
+	}
+	return nil
+}
+
+// flushUsed writes the read times of the hits since the last flush back to
+// the table. A rolled-back flush loses them, which only makes those entries
+// look older to vector_embed_cache_evict.
+func (c *embedCache) flushUsed(conn *sqlite.Conn) error {
+	for key, used := range c.used {
+		err := sqlitex.Execute(conn, fmt.Sprintf("UPDATE %s SET used = max(used, ?) WHERE key = ?", c.quotedTable()), &sqlitex.ExecOptions{
+			Args: []any{used, key[:]},
+		})
+		if err != nil {
+			return fmt.Errorf("embed cache: %v", err)
+		}
+	}
+	clear(c.used)
+	return nil
+}
+
+// cacheFuncs returns the vector_embed_cache_stats and
+// vector_embed_cache_evict table-valued functions.
+func cacheFuncs(conn *sqlite.Conn, cfg *config) []*tableFunc {
+	requireCache := func() (*embedCache, error) {
+		if cfg.cache == nil {
+			return nil, fmt.Errorf("no embed cache configured, call Register with WithEmbedCache")
+		}
+		return cfg.cache, nil
+	}
+	return []*tableFunc{
+		{
+			name:    cfg.funcName("_embed_cache_stats"),
+			columns: []string{"entries INTEGER", "model_entries INTEGER", "bytes INTEGER", "hits INTEGER", "misses INTEGER"},
+			run: func(params []sqlite.Value) ([]tableFuncRow, error) {
+				c, err := requireCache()
+				if err != nil {
+					return nil, err
+				}
+				values := []sqlite.Value{
+					sqlite.IntegerValue(0),
+					sqlite.IntegerValue(0),
+					sqlite.IntegerValue(0),
+					sqlite.IntegerValue(c.hits),
+					sqlite.IntegerValue(c.misses),
+				}
+				if exists, err := c.exists(conn); err != nil || !exists {
+					return []tableFuncRow{{values: values}}, err
+				}
+				err = sqlitex.Execute(conn,
+					fmt.Sprintf("SELECT count(*), count(*) FILTER (WHERE model = ?), coalesce(sum(length(embedding)), 0) FROM %s", c.quotedTable()),
+					&sqlitex.ExecOptions{
+						Args: []any{c.model},
+						ResultFunc: func(stmt *sqlite.Stmt) error {
+							values = []sqlite.Value{
+								sqlite.IntegerValue(stmt.ColumnInt64(0)),
+								sqlite.IntegerValue(stmt.ColumnInt64(1)),
+								sqlite.IntegerValue(stmt.ColumnInt64(2)),
+								sqlite.IntegerValue(c.hits),
+								sqlite.IntegerValue(c.misses),
+							}
+							return nil
+						},
+					})
+				if err != nil {
+					return nil, err
+				}
+				return []tableFuncRow{{values: values}}, nil
+			},
+		},
+		{
+			name:     cfg.funcName("_embed_cache_evict"),
+			columns:  []string{"evicted INTEGER"},
+			params:   []string{"max_entries"},
+			required: 1,
+			run: func(params []sqlite.Value) ([]tableFuncRow, error) {
+				c, err := requireCache()
+				if err != nil {
+					return nil, err
+				}
+				n := params[0].Int64()
+				if n < 0 {
+					return nil, fmt.Errorf("max_entries must be >= 0, got %d", n)
+				}
+				if err := c.createTable(conn); err != nil {
+					return nil, err
+				}
+				if err := c.flushUsed(conn); err != nil {
+					return nil, err
+				}
+				err = sqlitex.Execute(conn,
+					fmt.Sprintf("DELETE FROM %[1]s WHERE key NOT IN (SELECT key FROM %[1]s ORDER BY used DESC LIMIT ?)", c.quotedTable()),
+					&sqlitex.ExecOptions{Args: []any{n}})
+				if err != nil {
+					return nil, err
+				}
+				return []tableFuncRow{{values: []sqlite.Value{sqlite.IntegerValue(int64(conn.Changes()))}}}, nil
+			},
+		},
+	}
+}
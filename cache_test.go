@@ -0,0 +1,190 @@
+package vector
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+type cacheStats struct {
+	entries, modelEntries, bytes, hits, misses int64
+}
+
+func queryCacheStats(t *testing.T, conn *sqlite.Conn) cacheStats {
+	t.Helper()
+	var s cacheStats
+	err := sqlitex.ExecuteTransient(conn, "SELECT entries, model_entries, bytes, hits, misses FROM vector_embed_cache_stats()", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			s = cacheStats{stmt.ColumnInt64(0), stmt.ColumnInt64(1), stmt.ColumnInt64(2), stmt.ColumnInt64(3), stmt.ColumnInt64(4)}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestEmbedCache(t *testing.T) {
+	emb := &lengthEmbedder{}
+	conn := setupEmbedTable(t, 3, WithEmbedder(emb), WithEmbedCache("embed_cache", "m1"))
+
+	if got := queryKNN(t, conn, "SELECT id FROM vector_embed_batch('SELECT rowid, body FROM docs')"); !slices.Equal(got, []int64{1, 2, 3}) {
+		t.Fatalf("ids = %v", got)
+	}
+	if got := queryKNN(t, conn, "SELECT id FROM vector_embed_batch('SELECT rowid, body FROM docs')"); !slices.Equal(got, []int64{1, 2, 3}) {
+		t.Fatalf("cached ids = %v", got)
+	}
+	if want := []int{3}; !slices.Equal(emb.batches, want) {
+		t.Errorf("batches = %v, want %v: the second run should be served from the cache", emb.batches, want)
+	}
+
+	// vector_embed shares the cache.
+	var json string
+	err := sqlitex.ExecuteTransient(conn, "SELECT vector_to_json(vector_embed('xx'))", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			json = stmt.ColumnText(0)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json != "[2,1]" || emb.embeds != 0 {
+		t.Errorf("vector_embed('xx') = %s after %d Embed calls, want [2,1] from the cache", json, emb.embeds)
+	}
+	if got, want := queryCacheStats(t, conn), (cacheStats{3, 3, 24, 4, 3}); got != want {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+
+	// A different model does not reuse the entries.
+	if err := Register(conn, 2, WithEmbedder(emb), WithEmbedCache("embed_cache", "m2")); err != nil {
+		t.Fatal(err)
+	}
+	queryKNN(t, conn, "SELECT id FROM vector_embed_batch('SELECT rowid, body FROM docs WHERE rowid = 1')")
+	if want := []int{3, 1}; !slices.Equal(emb.batches, want) {
+		t.Errorf("batches = %v, want %v", emb.batches, want)
+	}
+	if got, want := queryCacheStats(t, conn), (cacheStats{4, 1, 32, 0, 1}); got != want {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+
+	// Eviction keeps the most recently used entries.
+	if got := queryKNN(t, conn, "SELECT evicted FROM vector_embed_cache_evict(1)"); !slices.Equal(got, []int64{3}) {
+		t.Errorf("evicted = %v, want [3]", got)
+	}
+	if got := queryCacheStats(t, conn); got.entries != 1 || got.modelEntries != 1 {
+		t.Errorf("stats after eviction = %+v, want the m2 entry only", got)
+	}
+}
+
+func TestEmbedCacheRollback(t *testing.T) {
+	emb := &lengthEmbedder{}
+	conn := setupEmbedTable(t, 1, WithEmbedder(emb), WithEmbedCache("embed_cache", "m"))
+	for _, query := range []string{
+		"BEGIN",
+		"SELECT * FROM vector_embed_batch('SELECT rowid, body FROM docs')",
+		"ROLLBACK",
+	} {
+		if err := sqlitex.ExecuteTransient(conn, query, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queryKNN(t, conn, "SELECT id FROM vector_embed_batch('SELECT rowid, body FROM docs')")
+	if want := []int{1, 1}; !slices.Equal(emb.batches, want) {
+		t.Errorf("batches = %v, want %v: the rolled-back entry should not be reused", emb.batches, want)
+	}
+}
+
+func TestEmbedCacheErrors(t *testing.T) {
+	conn := setupEmbedTable(t, 1)
+	err := sqlitex.ExecuteTransient(conn, "SELECT * FROM vector_embed_cache_stats()", nil)
+	if err == nil || !strings.Contains(err.Error(), "no embed cache configured") {
+		t.Errorf("err = %v, want no embed cache configured", err)
+	}
+}
+
+func TestEmbedCacheScalar(t *testing.T) {
+	emb := &lengthEmbedder{}
+	conn := setupEmbedTable(t, 2, WithEmbedder(emb), WithEmbedCache("embed_cache", "m"))
+	for i := 0; i < 2; i++ {
+		if err := sqlitex.ExecuteTransient(conn, "UPDATE docs SET embedding = vector_embed(body)", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if emb.embeds != 2 {
+		t.Errorf("Embed called %d times, want 2", emb.embeds)
+	}
+	if got, want := queryCacheStats(t, conn), (cacheStats{2, 2, 16, 2, 2}); got != want {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+}
+
+func TestEmbedCacheReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	emb := &lengthEmbedder{}
+	conn, err := sqlite.OpenConn(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := Register(conn, 2, WithEmbedder(emb), WithEmbedCache("embed_cache", "m")); err != nil {
+		t.Fatal(err)
+	}
+	// A lookup before the first write neither creates the table nor fails.
+	if err := sqlitex.ExecuteTransient(conn, "SELECT * FROM vector_embed_cache_stats()", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlitex.ExecuteTransient(conn, "SELECT vector_embed('xx')", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ro, err := sqlite.OpenConn(path, sqlite.OpenReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	if err := Register(ro, 2, WithEmbedder(emb), WithEmbedCache("embed_cache", "m")); err != nil {
+		t.Fatal(err)
+	}
+	var json string
+	err = sqlitex.ExecuteTransient(ro, "SELECT vector_to_json(vector_embed('xx'))", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			json = stmt.ColumnText(0)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json != "[2,1]" || emb.embeds != 1 {
+		t.Errorf("vector_embed('xx') = %s after %d Embed calls, want [2,1] from the cache", json, emb.embeds)
+	}
+	if got, want := queryCacheStats(t, ro), (cacheStats{1, 1, 8, 1, 0}); got != want {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+}
+
+func TestEmbedCacheEvictKeepsHits(t *testing.T) {
+	emb := &lengthEmbedder{}
+	conn := setupEmbedTable(t, 0, WithEmbedder(emb), WithEmbedCache("embed_cache", "m"))
+	for _, text := range []string{"a", "bb", "a"} {
+		if err := sqlitex.ExecuteTransient(conn, "SELECT vector_embed(?)", &sqlitex.ExecOptions{Args: []any{text}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// "a" was written first but read last, so it is the one kept.
+	if got := queryKNN(t, conn, "SELECT evicted FROM vector_embed_cache_evict(1)"); !slices.Equal(got, []int64{1}) {
+		t.Errorf("evicted = %v, want [1]", got)
+	}
+	if err := sqlitex.ExecuteTransient(conn, "SELECT vector_embed('a')", nil); err != nil {
+		t.Fatal(err)
+	}
+	if emb.embeds != 2 {
+		t.Errorf("Embed called %d times, want 2: the entry read last should survive eviction", emb.embeds)
+	}
+}
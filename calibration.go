@@ -0,0 +1,261 @@
+package vector
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// calibrationTable stores named calibrations as JSON so every connection on
+// a database can quantize with the same ranges.
+const calibrationTable = "vector_quant_calibration"
+
+// calibrationSamples caps the number of vectors kept to compute percentile
+// ranges.
+const calibrationSamples = 10000
+
+// Calibration holds per-dimension quantization ranges: dimension i is
+// mapped from [Min[i], Max[i]] onto the 256 int8 levels.
+type Calibration struct {
+	Min []float32 `json:"min"`
+	Max []float32 `json:"max"`
+}
+
+// WithQuantCalibration enables quantization with per-dimension ranges,
+// typically computed by Calibrate or vector_quant_calibrate and read back
+// with LoadCalibration. Whichever of WithQuantRange and WithQuantCalibration
+// comes last takes effect.
+func WithQuantCalibration(c *Calibration) Option {
+	return func(cfg *config) {
+		cfg.quantCal = c
+		cfg.quantEnabled = true
+	}
+}
+
+func (c *Calibration) validate(dim int) error {
+	if len(c.Min) != dim || len(c.Max) != dim {
+		return fmt.Errorf("calibration has %d min and %d max values, expected %d", len(c.Min), len(c.Max), dim)
+	}
+	for i := range c.Min {
+		if !(c.Max[i] >= c.Min[i]) {
+			return fmt.Errorf("calibration dimension %d has max %v below min %v", i, c.Max[i], c.Min[i])
+		}
+	}
+	return nil
+}
+
+// Calibrate computes per-dimension ranges from the float32 vectors of
+// dimension dim in table.column, skipping NULLs. Like vector_quant_calibrate,
+// it rejects any other blob, including half-float, typed and quantized ones.
+// A percentile of 100 uses each dimension's
+// minimum and maximum; a percentile p in (50, 100) uses the (100-p)th and
+// pth percentiles of a sample of the rows, so outliers are clamped instead
+// of stretching the range.
+func Calibrate(conn *sqlite.Conn, table, column string, dim int, percentile float64) (*Calibration, error) {
+	if dim < 1 {
+		return nil, fmt.Errorf("vector: dimension must be >= 1, got %d", dim)
+	}
+	cal, err := newCalibrator(percentile)
+	if err != nil {
+		return nil, fmt.Errorf("vector: %v", err)
+	}
+	err = sqlitex.Execute(conn, fmt.Sprintf("SELECT rowid, %s FROM %s WHERE %[1]s IS NOT NULL", quoteIdent(column), quoteIdent(table)),
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				b := make([]byte, stmt.ColumnLen(1))
+				stmt.ColumnBytes(1, b)
+				v, err := calibrationInput(b, dim)
+				if err != nil {
+					return fmt.Errorf("row %d: %v", stmt.ColumnInt64(0), err)
+				}
+				return cal.add(v)
+			},
+		})
+	if err != nil {
+		return nil, fmt.Errorf("vector: %v", err)
+	}
+	c := cal.result()
+	if c == nil {
+		return nil, fmt.Errorf("vector: no vectors in %s.%s", table, column)
+	}
+	return c, nil
+}
+
+// SaveCalibration stores c under name in the vector_quant_calibration
+// table, creating the table if needed.
+func SaveCalibration(conn *sqlite.Conn, name string, c *Calibration) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("vector: %v", err)
+	}
+	err = sqlitex.ExecuteTransient(conn, "CREATE TABLE IF NOT EXISTS "+calibrationTable+" (name TEXT PRIMARY KEY, ranges TEXT NOT NULL)", nil)
+	if err != nil {
+		return err
+	}
+	return sqlitex.Execute(conn, "INSERT OR REPLACE INTO "+calibrationTable+" (name, ranges) VALUES (?, ?)",
+		&sqlitex.ExecOptions{Args: []any{name, string(data)}})
+}
+
+// LoadCalibration reads the calibration stored under name.
+func LoadCalibration(conn *sqlite.Conn, name string) (*Calibration, error) {
+	var c *Calibration
+	err := sqlitex.Execute(conn, "SELECT ranges FROM "+calibrationTable+" WHERE name = ?", &sqlitex.ExecOptions{
+		Args: []any{name},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			c = new(Calibration)
+			return json.Unmarshal([]byte(stmt.ColumnText(0)), c)
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("vector: load calibration %q: %v", name, err)
+	}
+	if c == nil {
+		return nil, fmt.Errorf("vector: no calibration named %q", name)
+	}
+	return c, nil
+}
+
+// calibrator accumulates vectors for a Calibration. With a percentile of
+// 100 it tracks running minima and maxima; otherwise it keeps a reservoir
+// sample to take percentiles from.
+type calibrator struct {
+	percentile float64
+	min, max   []float32
+	sample     [][]float32
+	seen       int
+	rng        *rand.Rand
+}
+
+func newCalibrator(percentile float64) (*calibrator, error) {
+	if !(percentile > 50 && percentile <= 100) {
+		return nil, fmt.Errorf("percentile must be in (50, 100], got %v", percentile)
+	}
+	return &calibrator{percentile: percentile, rng: rand.New(rand.NewSource(1))}, nil
+}
+
+func (c *calibrator) add(v []float32) error {
+	if c.seen > 0 && len(v) != c.dim() {
+		return fmt.Errorf("vector has dimension %d, previous vectors have %d", len(v), c.dim())
+	}
+	c.seen++
+	if c.percentile == 100 {
+		if c.min == nil {
+			c.min = append([]float32(nil), v...)
+			c.max = append([]float32(nil), v...)
+			return nil
+		}
+		for i, f := range v {
+			c.min[i] = min(c.min[i], f)
+			c.max[i] = max(c.max[i], f)
+		}
+		return nil
+	}
+	if len(c.sample) < calibrationSamples {
+		c.sample = append(c.sample, v)
+	} else if j := c.rng.Intn(c.seen); j < calibrationSamples {
+		c.sample[j] = v
+	}
+	return nil
+}
+
+func (c *calibrator) dim() int {
+	if c.min != nil {
+		return len(c.min)
+	}
+	return len(c.sample[0])
+}
+
+// result returns the calibration, or nil if no vectors were added.
+func (c *calibrator) result() *Calibration {
+	if c.seen == 0 {
+		return nil
+	}
+	if c.percentile == 100 {
+		return &Calibration{Min: c.min, Max: c.max}
+	}
+	dim := c.dim()
+	n := len(c.sample)
+	lo := int(math.Floor((100 - c.percentile) / 100 * float64(n-1)))
+	hi := int(math.Ceil(c.percentile / 100 * float64(n-1)))
+	cal := &Calibration{Min: make([]float32, dim), Max: make([]float32, dim)}
+	values := make([]float32, n)
+	for d := 0; d < dim; d++ {
+		for i, v := range c.sample {
+			values[i] = v[d]
+		}
+		sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+		cal.Min[d] = values[lo]
+		cal.Max[d] = values[hi]
+	}
+	return cal
+}
+
+// calibrationInput decodes b, which must be a float32 blob of dimension
+// dim. Calibration ranges are meant for full-precision vectors, so every
+// other format is rejected rather than decoded.
+func calibrationInput(b []byte, dim int) ([]float32, error) {
+	if expected := dim * 4; len(b) != expected {
+		if f := blobFormatName(b); f != "" {
+			return nil, fmt.Errorf("input is %s, expected float32", f)
+		}
+		return nil, fmt.Errorf("expected %d bytes (dim=%d), got %d", expected, dim, len(b))
+	}
+	v, _ := BlobToFloat32(b)
+	return v, nil
+}
+
+// calibrateAggregate implements vector_quant_calibrate.
+type calibrateAggregate struct {
+	cfg *config
+	cal *calibrator
+}
+
+func (a *calibrateAggregate) Step(ctx sqlite.Context, args []sqlite.Value) error {
+	if a.cal == nil {
+		percentile := 100.0
+		if len(args) > 1 && args[1].Type() != sqlite.TypeNull {
+			percentile = args[1].Float()
+		}
+		cal, err := newCalibrator(percentile)
+		if err != nil {
+			return fmt.Errorf("%s: %v", a.cfg.funcName("_quant_calibrate"), err)
+		}
+		a.cal = cal
+	}
+	if args[0].Type() == sqlite.TypeNull {
+		return nil
+	}
+	v, err := calibrationInput(args[0].Blob(), a.cfg.dim)
+	if err != nil {
+		return fmt.Errorf("%s: %v", a.cfg.funcName("_quant_calibrate"), err)
+	}
+	return a.cal.add(v)
+}
+
+func (a *calibrateAggregate) WindowInverse(ctx sqlite.Context, args []sqlite.Value) error {
+	return fmt.Errorf("%s: not supported as a window function", a.cfg.funcName("_quant_calibrate"))
+}
+
+// WindowValue returns the calibration as JSON, the format stored in the
+// vector_quant_calibration table, or NULL if there were no vectors.
+func (a *calibrateAggregate) WindowValue(ctx sqlite.Context) (sqlite.Value, error) {
+	if a.cal == nil {
+		return sqlite.Value{}, nil
+	}
+	c := a.cal.result()
+	if c == nil {
+		return sqlite.Value{}, nil
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return sqlite.Value{}, fmt.Errorf("%s: %v", a.cfg.funcName("_quant_calibrate"), err)
+	}
+	return sqlite.TextValue(string(data)), nil
+}
+
+func (a *calibrateAggregate) Finalize(ctx sqlite.Context) {}
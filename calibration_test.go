@@ -0,0 +1,229 @@
+package vector
+
+import (
+	"encoding/json"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestCalibrator(t *testing.T) {
+	fill := func(c *calibrator) {
+		for i := 1000; i >= 1; i-- {
+			if err := c.add([]float32{float32(i), float32(-i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	tests := []struct {
+		percentile float64
+		want       Calibration
+	}{
+		{100, Calibration{Min: []float32{1, -1000}, Max: []float32{1000, -1}}},
+		{99, Calibration{Min: []float32{10, -991}, Max: []float32{991, -10}}},
+	}
+	for _, tt := range tests {
+		c, err := newCalibrator(tt.percentile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fill(c)
+		if got := c.result(); !reflect.DeepEqual(*got, tt.want) {
+			t.Errorf("percentile %v: got %+v, want %+v", tt.percentile, *got, tt.want)
+		}
+	}
+
+	for _, p := range []float64{50, 100.5, -1} {
+		if _, err := newCalibrator(p); err == nil {
+			t.Errorf("newCalibrator(%v) succeeded, want error", p)
+		}
+	}
+	c, _ := newCalibrator(100)
+	if c.result() != nil {
+		t.Error("result with no vectors is not nil")
+	}
+	c.add([]float32{1, 2})
+	if err := c.add([]float32{1}); err == nil {
+		t.Error("add accepted a vector of a different dimension")
+	}
+}
+
+func TestQuantizeRanges(t *testing.T) {
+	// Dimension 0 spans [-1, 1] and dimension 1 spans [-0.01, 0.01]. A single
+	// global range wastes almost every level on dimension 1.
+	rng := rand.New(rand.NewSource(1))
+	min := []float32{-1, -0.01}
+	max := []float32{1, 0.01}
+	var globalErr, rangesErr float64
+	for i := 0; i < 1000; i++ {
+		v := []float32{rng.Float32()*2 - 1, (rng.Float32()*2 - 1) / 100}
+		g, _ := dequantize(quantize(v, -1, 1), -1, 1)
+		r, err := dequantizeRanges(quantizeRanges(v, min, max), min, max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		globalErr += float64((g[1] - v[1]) * (g[1] - v[1]))
+		rangesErr += float64((r[1] - v[1]) * (r[1] - v[1]))
+	}
+	if rangesErr*100 > globalErr {
+		t.Errorf("per-dimension error %v is not far below global error %v", rangesErr, globalErr)
+	}
+
+	if _, err := dequantizeRanges(quantizeRanges([]float32{0, 0}, min, max), min[:1], max[:1]); err == nil {
+		t.Error("dequantizeRanges accepted a blob of the wrong dimension")
+	}
+	b := quantizeRanges([]float32{5, 5}, []float32{5, 0}, []float32{5, 10})
+	got, _ := dequantizeRanges(b, []float32{5, 0}, []float32{5, 10})
+	if got[0] != 5 {
+		t.Errorf("empty range dequantized to %v, want 5", got[0])
+	}
+}
+
+func TestCalibrateAndStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cal.db")
+	conn, err := sqlite.OpenConn(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := Register(conn, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlitex.ExecuteTransient(conn, "CREATE TABLE items (embedding BLOB)", nil); err != nil {
+		t.Fatal(err)
+	}
+	insertRandomVectors(t, conn, "items", rand.New(rand.NewSource(1)), 200, 4)
+	if err := sqlitex.ExecuteTransient(conn, "INSERT INTO items (embedding) VALUES (NULL)", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	cal, err := Calibrate(conn, "items", "embedding", 4, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var aggregate string
+	err = sqlitex.ExecuteTransient(conn, "SELECT vector_quant_calibrate(embedding) FROM items", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			aggregate = stmt.ColumnText(0)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromSQL Calibration
+	if err := json.Unmarshal([]byte(aggregate), &fromSQL); err != nil {
+		t.Fatalf("vector_quant_calibrate returned %q: %v", aggregate, err)
+	}
+	if !reflect.DeepEqual(fromSQL, *cal) {
+		t.Errorf("vector_quant_calibrate = %+v, Calibrate = %+v", fromSQL, *cal)
+	}
+	if err := SaveCalibration(conn, "default", cal); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second connection quantizes with the stored calibration.
+	other, err := sqlite.OpenConn(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	loaded, err := LoadCalibration(other, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, cal) {
+		t.Errorf("loaded %+v, want %+v", loaded, cal)
+	}
+	if err := Register(other, 4, WithQuantCalibration(loaded)); err != nil {
+		t.Fatal(err)
+	}
+	v := []float32{0.1, -0.2, 0.3, -0.4}
+	var got []byte
+	err = sqlitex.Execute(other, "SELECT vector_quantize(?)", &sqlitex.ExecOptions{
+		Args: []any{Float32ToBlob(v)},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			got = make([]byte, stmt.ColumnLen(0))
+			stmt.ColumnBytes(0, got)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&config{dim: 4, quantCal: cal, quantCalID: cal.id()}).quantize(v); !reflect.DeepEqual(got, want) {
+		t.Errorf("vector_quantize = %x, want %x", got, want)
+	}
+
+	if _, err := LoadCalibration(other, "missing"); err == nil {
+		t.Error("LoadCalibration of a missing name succeeded")
+	}
+}
+
+func TestCalibrateRejectsOtherFormats(t *testing.T) {
+	typed, err := TypedToBlob([]float32{1, 2, 3, 4}, ElementFloat32, "m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	quantized := (&config{dim: 4, quantEnabled: true, quantMin: -1, quantMax: 1}).quantize([]float32{0.1, 0.2, 0.3, 0.4})
+	for _, tt := range []struct {
+		name string
+		blob []byte
+		want string
+	}{
+		// Three float16 values and their header take 8 bytes, a multiple of 4.
+		{"float16", encodeHalf(formatFloat16, []float32{1, 2, 3}), "input is float16"},
+		{"bfloat16", encodeHalf(formatBFloat16, []float32{1, 2, 3}), "input is bfloat16"},
+		{"typed", typed, "input is a typed vector"},
+		{"int8", quantized, "input is int8-quantized"},
+		{"dimension", Float32ToBlob([]float32{1, 2}), "expected 16 bytes (dim=4), got 8"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := openTestConn(t)
+			if err := sqlitex.ExecuteTransient(conn, "CREATE TABLE items (embedding BLOB)", nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := sqlitex.ExecuteTransient(conn, "INSERT INTO items (embedding) VALUES (?)", &sqlitex.ExecOptions{Args: []any{tt.blob}}); err != nil {
+				t.Fatal(err)
+			}
+			_, err := Calibrate(conn, "items", "embedding", 4, 100)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Calibrate err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithQuantCalibration(t *testing.T) {
+	conn := openTestConn(t)
+	cal := &Calibration{Min: []float32{-1, -1}, Max: []float32{1, 1}}
+	if err := Register(conn, 3, WithQuantCalibration(cal)); err == nil {
+		t.Error("Register accepted a calibration of the wrong dimension")
+	}
+	inverted := &Calibration{Min: []float32{1, -1}, Max: []float32{-1, 1}}
+	if err := Register(conn, 2, WithQuantCalibration(inverted)); err == nil {
+		t.Error("Register accepted a calibration with max below min")
+	}
+	if err := Register(conn, 2, WithQuantCalibration(cal), WithQuantRange(-2, 2)); err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	err := sqlitex.ExecuteTransient(conn, "SELECT vector_quantize(vector_encode('[1, 1]'))", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			got = make([]byte, stmt.ColumnLen(0))
+			stmt.ColumnBytes(0, got)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&config{dim: 2, quantMin: -2, quantMax: 2}).quantize([]float32{1, 1}); !reflect.DeepEqual(got, want) {
+		t.Errorf("later WithQuantRange did not take effect: got %x, want %x", got, want)
+	}
+}
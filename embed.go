@@ -0,0 +1,266 @@
+package vector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+)
+
+const (
+	// defaultEmbedBatchSize is the number of texts vector_embed_batch sends
+	// to the Embedder at once unless WithEmbedBatchSize says otherwise.
+	defaultEmbedBatchSize = 64
+	// embedInterruptPoll is how often a running embedding call checks
+	// whether its statement was interrupted.
+	embedInterruptPoll = 10 * time.Millisecond
+)
+
+// BatchEmbedder is an Embedder that can embed several texts in one call.
+// When the Embedder passed to WithEmbedder implements it,
+// vector_embed_batch uses EmbedBatch instead of calling Embed once per
+// text. EmbedBatch returns one vector per text, in order.
+type BatchEmbedder interface {
+	Embedder
+	EmbedBatch(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// WithEmbedBatchSize sets how many texts vector_embed_batch passes to
+// BatchEmbedder.EmbedBatch at a time. The default is 64.
+func WithEmbedBatchSize(n int) Option {
+	return func(c *config) {
+		c.embedBatchSize = n
+	}
+}
+
+// WithEmbedTimeout sets a deadline for each call vector_embed and
+// vector_embed_batch make to the Embedder. The default, 0, means no
+// deadline.
+func WithEmbedTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.embedTimeout = d
+	}
+}
+
+// callEmbedder runs fn with a context that is cancelled when a statement on
+// conn is interrupted with conn.SetInterrupt, and that expires after the
+// WithEmbedTimeout duration if one is set. The sqlite package does not
+// expose a connection's interrupt channel and conn must not be used from
+// another goroutine, so fn runs on a new goroutine while this one polls
+// conn. If conn is interrupted, callEmbedder returns an SQLITE_INTERRUPT
+// error without waiting for fn to return.
+func (cfg *config) callEmbedder(conn *sqlite.Conn, fn func(ctx context.Context) error) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if cfg.embedTimeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), cfg.embedTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- fn(ctx)
+	}()
+	ticker := time.NewTicker(embedInterruptPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("embedding timed out after %v: %w", cfg.embedTimeout, err)
+			}
+			return err
+		case <-ticker.C:
+			if connInterrupted(conn) {
+				return fmt.Errorf("embedding interrupted: %w", sqlite.ResultInterrupt.ToError())
+			}
+		}
+	}
+}
+
+// connInterrupted reports whether conn has been interrupted. Preparing an
+// empty statement does no work but fails once the interrupt channel passed
+// to conn.SetInterrupt is closed.
+func connInterrupted(conn *sqlite.Conn) bool {
+	stmt, _, err := conn.PrepareTransient("")
+	if stmt != nil {
+		stmt.Finalize()
+	}
+	return err != nil
+}
+
+// embed embeds a single text, consulting the embedding cache if one is
+// configured.
+func (cfg *config) embed(conn *sqlite.Conn, text string) ([]float32, error) {
+	if cfg.cache != nil {
+		v, ok, err := cfg.cache.get(conn, cfg.dim, text)
+		if err != nil || ok {
+			return v, err
+		}
+	}
+	var v []float32
+	err := cfg.callEmbedder(conn, func(ctx context.Context) error {
+		var err error
+		v, err = cfg.embedder.Embed(ctx, text)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(v) != cfg.dim {
+		return nil, fmt.Errorf("embedder returned dimension %d, expected %d", len(v), cfg.dim)
+	}
+	if cfg.cache != nil {
+		if err := cfg.cache.put(conn, text, v); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// embedBatch embeds texts in groups of cfg.embedBatchSize, using EmbedBatch
+// when the embedder supports it, and checks every vector's dimension. Texts
+// found in the embedding cache are not sent to the embedder.
+func (cfg *config) embedBatch(conn *sqlite.Conn, texts []string) ([][]float32, error) {
+	be, ok := cfg.embedder.(BatchEmbedder)
+	if !ok {
+		out := make([][]float32, len(texts))
+		for i, text := range texts {
+			v, err := cfg.embed(conn, text)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = v
+		}
+		return out, nil
+	}
+
+	out := make([][]float32, len(texts))
+	var missing []int
+	for i, text := range texts {
+		if cfg.cache != nil {
+			v, ok, err := cfg.cache.get(conn, cfg.dim, text)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				out[i] = v
+				continue
+			}
+		}
+		missing = append(missing, i)
+	}
+	for start := 0; start < len(missing); start += cfg.embedBatchSize {
+		idx := missing[start:min(start+cfg.embedBatchSize, len(missing))]
+		batch := make([]string, len(idx))
+		for j, i := range idx {
+			batch[j] = texts[i]
+		}
+		var vecs [][]float32
+		err := cfg.callEmbedder(conn, func(ctx context.Context) error {
+			var err error
+			vecs, err = be.EmbedBatch(ctx, batch)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(vecs) != len(batch) {
+			return nil, fmt.Errorf("embedder returned %d vectors for %d texts", len(vecs), len(batch))
+		}
+		for j, v := range vecs {
+			if len(v) != cfg.dim {
+				return nil, fmt.Errorf("embedder returned dimension %d, expected %d", len(v), cfg.dim)
+			}
+			if cfg.cache != nil {
+				if err := cfg.cache.put(conn, batch[j], v); err != nil {
+					return nil, err
+				}
+			}
+			out[idx[j]] = v
+		}
+	}
+	return out, nil
+}
+
+// embedFunc returns the vector_embed SQL function.
+func embedFunc(cfg *config) *sqlite.FunctionImpl {
+	name := cfg.funcName("_embed")
+	return &sqlite.FunctionImpl{
+		NArgs:         1,
+		Deterministic: false,
+		Scalar: func(ctx sqlite.Context, args []sqlite.Value) (sqlite.Value, error) {
+			if args[0].Type() == sqlite.TypeNull {
+				return sqlite.Value{}, nil
+			}
+			if cfg.embedder == nil {
+				return sqlite.Value{}, fmt.Errorf("%s: no embedder configured, call Register with WithEmbedder", name)
+			}
+			floats, err := cfg.embed(ctx.Conn(), args[0].Text())
+			if err != nil {
+				return sqlite.Value{}, fmt.Errorf("%s: %w", name, err)
+			}
+			return sqlite.BlobValue(Float32ToBlob(floats)), nil
+		},
+	}
+}
+
+// embedBatchFunc returns the vector_embed_batch table-valued function. Its
+// argument is an SQL query whose rows are (id, text); it embeds every text
+// in batches and returns one (id, embedding) row per input row, in order,
+// skipping NULL texts.
+func embedBatchFunc(conn *sqlite.Conn, cfg *config) *tableFunc {
+	return &tableFunc{
+		name:     cfg.funcName("_embed_batch"),
+		columns:  []string{"id INTEGER", "embedding BLOB"},
+		params:   []string{"texts"},
+		required: 1,
+		run: func(params []sqlite.Value) ([]tableFuncRow, error) {
+			if cfg.embedder == nil {
+				return nil, fmt.Errorf("no embedder configured, call Register with WithEmbedder")
+			}
+			ids, texts, err := loadTexts(conn, params[0].Text())
+			if err != nil {
+				return nil, err
+			}
+			vecs, err := cfg.embedBatch(conn, texts)
+			if err != nil {
+				return nil, err
+			}
+			rows := make([]tableFuncRow, len(ids))
+			for i, id := range ids {
+				rows[i] = tableFuncRow{rowID: id, values: []sqlite.Value{sqlite.IntegerValue(id), sqlite.BlobValue(Float32ToBlob(vecs[i]))}}
+			}
+			return rows, nil
+		},
+	}
+}
+
+// loadTexts runs query, which must return (id, text) rows, and collects the
+// rows whose text is not NULL.
+func loadTexts(conn *sqlite.Conn, query string) ([]int64, []string, error) {
+	stmt, err := prepareRowQuery(conn, query, "id", "text")
+	if err != nil {
+		return nil, nil, fmt.Errorf("texts: %v", err)
+	}
+	defer stmt.Finalize()
+	var ids []int64
+	var texts []string
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, nil, fmt.Errorf("texts: %v", err)
+		}
+		if !hasRow {
+			return ids, texts, nil
+		}
+		if stmt.ColumnType(1) == sqlite.TypeNull {
+			continue
+		}
+		ids = append(ids, stmt.ColumnInt64(0))
+		texts = append(texts, stmt.ColumnText(1))
+	}
+}
@@ -0,0 +1,179 @@
+package vector
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// lengthEmbedder embeds a text as [len(text), 1] and records the size of
+// every batch it receives.
+type lengthEmbedder struct {
+	batches []int
+	embeds  int
+	short   bool // return one vector too few per batch
+}
+
+func (e *lengthEmbedder) Embed(_ context.Context, text string) ([]float32, error) {
+	e.embeds++
+	return []float32{float32(len(text)), 1}, nil
+}
+
+func (e *lengthEmbedder) EmbedBatch(ctx context.Context, texts []string) ([][]float32, error) {
+	e.batches = append(e.batches, len(texts))
+	var out [][]float32
+	for _, text := range texts {
+		out = append(out, []float32{float32(len(text)), 1})
+	}
+	if e.short {
+		out = out[1:]
+	}
+	return out, nil
+}
+
+func setupEmbedTable(t *testing.T, n int, opts ...Option) *sqlite.Conn {
+	t.Helper()
+	conn := openTestConn(t)
+	if err := Register(conn, 2, opts...); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlitex.ExecuteTransient(conn, "CREATE TABLE docs (body TEXT, embedding BLOB)", nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= n; i++ {
+		err := sqlitex.Execute(conn, "INSERT INTO docs (rowid, body) VALUES (?, ?)",
+			&sqlitex.ExecOptions{Args: []any{i, strings.Repeat("x", i)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return conn
+}
+
+func TestVectorEmbedBatch(t *testing.T) {
+	emb := &lengthEmbedder{}
+	conn := setupEmbedTable(t, 10, WithEmbedder(emb), WithEmbedBatchSize(4))
+	err := sqlitex.ExecuteTransient(conn, `
+		UPDATE docs SET embedding = e.embedding
+		FROM vector_embed_batch('SELECT rowid, body FROM docs WHERE embedding IS NULL') AS e
+		WHERE docs.rowid = e.id`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{4, 4, 2}; !slices.Equal(emb.batches, want) {
+		t.Errorf("batch sizes = %v, want %v", emb.batches, want)
+	}
+	if emb.embeds != 0 {
+		t.Errorf("Embed called %d times, want 0", emb.embeds)
+	}
+	var got []string
+	err = sqlitex.ExecuteTransient(conn, "SELECT vector_to_json(embedding) FROM docs ORDER BY rowid", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			got = append(got, stmt.ColumnText(0))
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range got {
+		if want := fmt.Sprintf("[%d,1]", i+1); s != want {
+			t.Errorf("row %d embedding = %s, want %s", i+1, s, want)
+		}
+	}
+}
+
+func TestVectorEmbedBatchFallback(t *testing.T) {
+	// An Embedder without EmbedBatch is called once per text.
+	emb := &mockEmbedder{vec: []float32{1, 2}}
+	conn := setupEmbedTable(t, 3, WithEmbedder(emb))
+	if err := sqlitex.ExecuteTransient(conn, "INSERT INTO docs (rowid, body) VALUES (4, NULL)", nil); err != nil {
+		t.Fatal(err)
+	}
+	got := queryKNN(t, conn, "SELECT id FROM vector_embed_batch('SELECT rowid, body FROM docs')")
+	if want := []int64{1, 2, 3}; !slices.Equal(got, want) {
+		t.Errorf("ids = %v, want %v", got, want)
+	}
+}
+
+func TestVectorEmbedBatchErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  []Option
+		query string
+		want  string
+	}{
+		{"no embedder", nil, "SELECT * FROM vector_embed_batch('SELECT rowid, body FROM docs')", "no embedder configured"},
+		{"short batch", []Option{WithEmbedder(&lengthEmbedder{short: true})}, "SELECT * FROM vector_embed_batch('SELECT rowid, body FROM docs')", "returned 2 vectors for 3 texts"},
+		{"wrong dimension", []Option{WithEmbedder(&mockEmbedder{vec: []float32{1}})}, "SELECT * FROM vector_embed_batch('SELECT rowid, body FROM docs')", "dimension 1, expected 2"},
+		{"wrong columns", []Option{WithEmbedder(&lengthEmbedder{})}, "SELECT * FROM vector_embed_batch('SELECT body FROM docs')", "want 2 (id, text)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := setupEmbedTable(t, 3, tt.opts...)
+			err := sqlitex.ExecuteTransient(conn, tt.query, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want containing %q", err, tt.want)
+			}
+		})
+	}
+
+	if err := Register(openTestConn(t), 2, WithEmbedBatchSize(0)); err == nil {
+		t.Error("Register accepted batch size 0")
+	}
+}
+
+// blockingEmbedder blocks until its context is done, or forever if
+// ignoreContext is set.
+type blockingEmbedder struct {
+	ignoreContext bool
+}
+
+func (e *blockingEmbedder) Embed(ctx context.Context, _ string) ([]float32, error) {
+	if e.ignoreContext {
+		select {}
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestVectorEmbedInterrupt(t *testing.T) {
+	for _, ignore := range []bool{false, true} {
+		t.Run(fmt.Sprintf("ignoreContext=%v", ignore), func(t *testing.T) {
+			conn := setupEmbedTable(t, 1, WithEmbedder(&blockingEmbedder{ignoreContext: ignore}))
+			for _, query := range []string{
+				"SELECT vector_embed('hello')",
+				"SELECT * FROM vector_embed_batch('SELECT rowid, body FROM docs')",
+			} {
+				done := make(chan struct{})
+				conn.SetInterrupt(done)
+				time.AfterFunc(20*time.Millisecond, func() { close(done) })
+				err := sqlitex.ExecuteTransient(conn, query, nil)
+				if sqlite.ErrCode(err) != sqlite.ResultInterrupt {
+					t.Errorf("%s: err = %v, want SQLITE_INTERRUPT", query, err)
+				}
+				conn.SetInterrupt(nil)
+			}
+		})
+	}
+}
+
+func TestVectorEmbedTimeout(t *testing.T) {
+	conn := setupEmbedTable(t, 1, WithEmbedder(&blockingEmbedder{}), WithEmbedTimeout(20*time.Millisecond))
+	err := sqlitex.ExecuteTransient(conn, "SELECT * FROM vector_embed_batch('SELECT rowid, body FROM docs')", nil)
+	if err == nil || !strings.Contains(err.Error(), "timed out after 20ms") {
+		t.Errorf("err = %v, want a timeout", err)
+	}
+
+	// A fast embedder is unaffected by the timeout.
+	conn = setupEmbedTable(t, 1, WithEmbedder(&lengthEmbedder{}), WithEmbedTimeout(time.Second))
+	if got := queryKNN(t, conn, "SELECT id FROM vector_embed_batch('SELECT rowid, body FROM docs')"); !slices.Equal(got, []int64{1}) {
+		t.Errorf("ids = %v, want [1]", got)
+	}
+}
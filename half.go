@@ -0,0 +1,182 @@
+package vector
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"zombiezen.com/go/sqlite"
+)
+
+// Half-precision blobs store each value in 16 bits after the two-byte
+// header, halving the size of a float32 blob. Float16 is IEEE 754 binary16:
+// more mantissa, but values above 65504 overflow to infinity. Bfloat16 is
+// the top half of a float32: the same range, with 8 bits of mantissa.
+// Conversions from float32 round to nearest even.
+//
+// A half-precision blob is 2 + 2*dim bytes, which equals the float32 length
+// only when dim is 1, so vector_to_f16 and vector_to_bf16 reject dimension 1.
+
+const halfVersion = 0x01
+
+// halfFormat returns the format byte of a float16 or bfloat16 blob, or
+// false if b has neither header.
+func halfFormat(b []byte) (byte, bool) {
+	if len(b) < 2 || b[1] != halfVersion || (b[0] != formatFloat16 && b[0] != formatBFloat16) {
+		return 0, false
+	}
+	return b[0], true
+}
+
+func halfName(format byte) string {
+	if format == formatBFloat16 {
+		return "bfloat16"
+	}
+	return "float16"
+}
+
+// halfLen returns the byte length of a half-precision blob for dim
+// dimensions.
+func halfLen(dim int) int {
+	return 2 + 2*dim
+}
+
+func encodeHalf(format byte, v []float32) []byte {
+	b := make([]byte, halfLen(len(v)))
+	b[0] = format
+	b[1] = halfVersion
+	conv := float32ToFloat16
+	if format == formatBFloat16 {
+		conv = float32ToBFloat16
+	}
+	for i, f := range v {
+		binary.LittleEndian.PutUint16(b[2+i*2:], conv(f))
+	}
+	return b
+}
+
+func decodeHalf(format byte, b []byte) ([]float32, error) {
+	if f, ok := halfFormat(b); !ok || f != format {
+		return nil, fmt.Errorf("missing %s format magic bytes", halfName(format))
+	}
+	data := b[2:]
+	if len(data)%2 != 0 {
+		return nil, fmt.Errorf("blob length %d is not 2 plus a multiple of 2", len(b))
+	}
+	v := make([]float32, len(data)/2)
+	decodeHalfInto(v, format, data)
+	return v, nil
+}
+
+// decodeHalfInto decodes the 16-bit values in data into dst without
+// allocating.
+func decodeHalfInto(dst []float32, format byte, data []byte) {
+	conv := float16ToFloat32
+	if format == formatBFloat16 {
+		conv = bfloat16ToFloat32
+	}
+	for i := range dst {
+		dst[i] = conv(binary.LittleEndian.Uint16(data[i*2:]))
+	}
+}
+
+func float32ToFloat16(f float32) uint16 {
+	bits := math.Float32bits(f)
+	sign := uint16(bits>>16) & 0x8000
+	exp := int(bits>>23) & 0xff
+	mant := bits & 0x7fffff
+	switch {
+	case exp == 0xff && mant != 0:
+		return sign | 0x7e00 // quiet NaN
+	case exp == 0xff:
+		return sign | 0x7c00
+	}
+
+	// Half-precision biased exponent.
+	e := exp - 127 + 15
+	switch {
+	case e >= 0x1f:
+		return sign | 0x7c00
+	case e <= 0:
+		// Subnormal: the value is m * 2^-24 with m below 2^10.
+		if e < -10 {
+			return sign
+		}
+		full := mant | 0x800000
+		shift := uint(14 - e)
+		return sign | uint16(roundShift(full, shift))
+	default:
+		// A carry out of the mantissa correctly bumps the exponent, up to
+		// infinity.
+		return sign | (uint16(e)<<10 + uint16(roundShift(mant, 13)))
+	}
+}
+
+// roundShift returns x >> shift rounded to nearest even.
+func roundShift(x uint32, shift uint) uint32 {
+	q := x >> shift
+	rem := x & (1<<shift - 1)
+	half := uint32(1) << (shift - 1)
+	if rem > half || (rem == half && q&1 == 1) {
+		q++
+	}
+	return q
+}
+
+func float16ToFloat32(h uint16) float32 {
+	sign := uint32(h&0x8000) << 16
+	exp := uint32(h>>10) & 0x1f
+	mant := uint32(h & 0x3ff)
+	switch exp {
+	case 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | mant<<13)
+	case 0:
+		v := float32(mant) / (1 << 24)
+		if sign != 0 {
+			return -v
+		}
+		return v
+	default:
+		return math.Float32frombits(sign | (exp+127-15)<<23 | mant<<13)
+	}
+}
+
+func float32ToBFloat16(f float32) uint16 {
+	bits := math.Float32bits(f)
+	if bits&0x7fffffff > 0x7f800000 {
+		return uint16(bits>>16) | 0x40 // quiet NaN
+	}
+	bits += 0x7fff + (bits>>16)&1
+	return uint16(bits >> 16)
+}
+
+func bfloat16ToFloat32(h uint16) float32 {
+	return math.Float32frombits(uint32(h) << 16)
+}
+
+// toHalfFunc returns the SQL function that converts float32 blobs to the
+// half-precision format.
+func toHalfFunc(name string, cfg *config, format byte) *sqlite.FunctionImpl {
+	return &sqlite.FunctionImpl{
+		NArgs:         1,
+		Deterministic: true,
+		Scalar: func(ctx sqlite.Context, args []sqlite.Value) (sqlite.Value, error) {
+			if args[0].Type() == sqlite.TypeNull {
+				return sqlite.Value{}, nil
+			}
+			if cfg.dim == 1 {
+				return sqlite.Value{}, fmt.Errorf("%s: dimension 1 is not supported, %s blobs would have the float32 length", name, halfName(format))
+			}
+			blob := args[0].Blob()
+			expected := cfg.dim * 4
+			if len(blob) != expected {
+				if f := blobFormatName(blob); f != "" {
+					return sqlite.Value{}, fmt.Errorf("%s: input is %s, expected float32", name, f)
+				}
+				return sqlite.Value{}, fmt.Errorf("%s: expected %d bytes (dim=%d), got %d", name, expected, cfg.dim, len(blob))
+			}
+			floats, _ := BlobToFloat32(blob)
+			return sqlite.BlobValue(encodeHalf(format, floats)), nil
+		},
+	}
+}
@@ -0,0 +1,170 @@
+package vector
+
+import (
+	"math"
+	"testing"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestFloat32ToFloat16(t *testing.T) {
+	tests := []struct {
+		f    float32
+		want uint16
+	}{
+		{0, 0x0000},
+		{float32(math.Copysign(0, -1)), 0x8000},
+		{1, 0x3c00},
+		{-2, 0xc000},
+		{65504, 0x7bff},
+		{65519, 0x7bff},
+		{65520, 0x7c00}, // halfway to 65536 rounds to even, which is infinity
+		{float32(math.Inf(1)), 0x7c00},
+		{float32(math.Inf(-1)), 0xfc00},
+		{float32(math.NaN()), 0x7e00},
+		{0x1p-14, 0x0400},     // smallest normal
+		{0x1p-24, 0x0001},     // smallest subnormal
+		{0x1p-25, 0x0000},     // halfway to the smallest subnormal rounds to even
+		{0x1.8p-25, 0x0001},   // above halfway rounds up
+		{0x1p-26, 0x0000},     // underflows
+		{1 + 0x1p-11, 0x3c00}, // halfway between 1 and the next value rounds to even
+		{1 + 0x3p-11, 0x3c02}, // halfway rounds to even upward
+		{0x1.ffcp-15, 0x0400}, // rounds up from subnormal to normal
+	}
+	for _, tt := range tests {
+		if got := float32ToFloat16(tt.f); got != tt.want {
+			t.Errorf("float32ToFloat16(%v) = %#04x, want %#04x", tt.f, got, tt.want)
+		}
+	}
+}
+
+func TestFloat32ToBFloat16(t *testing.T) {
+	tests := []struct {
+		f    float32
+		want uint16
+	}{
+		{0, 0x0000},
+		{1, 0x3f80},
+		{-2, 0xc000},
+		{1 + 0x1p-8, 0x3f80}, // halfway rounds to even
+		{1 + 0x3p-8, 0x3f82},
+		{math.MaxFloat32, 0x7f80}, // rounds up to infinity
+		{float32(math.Inf(-1)), 0xff80},
+	}
+	for _, tt := range tests {
+		if got := float32ToBFloat16(tt.f); got != tt.want {
+			t.Errorf("float32ToBFloat16(%v) = %#04x, want %#04x", tt.f, got, tt.want)
+		}
+	}
+	if h := float32ToBFloat16(float32(math.NaN())); !math.IsNaN(float64(bfloat16ToFloat32(h))) {
+		t.Errorf("float32ToBFloat16(NaN) = %#04x, not a NaN", h)
+	}
+}
+
+func TestHalfRoundTrip(t *testing.T) {
+	// Every 16-bit value decodes to a float32 that encodes back to itself.
+	for i := 0; i <= math.MaxUint16; i++ {
+		h := uint16(i)
+		if f := float16ToFloat32(h); !math.IsNaN(float64(f)) && float32ToFloat16(f) != h {
+			t.Fatalf("float16 %#04x decodes to %v, which encodes to %#04x", h, f, float32ToFloat16(f))
+		}
+		if f := bfloat16ToFloat32(h); !math.IsNaN(float64(f)) && float32ToBFloat16(f) != h {
+			t.Fatalf("bfloat16 %#04x decodes to %v, which encodes to %#04x", h, f, float32ToBFloat16(f))
+		}
+	}
+}
+
+func TestHalfBlobs(t *testing.T) {
+	v := []float32{0.5, -0.25, 1, 3.140625}
+	b := Float16ToBlob(v)
+	if len(b) != halfLen(len(v)) || b[0] != formatFloat16 || b[1] != halfVersion {
+		t.Fatalf("Float16ToBlob = %x, want a float16 header and %d values", b, len(v))
+	}
+	got, err := BlobToFloat16(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range v {
+		if got[i] != v[i] {
+			t.Fatalf("BlobToFloat16 = %v, want %v", got, v)
+		}
+	}
+	got, err = BlobToBFloat16(BFloat16ToBlob(v))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range v {
+		if got[i] != v[i] {
+			t.Fatalf("BlobToBFloat16 = %v, want %v", got, v)
+		}
+	}
+
+	if _, err := BlobToBFloat16(b); err == nil {
+		t.Error("BlobToBFloat16 accepted a float16 blob")
+	}
+	if _, err := BlobToFloat16(Float32ToBlob(v)); err == nil {
+		t.Error("BlobToFloat16 accepted a float32 blob")
+	}
+	if got := blobFormatName(BFloat16ToBlob(v)); got != "bfloat16" {
+		t.Errorf("blobFormatName(bfloat16 blob) = %q", got)
+	}
+}
+
+func TestVectorDistanceHalf(t *testing.T) {
+	conn := openTestConn(t)
+	if err := Register(conn, 3); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		query string
+		want  float64
+		tol   float64
+	}{
+		{
+			name:  "float16",
+			query: "SELECT vector_distance(vector_to_f16(vector_encode('[1,2,3]')), vector_to_f16(vector_encode('[4,6,8]')))",
+			want:  50,
+		},
+		{
+			name:  "bfloat16",
+			query: "SELECT vector_distance(vector_to_bf16(vector_encode('[1,2,3]')), vector_to_bf16(vector_encode('[4,6,8]')))",
+			want:  50,
+		},
+		{
+			name:  "mixed formats",
+			query: "SELECT vector_distance_dot(vector_to_f16(vector_encode('[0.1,0.2,0.3]')), vector_encode('[1,1,1]'))",
+			want:  -0.6,
+			tol:   1e-3,
+		},
+		{
+			name:  "float16 and bfloat16",
+			query: "SELECT vector_distance_cosine(vector_to_f16(vector_encode('[1,2,3]')), vector_to_bf16(vector_encode('[2,4,6]')))",
+			want:  0,
+			tol:   1e-6,
+		},
+		{
+			name:  "size",
+			query: "SELECT length(vector_to_f16(vector_encode('[1,2,3]'))) + length(vector_to_bf16(vector_encode('[1,2,3]')))",
+			want:  16,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got float64
+			err := sqlitex.ExecuteTransient(conn, tt.query, &sqlitex.ExecOptions{
+				ResultFunc: func(stmt *sqlite.Stmt) error {
+					got = stmt.ColumnFloat(0)
+					return nil
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(got-tt.want) > tt.tol {
+				t.Errorf("%s = %v, want %v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
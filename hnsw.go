@@ -0,0 +1,581 @@
+package vector
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// An HNSW (hierarchical navigable small world) graph index for vector tables
+// declared with index=hnsw. The graph is stored in two shadow tables:
+//
+//	<name>_hnsw_edges (id, level, neighbors)  one row per node per level;
+//	                                          neighbors is a blob of int64 LE row IDs
+//	<name>_hnsw_meta (key, value)             entry_point and max_level
+//
+// Each insert, update and delete on the virtual table updates the graph in
+// the same transaction. Nodes are read through a per-operation cache, so the
+// index needs no in-memory state between statements.
+
+const (
+	defaultHNSWM              = 16
+	defaultHNSWEfConstruction = 200
+	defaultHNSWEfSearch       = 64
+	maxHNSWLevel              = 16
+)
+
+type hnswParams struct {
+	m              int
+	efConstruction int
+	efSearch       int
+}
+
+func (p hnswParams) maxConnections(level int) int {
+	if level == 0 {
+		return 2 * p.m
+	}
+	return p.m
+}
+
+// hnswLevel returns the top layer of node id. Levels follow the usual
+// exponential distribution with mL = 1/ln(M), drawn from a hash of the row ID
+// so that rebuilding a table produces the same graph.
+func hnswLevel(id int64, m int) int {
+	x := uint64(id) + 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	x ^= x >> 31
+	u := (float64(x>>11) + 1) / (1 << 53)
+	level := int(-math.Log(u) / math.Log(float64(m)))
+	return min(level, maxHNSWLevel)
+}
+
+func (vt *vecTable) hnswEdgesTable() string { return vt.shadowName("_hnsw_edges") }
+func (vt *vecTable) hnswMetaTable() string  { return vt.shadowName("_hnsw_meta") }
+
+func (vt *vecTable) createHNSWTables() error {
+	for _, query := range []string{
+		"CREATE TABLE " + vt.hnswEdgesTable() + " (id INTEGER NOT NULL, level INTEGER NOT NULL, neighbors BLOB NOT NULL, PRIMARY KEY (id, level)) WITHOUT ROWID",
+		"CREATE TABLE " + vt.hnswMetaTable() + " (key TEXT PRIMARY KEY, value INTEGER NOT NULL)",
+	} {
+		if err := sqlitex.ExecuteTransient(vt.conn, query, nil); err != nil {
+			return fmt.Errorf("vector: create hnsw shadow tables: %w", err)
+		}
+	}
+	return nil
+}
+
+type hnswKey struct {
+	id    int64
+	level int
+}
+
+// hnswSession caches the nodes touched by a single graph operation and
+// buffers its writes until flush.
+type hnswSession struct {
+	vt      *vecTable
+	params  hnswParams
+	vectors map[int64][]float32
+	links   map[hnswKey][]int64
+	dirty   map[hnswKey]bool
+	removed map[int64]bool
+
+	metaLoaded bool
+	hasEntry   bool
+	entry      int64
+	maxLevel   int
+	metaDirty  bool
+}
+
+func (vt *vecTable) hnswSession() *hnswSession {
+	return &hnswSession{
+		vt:      vt,
+		params:  vt.spec.hnsw,
+		vectors: make(map[int64][]float32),
+		links:   make(map[hnswKey][]int64),
+		dirty:   make(map[hnswKey]bool),
+		removed: make(map[int64]bool),
+	}
+}
+
+func (s *hnswSession) distance(a, b []float32) float64 {
+	return s.vt.spec.metric.distance(a, b)
+}
+
+// vector returns the stored vector for id, or nil if the row does not exist.
+func (s *hnswSession) vector(id int64) ([]float32, error) {
+	if v, ok := s.vectors[id]; ok {
+		return v, nil
+	}
+	if s.removed[id] {
+		return nil, nil
+	}
+	vt := s.vt
+	stmt, err := vt.conn.Prepare(fmt.Sprintf("SELECT %s FROM %s WHERE id = ?", quoteIdent(vt.spec.column), vt.rowsTable()))
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Reset()
+	stmt.BindInt64(1, id)
+	hasRow, err := stmt.Step()
+	if err != nil {
+		return nil, err
+	}
+	var v []float32
+	if hasRow && stmt.ColumnLen(0) == vt.spec.dim*4 {
+		buf := make([]byte, vt.spec.dim*4)
+		stmt.ColumnBytes(0, buf)
+		v = make([]float32, vt.spec.dim)
+		decodeFloat32(v, buf)
+	}
+	s.vectors[id] = v
+	return v, nil
+}
+
+func (s *hnswSession) neighbors(id int64, level int) ([]int64, error) {
+	key := hnswKey{id, level}
+	if ids, ok := s.links[key]; ok {
+		return ids, nil
+	}
+	if s.removed[id] {
+		return nil, nil
+	}
+	stmt, err := s.vt.conn.Prepare(fmt.Sprintf("SELECT neighbors FROM %s WHERE id = ? AND level = ?", s.vt.hnswEdgesTable()))
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Reset()
+	stmt.BindInt64(1, id)
+	stmt.BindInt64(2, int64(level))
+	hasRow, err := stmt.Step()
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	if hasRow {
+		buf := make([]byte, stmt.ColumnLen(0))
+		stmt.ColumnBytes(0, buf)
+		ids = decodeRowIDs(buf)
+	}
+	s.links[key] = ids
+	return ids, nil
+}
+
+func (s *hnswSession) setNeighbors(id int64, level int, ids []int64) {
+	key := hnswKey{id, level}
+	s.links[key] = ids
+	s.dirty[key] = true
+}
+
+func (s *hnswSession) loadMeta() error {
+	if s.metaLoaded {
+		return nil
+	}
+	s.metaLoaded = true
+	return sqlitex.Execute(s.vt.conn, "SELECT key, value FROM "+s.vt.hnswMetaTable(), &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			switch stmt.ColumnText(0) {
+			case "entry_point":
+				s.entry = stmt.ColumnInt64(1)
+				s.hasEntry = true
+			case "max_level":
+				s.maxLevel = stmt.ColumnInt(1)
+			}
+			return nil
+		},
+	})
+}
+
+func (s *hnswSession) setEntry(id int64, level int) {
+	s.hasEntry = true
+	s.entry = id
+	s.maxLevel = level
+	s.metaDirty = true
+}
+
+func (s *hnswSession) flush() error {
+	vt := s.vt
+	for id := range s.removed {
+		err := sqlitex.Execute(vt.conn, "DELETE FROM "+vt.hnswEdgesTable()+" WHERE id = ?",
+			&sqlitex.ExecOptions{Args: []any{id}})
+		if err != nil {
+			return err
+		}
+	}
+	for key := range s.dirty {
+		if s.removed[key.id] {
+			continue
+		}
+		err := sqlitex.Execute(vt.conn,
+			"INSERT OR REPLACE INTO "+vt.hnswEdgesTable()+" (id, level, neighbors) VALUES (?, ?, ?)",
+			&sqlitex.ExecOptions{Args: []any{key.id, key.level, encodeRowIDs(s.links[key])}})
+		if err != nil {
+			return err
+		}
+	}
+	if !s.metaDirty {
+		return nil
+	}
+	if !s.hasEntry {
+		return sqlitex.Execute(vt.conn, "DELETE FROM "+vt.hnswMetaTable(), nil)
+	}
+	return sqlitex.Execute(vt.conn,
+		"INSERT OR REPLACE INTO "+vt.hnswMetaTable()+" (key, value) VALUES ('entry_point', ?), ('max_level', ?)",
+		&sqlitex.ExecOptions{Args: []any{s.entry, s.maxLevel}})
+}
+
+// searchLayer runs a greedy best-first search on one layer starting from
+// entries and returns up to ef nearest nodes in ascending distance.
+func (s *hnswSession) searchLayer(q []float32, entries []neighbor, ef, level int) ([]neighbor, error) {
+	// ef can come from a query's k, so it only bounds the results; the
+	// allocations grow with the nodes actually visited.
+	size := min(ef, maxTopKPrealloc)
+	visited := make(map[int64]bool, size*4)
+	candidates := make(neighborMinHeap, 0, size)
+	results := make(neighborHeap, 0, size+1)
+	for _, e := range entries {
+		visited[e.id] = true
+		heap.Push(&candidates, e)
+		heap.Push(&results, e)
+		if len(results) > ef {
+			heap.Pop(&results)
+		}
+	}
+	for len(candidates) > 0 {
+		c := heap.Pop(&candidates).(neighbor)
+		if len(results) >= ef && c.distance > results[0].distance {
+			break
+		}
+		ids, err := s.neighbors(c.id, level)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			if visited[id] {
+				continue
+			}
+			visited[id] = true
+			v, err := s.vector(id)
+			if err != nil {
+				return nil, err
+			}
+			if v == nil {
+				continue
+			}
+			d := s.distance(q, v)
+			if len(results) < ef || d < results[0].distance {
+				n := neighbor{id: id, distance: d}
+				heap.Push(&candidates, n)
+				heap.Push(&results, n)
+				if len(results) > ef {
+					heap.Pop(&results)
+				}
+			}
+		}
+	}
+	out := []neighbor(results)
+	sortNeighbors(out)
+	return out, nil
+}
+
+// selectNeighbors picks up to m of the candidates (sorted ascending by
+// distance to the base vector) using the HNSW heuristic: a candidate is kept
+// only if it is closer to the base than to every candidate already kept.
+// Pruned candidates fill any remaining slots.
+func (s *hnswSession) selectNeighbors(candidates []neighbor, m int) ([]int64, error) {
+	selected := make([]int64, 0, m)
+	selectedVecs := make([][]float32, 0, m)
+	var pruned []int64
+	for _, c := range candidates {
+		if len(selected) >= m {
+			break
+		}
+		cv, err := s.vector(c.id)
+		if err != nil {
+			return nil, err
+		}
+		if cv == nil {
+			continue
+		}
+		keep := true
+		for _, sv := range selectedVecs {
+			if s.distance(cv, sv) < c.distance {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			selected = append(selected, c.id)
+			selectedVecs = append(selectedVecs, cv)
+		} else {
+			pruned = append(pruned, c.id)
+		}
+	}
+	for _, id := range pruned {
+		if len(selected) >= m {
+			break
+		}
+		selected = append(selected, id)
+	}
+	return selected, nil
+}
+
+// rankFrom returns ids sorted by distance to base, skipping missing rows.
+func (s *hnswSession) rankFrom(base []float32, ids []int64) ([]neighbor, error) {
+	ranked := make([]neighbor, 0, len(ids))
+	for _, id := range ids {
+		v, err := s.vector(id)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			continue
+		}
+		ranked = append(ranked, neighbor{id: id, distance: s.distance(base, v)})
+	}
+	sortNeighbors(ranked)
+	return ranked, nil
+}
+
+func (s *hnswSession) insert(id int64, vec []float32) error {
+	if err := s.loadMeta(); err != nil {
+		return err
+	}
+	s.vectors[id] = vec
+	level := hnswLevel(id, s.params.m)
+	if !s.hasEntry {
+		for l := 0; l <= level; l++ {
+			s.setNeighbors(id, l, nil)
+		}
+		s.setEntry(id, level)
+		return s.flush()
+	}
+
+	ev, err := s.vector(s.entry)
+	if err != nil {
+		return err
+	}
+	if ev == nil {
+		return fmt.Errorf("hnsw entry point %d has no vector", s.entry)
+	}
+	ep := []neighbor{{id: s.entry, distance: s.distance(vec, ev)}}
+	for l := s.maxLevel; l > level; l-- {
+		if ep, err = s.searchLayer(vec, ep, 1, l); err != nil {
+			return err
+		}
+	}
+	for l := min(level, s.maxLevel); l >= 0; l-- {
+		w, err := s.searchLayer(vec, ep, s.params.efConstruction, l)
+		if err != nil {
+			return err
+		}
+		selected, err := s.selectNeighbors(w, s.params.m)
+		if err != nil {
+			return err
+		}
+		s.setNeighbors(id, l, selected)
+		for _, n := range selected {
+			if err := s.link(n, id, l); err != nil {
+				return err
+			}
+		}
+		ep = w
+	}
+	for l := s.maxLevel + 1; l <= level; l++ {
+		s.setNeighbors(id, l, nil)
+	}
+	if level > s.maxLevel {
+		s.setEntry(id, level)
+	}
+	return s.flush()
+}
+
+// link adds a directed edge from -> to on level, shrinking from's neighbor
+// list with the selection heuristic if it grows past the layer's limit.
+func (s *hnswSession) link(from, to int64, level int) error {
+	ids, err := s.neighbors(from, level)
+	if err != nil {
+		return err
+	}
+	ids = append(append([]int64(nil), ids...), to)
+	if limit := s.params.maxConnections(level); len(ids) > limit {
+		fv, err := s.vector(from)
+		if err != nil {
+			return err
+		}
+		ranked, err := s.rankFrom(fv, ids)
+		if err != nil {
+			return err
+		}
+		if ids, err = s.selectNeighbors(ranked, limit); err != nil {
+			return err
+		}
+	}
+	s.setNeighbors(from, level, ids)
+	return nil
+}
+
+// remove deletes node id from the graph. Each former neighbor is reconnected
+// by reselecting its neighbors from the union of its own list and the removed
+// node's list. Edges to id held by nodes outside that neighborhood are left
+// dangling; searches skip them and they are dropped when the list is next
+// rewritten.
+func (s *hnswSession) remove(id int64) error {
+	if err := s.loadMeta(); err != nil {
+		return err
+	}
+	var levels [][]int64
+	err := sqlitex.Execute(s.vt.conn,
+		"SELECT level, neighbors FROM "+s.vt.hnswEdgesTable()+" WHERE id = ? ORDER BY level",
+		&sqlitex.ExecOptions{
+			Args: []any{id},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				buf := make([]byte, stmt.ColumnLen(1))
+				stmt.ColumnBytes(1, buf)
+				levels = append(levels, decodeRowIDs(buf))
+				return nil
+			},
+		})
+	if err != nil {
+		return err
+	}
+	if len(levels) == 0 {
+		return nil
+	}
+	s.removed[id] = true
+	delete(s.vectors, id)
+	for level, nbrs := range levels {
+		for _, n := range nbrs {
+			if n == id {
+				continue
+			}
+			own, err := s.neighbors(n, level)
+			if err != nil {
+				return err
+			}
+			seen := map[int64]bool{id: true, n: true}
+			var candidates []int64
+			for _, c := range append(append([]int64(nil), own...), nbrs...) {
+				if !seen[c] {
+					seen[c] = true
+					candidates = append(candidates, c)
+				}
+			}
+			nv, err := s.vector(n)
+			if err != nil {
+				return err
+			}
+			if nv == nil {
+				continue
+			}
+			ranked, err := s.rankFrom(nv, candidates)
+			if err != nil {
+				return err
+			}
+			selected, err := s.selectNeighbors(ranked, s.params.maxConnections(level))
+			if err != nil {
+				return err
+			}
+			s.setNeighbors(n, level, selected)
+		}
+	}
+	if err := s.flush(); err != nil {
+		return err
+	}
+	if !s.hasEntry || s.entry != id {
+		return nil
+	}
+
+	// Promote the remaining node with the highest level to entry point.
+	s.hasEntry = false
+	err = sqlitex.Execute(s.vt.conn,
+		"SELECT id, level FROM "+s.vt.hnswEdgesTable()+" ORDER BY level DESC, id LIMIT 1",
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				s.setEntry(stmt.ColumnInt64(0), stmt.ColumnInt(1))
+				return nil
+			},
+		})
+	if err != nil {
+		return err
+	}
+	s.metaDirty = true
+	s.dirty = map[hnswKey]bool{}
+	return s.flush()
+}
+
+// search returns the approximate k nearest neighbors of q.
+func (s *hnswSession) search(q []float32, k, ef int) ([]neighbor, error) {
+	if err := s.loadMeta(); err != nil {
+		return nil, err
+	}
+	if !s.hasEntry || k <= 0 {
+		return nil, nil
+	}
+	ev, err := s.vector(s.entry)
+	if err != nil {
+		return nil, err
+	}
+	if ev == nil {
+		return nil, fmt.Errorf("hnsw entry point %d has no vector", s.entry)
+	}
+	ep := []neighbor{{id: s.entry, distance: s.distance(q, ev)}}
+	for l := s.maxLevel; l > 0; l-- {
+		if ep, err = s.searchLayer(q, ep, 1, l); err != nil {
+			return nil, err
+		}
+	}
+	w, err := s.searchLayer(q, ep, max(ef, k), 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(w) > k {
+		w = w[:k]
+	}
+	return w, nil
+}
+
+// neighborMinHeap is a min-heap on distance.
+type neighborMinHeap []neighbor
+
+func (h neighborMinHeap) Len() int           { return len(h) }
+func (h neighborMinHeap) Less(i, j int) bool { return h[i].distance < h[j].distance }
+func (h neighborMinHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *neighborMinHeap) Push(x any)        { *h = append(*h, x.(neighbor)) }
+func (h *neighborMinHeap) Pop() any {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
+
+// sortNeighbors sorts ns nearest first, breaking ties by row ID.
+func sortNeighbors(ns []neighbor) {
+	sort.Slice(ns, func(i, j int) bool {
+		if ns[i].distance != ns[j].distance {
+			return ns[i].distance < ns[j].distance
+		}
+		return ns[i].id < ns[j].id
+	})
+}
+
+func encodeRowIDs(ids []int64) []byte {
+	b := make([]byte, len(ids)*8)
+	for i, id := range ids {
+		binary.LittleEndian.PutUint64(b[i*8:], uint64(id))
+	}
+	return b
+}
+
+func decodeRowIDs(b []byte) []int64 {
+	ids := make([]int64, len(b)/8)
+	for i := range ids {
+		ids[i] = int64(binary.LittleEndian.Uint64(b[i*8:]))
+	}
+	return ids
+}
@@ -0,0 +1,442 @@
+package vector
+
+import (
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestHNSWLevel(t *testing.T) {
+	counts := make(map[int]int)
+	for id := int64(1); id <= 10000; id++ {
+		level := hnswLevel(id, 16)
+		if level != hnswLevel(id, 16) {
+			t.Fatalf("hnswLevel(%d) is not deterministic", id)
+		}
+		counts[level]++
+	}
+	// P(level >= 1) = 1/M, so about 625 of 10000 nodes.
+	upper := 10000 - counts[0]
+	if upper < 450 || upper > 800 {
+		t.Errorf("%d of 10000 nodes above level 0, want about 625", upper)
+	}
+}
+
+func TestRowIDsRoundTrip(t *testing.T) {
+	ids := []int64{1, -2, 1 << 40}
+	got := decodeRowIDs(encodeRowIDs(ids))
+	if len(got) != len(ids) {
+		t.Fatalf("got %v, want %v", got, ids)
+	}
+	for i := range ids {
+		if got[i] != ids[i] {
+			t.Errorf("id[%d] = %d, want %d", i, got[i], ids[i])
+		}
+	}
+}
+
+func TestParseVecTableArgsHNSW(t *testing.T) {
+	spec, err := parseVecTableArgs([]string{"e float[4]", "index=hnsw", "m=8", "ef_construction=50", "ef_search=20"}, MetricL2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.index != "hnsw" || spec.hnsw != (hnswParams{m: 8, efConstruction: 50, efSearch: 20}) {
+		t.Errorf("spec = %+v", *spec)
+	}
+	for _, args := range [][]string{
+		{"e float[4]", "m=8"},
+		{"e float[4]", "index=ivf"},
+		{"e float[4]", "index=hnsw", "m=1"},
+		{"e float[4]", "index=hnsw", "ef_search=zero"},
+	} {
+		if _, err := parseVecTableArgs(args, MetricL2); err == nil {
+			t.Errorf("parseVecTableArgs(%q) succeeded, want error", args)
+		}
+	}
+}
+
+func insertRandomVectors(t *testing.T, conn *sqlite.Conn, table string, rng *rand.Rand, n, dim int) map[int64][]float32 {
+	t.Helper()
+	vectors := make(map[int64][]float32, n)
+	endFn, err := sqlitex.ImmediateTransaction(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer endFn(&err)
+	for i := 1; i <= n; i++ {
+		v := make([]float32, dim)
+		for j := range v {
+			v[j] = rng.Float32()*2 - 1
+		}
+		vectors[int64(i)] = v
+		err = sqlitex.Execute(conn, "INSERT INTO "+table+" (rowid, embedding) VALUES (?, ?)",
+			&sqlitex.ExecOptions{Args: []any{i, Float32ToBlob(v)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return vectors
+}
+
+func bruteForceKNN(vectors map[int64][]float32, q []float32, k int) []int64 {
+	ns := make([]neighbor, 0, len(vectors))
+	for id, v := range vectors {
+		ns = append(ns, neighbor{id: id, distance: l2Squared(q, v)})
+	}
+	sortNeighbors(ns)
+	ids := make([]int64, 0, k)
+	for _, n := range ns[:min(k, len(ns))] {
+		ids = append(ids, n.id)
+	}
+	return ids
+}
+
+func queryKNN(t *testing.T, conn *sqlite.Conn, query string, args ...any) []int64 {
+	t.Helper()
+	var ids []int64
+	err := sqlitex.Execute(conn, query, &sqlitex.ExecOptions{
+		Args: args,
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			ids = append(ids, stmt.ColumnInt64(0))
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func recall(got, want []int64) float64 {
+	set := make(map[int64]bool, len(want))
+	for _, id := range want {
+		set[id] = true
+	}
+	hits := 0
+	for _, id := range got {
+		if set[id] {
+			hits++
+		}
+	}
+	return float64(hits) / float64(len(want))
+}
+
+func TestHNSWRecall(t *testing.T) {
+	const (
+		n       = 1000
+		dim     = 16
+		k       = 10
+		queries = 50
+	)
+	conn := openTestConn(t)
+	if err := Register(conn, dim); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlitex.ExecuteTransient(conn,
+		"CREATE VIRTUAL TABLE docs USING vector(embedding float[16], index=hnsw, m=12, ef_construction=64)", nil); err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	vectors := insertRandomVectors(t, conn, "docs", rng, n, dim)
+
+	var total float64
+	for i := 0; i < queries; i++ {
+		q := make([]float32, dim)
+		for j := range q {
+			q[j] = rng.Float32()*2 - 1
+		}
+		got := queryKNN(t, conn,
+			"SELECT rowid FROM docs WHERE embedding MATCH ?1 AND k = ?2 AND ef_search = 64 ORDER BY distance",
+			Float32ToBlob(q), k)
+		if len(got) != k {
+			t.Fatalf("query %d returned %d rows, want %d", i, len(got), k)
+		}
+		total += recall(got, bruteForceKNN(vectors, q, k))
+	}
+	if r := total / queries; r < 0.9 {
+		t.Errorf("recall@%d = %.3f, want >= 0.9", k, r)
+	} else {
+		t.Logf("recall@%d = %.3f", k, r)
+	}
+}
+
+func TestHNSWDistancesMatchBruteForce(t *testing.T) {
+	conn := openTestConn(t)
+	if err := Register(conn, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlitex.ExecuteTransient(conn,
+		"CREATE VIRTUAL TABLE docs USING vector(embedding float[3], content TEXT, index=hnsw)", nil); err != nil {
+		t.Fatal(err)
+	}
+	setupVecTableRows(t, conn)
+
+	var contents []string
+	var distances []float64
+	err := sqlitex.Execute(conn,
+		"SELECT content, distance FROM docs WHERE embedding MATCH '[1, 0, 0]' AND k = 3",
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				contents = append(contents, stmt.ColumnText(0))
+				distances = append(distances, stmt.ColumnFloat(1))
+				return nil
+			},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a", "e", "d"}
+	wantDist := []float64{0, 0.75, 1}
+	if len(contents) != len(want) {
+		t.Fatalf("got %v, want %v", contents, want)
+	}
+	for i := range want {
+		if contents[i] != want[i] || distances[i] != wantDist[i] {
+			t.Errorf("result[%d] = (%q, %v), want (%q, %v)", i, contents[i], distances[i], want[i], wantDist[i])
+		}
+	}
+}
+
+func TestHNSWDeleteAndUpdate(t *testing.T) {
+	const dim = 8
+	conn := openTestConn(t)
+	if err := Register(conn, dim); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlitex.ExecuteTransient(conn,
+		"CREATE VIRTUAL TABLE docs USING vector(embedding float[8], index=hnsw, m=6, ef_construction=32)", nil); err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(2))
+	vectors := insertRandomVectors(t, conn, "docs", rng, 300, dim)
+
+	// Delete every third row, including whichever node is the entry point.
+	var entry int64
+	err := sqlitex.Execute(conn, "SELECT value FROM docs_hnsw_meta WHERE key = 'entry_point'", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			entry = stmt.ColumnInt64(0)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted := []int64{entry}
+	for id := int64(3); id <= 300; id += 3 {
+		if id != entry {
+			deleted = append(deleted, id)
+		}
+	}
+	for _, id := range deleted {
+		if err := sqlitex.Execute(conn, "DELETE FROM docs WHERE rowid = ?", &sqlitex.ExecOptions{Args: []any{id}}); err != nil {
+			t.Fatal(err)
+		}
+		delete(vectors, id)
+	}
+
+	// Move one row to a known location.
+	target := make([]float32, dim)
+	for i := range target {
+		target[i] = 5
+	}
+	if err := sqlitex.Execute(conn, "UPDATE docs SET embedding = ? WHERE rowid = 1",
+		&sqlitex.ExecOptions{Args: []any{Float32ToBlob(target)}}); err != nil {
+		t.Fatal(err)
+	}
+	vectors[1] = target
+
+	var edgeRows int
+	err = sqlitex.Execute(conn, "SELECT COUNT(DISTINCT id) FROM docs_hnsw_edges", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			edgeRows = stmt.ColumnInt(0)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edgeRows != len(vectors) {
+		t.Errorf("graph has %d nodes, want %d", edgeRows, len(vectors))
+	}
+
+	got := queryKNN(t, conn, "SELECT rowid FROM docs WHERE embedding MATCH ?1 AND k = 1", Float32ToBlob(target))
+	if len(got) != 1 || got[0] != 1 {
+		t.Errorf("nearest to updated vector = %v, want [1]", got)
+	}
+
+	var total float64
+	for i := 0; i < 20; i++ {
+		q := make([]float32, dim)
+		for j := range q {
+			q[j] = rng.Float32()*2 - 1
+		}
+		got := queryKNN(t, conn, "SELECT rowid FROM docs WHERE embedding MATCH ?1 AND k = 5 AND ef_search = 50", Float32ToBlob(q))
+		for _, id := range got {
+			if _, ok := vectors[id]; !ok {
+				t.Fatalf("search returned deleted row %d", id)
+			}
+		}
+		total += recall(got, bruteForceKNN(vectors, q, 5))
+	}
+	if r := total / 20; r < 0.9 {
+		t.Errorf("recall@5 after deletes = %.3f, want >= 0.9", r)
+	}
+}
+
+func TestHNSWDeleteAll(t *testing.T) {
+	conn := openTestConn(t)
+	if err := Register(conn, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlitex.ExecuteTransient(conn,
+		"CREATE VIRTUAL TABLE docs USING vector(embedding float[3], content TEXT, index=hnsw)", nil); err != nil {
+		t.Fatal(err)
+	}
+	setupVecTableRows(t, conn)
+	if err := sqlitex.ExecuteTransient(conn, "DELETE FROM docs", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := queryKNN(t, conn, "SELECT rowid FROM docs WHERE embedding MATCH '[1, 0, 0]' AND k = 3"); len(got) != 0 {
+		t.Errorf("search on empty table returned %v", got)
+	}
+	if err := sqlitex.ExecuteTransient(conn, "INSERT INTO docs (content, embedding) VALUES ('z', '[1, 0, 0]')", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := queryKNN(t, conn, "SELECT rowid FROM docs WHERE embedding MATCH '[1, 0, 0]' AND k = 3"); len(got) != 1 {
+		t.Errorf("search after reinsert returned %v, want one row", got)
+	}
+}
+
+func TestHNSWHugeK(t *testing.T) {
+	conn := openTestConn(t)
+	if err := Register(conn, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlitex.ExecuteTransient(conn,
+		"CREATE VIRTUAL TABLE docs USING vector(embedding float[3], content TEXT, index=hnsw)", nil); err != nil {
+		t.Fatal(err)
+	}
+	setupVecTableRows(t, conn)
+	for _, query := range []string{
+		"SELECT rowid FROM docs WHERE embedding MATCH '[1, 0, 0]' AND k = 9223372036854775807",
+		"SELECT rowid FROM docs WHERE embedding MATCH '[1, 0, 0]' AND k = 2 AND ef_search = 100000000000",
+		"SELECT rowid FROM docs WHERE embedding MATCH '[1, 0, 0]' LIMIT -1",
+	} {
+		got := queryKNN(t, conn, query)
+		if len(got) == 0 || got[0] != 1 {
+			t.Errorf("%s = %v, want nearest row 1 first", query, got)
+		}
+	}
+}
+
+func TestHNSWMissingShadowTable(t *testing.T) {
+	for _, table := range []string{"docs_hnsw_edges", "docs_rows"} {
+		t.Run(table, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "hnsw.db")
+			conn, err := sqlite.OpenConn(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := Register(conn, 3); err != nil {
+				t.Fatal(err)
+			}
+			if err := sqlitex.ExecuteTransient(conn,
+				"CREATE VIRTUAL TABLE docs USING vector(embedding float[3], content TEXT, index=hnsw)", nil); err != nil {
+				t.Fatal(err)
+			}
+			setupVecTableRows(t, conn)
+			if err := sqlitex.ExecuteTransient(conn, "DROP TABLE "+table, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := conn.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// A new connection has no cached statements, so the index's
+			// lookups fail when they are prepared.
+			conn, err = sqlite.OpenConn(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if err := Register(conn, 3); err != nil {
+				t.Fatal(err)
+			}
+			err = sqlitex.ExecuteTransient(conn, "SELECT rowid FROM docs WHERE embedding MATCH '[1, 0, 0]' AND k = 3", nil)
+			if err == nil || !strings.Contains(err.Error(), "no such table") {
+				t.Errorf("search = %v, want a missing table error", err)
+			}
+		})
+	}
+}
+
+func TestHNSWPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hnsw.db")
+	conn, err := sqlite.OpenConn(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Register(conn, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlitex.ExecuteTransient(conn,
+		"CREATE VIRTUAL TABLE docs USING vector(embedding float[4], index=hnsw, m=4, ef_construction=16)", nil); err != nil {
+		t.Fatal(err)
+	}
+	vectors := insertRandomVectors(t, conn, "docs", rand.New(rand.NewSource(3)), 100, 4)
+	q := []float32{0.1, 0.2, 0.3, 0.4}
+	before := queryKNN(t, conn, "SELECT rowid FROM docs WHERE embedding MATCH ?1 AND k = 5", Float32ToBlob(q))
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err = sqlite.OpenConn(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := Register(conn, 4); err != nil {
+		t.Fatal(err)
+	}
+	after := queryKNN(t, conn, "SELECT rowid FROM docs WHERE embedding MATCH ?1 AND k = 5", Float32ToBlob(q))
+	if len(after) != len(before) {
+		t.Fatalf("after reopen got %v, want %v", after, before)
+	}
+	for i := range before {
+		if after[i] != before[i] {
+			t.Errorf("after reopen result[%d] = %d, want %d", i, after[i], before[i])
+		}
+	}
+	if r := recall(after, bruteForceKNN(vectors, q, 5)); r < 0.8 {
+		t.Errorf("recall@5 = %.2f", r)
+	}
+
+	if err := sqlitex.ExecuteTransient(conn, "ALTER TABLE docs RENAME TO docs2", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := queryKNN(t, conn, "SELECT rowid FROM docs2 WHERE embedding MATCH ?1 AND k = 5", Float32ToBlob(q)); len(got) != 5 {
+		t.Errorf("after rename got %v", got)
+	}
+	if err := sqlitex.ExecuteTransient(conn, "DROP TABLE docs2", nil); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	err = sqlitex.Execute(conn, "SELECT name FROM sqlite_schema", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			names = append(names, stmt.ColumnText(0))
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if len(names) != 0 {
+		t.Errorf("schema objects remain after DROP TABLE: %v", names)
+	}
+}
@@ -0,0 +1,240 @@
+// Package httpembed provides vector.Embedder implementations that call
+// embedding models over HTTP: the OpenAI embeddings API and servers
+// compatible with it, and Ollama. Both implement vector.BatchEmbedder, so
+// vector_embed_batch sends each batch in a single request.
+package httpembed
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRetries = 3
+	defaultBackoff = 500 * time.Millisecond
+	maxBackoff     = 30 * time.Second
+
+	// maxErrorBody is how much of an error response is kept in a
+	// StatusError.
+	maxErrorBody = 1 << 10
+)
+
+type config struct {
+	baseURL    string
+	dimensions int
+	headers    http.Header
+	client     *http.Client
+	retries    int
+	backoff    time.Duration
+	limiter    *limiter
+}
+
+// Option configures an Embedder.
+type Option func(*config)
+
+// WithBaseURL sets the URL the API paths are resolved against, such as
+// "https://api.openai.com/v1" or "http://localhost:11434".
+func WithBaseURL(url string) Option {
+	return func(c *config) {
+		c.baseURL = strings.TrimRight(url, "/")
+	}
+}
+
+// WithAPIKey sends key as a bearer token in the Authorization header.
+func WithAPIKey(key string) Option {
+	return WithHeader("Authorization", "Bearer "+key)
+}
+
+// WithHeader sends an extra header with every request, for example an
+// api-key header for Azure OpenAI.
+func WithHeader(name, value string) Option {
+	return func(c *config) {
+		c.headers.Set(name, value)
+	}
+}
+
+// WithDimensions asks the model for embeddings of n dimensions, for models
+// that can shorten their output. By default the request does not set it.
+func WithDimensions(n int) Option {
+	return func(c *config) {
+		c.dimensions = n
+	}
+}
+
+// WithHTTPClient sets the client used to send requests. The default is
+// http.DefaultClient.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *config) {
+		c.client = client
+	}
+}
+
+// WithRetries sets how many times a request is retried after a network
+// error, a 429 or a 5xx response, and the delay before the first retry.
+// The delay doubles after each attempt, with jitter, up to 30 seconds; a
+// Retry-After header overrides it. The default is 3 retries starting at
+// 500ms. A negative n or backoff is treated as 0.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(c *config) {
+		c.retries = max(n, 0)
+		c.backoff = max(backoff, 0)
+	}
+}
+
+// WithRateLimit limits requests to perSecond on average, waiting before a
+// request when it would exceed the limit. By default requests are not
+// limited.
+func WithRateLimit(perSecond float64) Option {
+	return func(c *config) {
+		c.limiter = nil
+		if perSecond > 0 {
+			c.limiter = &limiter{interval: time.Duration(float64(time.Second) / perSecond)}
+		}
+	}
+}
+
+func newConfig(baseURL string, opts []Option) *config {
+	c := &config{
+		baseURL: baseURL,
+		headers: make(http.Header),
+		client:  http.DefaultClient,
+		retries: defaultRetries,
+		backoff: defaultBackoff,
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+// StatusError is returned when the server answers with a status other than
+// 200 OK after any retries.
+type StatusError struct {
+	StatusCode int
+	Body       string // the start of the response body
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("httpembed: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+func retryable(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// post sends body as JSON to path and decodes the JSON response into out,
+// retrying transient failures.
+func (c *config) post(ctx context.Context, path string, body, out any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("httpembed: %v", err)
+	}
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		retry, retryAfter, err := c.send(ctx, path, data, out)
+		if err == nil || !retry || attempt >= c.retries || ctx.Err() != nil {
+			return err
+		}
+		delay := retryAfter
+		if delay == 0 {
+			delay = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+			backoff = min(backoff*2, maxBackoff)
+		}
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// send makes one request and reports whether a failure is worth retrying:
+// a network error, a 429 or a 5xx. It also returns the delay requested by
+// a Retry-After header, if any.
+func (c *config) send(ctx context.Context, path string, data []byte, out any) (retry bool, retryAfter time.Duration, err error) {
+	if c.limiter != nil {
+		if err := c.limiter.wait(ctx); err != nil {
+			return false, 0, err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return false, 0, fmt.Errorf("httpembed: %v", err)
+	}
+	for name, values := range c.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return true, 0, fmt.Errorf("httpembed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s >= 0 {
+			retryAfter = min(time.Duration(s)*time.Second, maxBackoff)
+		}
+		err := &StatusError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(b))}
+		return retryable(resp.StatusCode), retryAfter, err
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return false, 0, fmt.Errorf("httpembed: decoding response: %v", err)
+	}
+	return false, 0, nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limiter spaces requests at least interval apart.
+type limiter struct {
+	interval time.Duration
+	mu       sync.Mutex
+	next     time.Time
+}
+
+func (l *limiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(l.interval)
+	l.mu.Unlock()
+	return sleep(ctx, at.Sub(now))
+}
+
+// checkCount returns an error unless the server returned one embedding per
+// input.
+func checkCount(got, want int) error {
+	if got != want {
+		return fmt.Errorf("httpembed: server returned %d embeddings for %d inputs", got, want)
+	}
+	return nil
+}
+
+// single embeds one text with a batch function.
+func single(ctx context.Context, batch func(context.Context, []string) ([][]float32, error), text string) ([]float32, error) {
+	vecs, err := batch(ctx, []string{text})
+	if err != nil {
+		return nil, err
+	}
+	return vecs[0], nil
+}
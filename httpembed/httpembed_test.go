@@ -0,0 +1,117 @@
+package httpembed
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyServer fails the first failures requests with status and then
+// returns one Ollama embedding.
+func flakyServer(t *testing.T, failures int32, status int, header http.Header) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			for name, values := range header {
+				w.Header()[name] = values
+			}
+			w.WriteHeader(status)
+			w.Write([]byte("try again"))
+			return
+		}
+		w.Write([]byte(`{"embeddings":[[1]]}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		failures int32
+		retries  int
+		header   http.Header
+		wantErr  bool
+		calls    int32
+	}{
+		{"recovers from 500", http.StatusInternalServerError, 2, 3, nil, false, 3},
+		{"recovers from 429 with Retry-After", http.StatusTooManyRequests, 1, 3, http.Header{"Retry-After": {"0"}}, false, 2},
+		{"gives up", http.StatusBadGateway, 5, 2, nil, true, 3},
+		{"does not retry 400", http.StatusBadRequest, 1, 3, nil, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, calls := flakyServer(t, tt.failures, tt.status, tt.header)
+			e := NewOllama("m", WithBaseURL(srv.URL), WithRetries(tt.retries, time.Millisecond))
+			_, err := e.Embed(context.Background(), "x")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if got := calls.Load(); got != tt.calls {
+				t.Errorf("server saw %d requests, want %d", got, tt.calls)
+			}
+			var se *StatusError
+			if tt.wantErr && (!errors.As(err, &se) || se.StatusCode != tt.status || se.Body != "try again") {
+				t.Errorf("err = %#v, want a StatusError for %d", err, tt.status)
+			}
+		})
+	}
+}
+
+func TestRetriesNegativeBackoff(t *testing.T) {
+	srv, calls := flakyServer(t, 1, http.StatusServiceUnavailable, nil)
+	e := NewOllama("m", WithBaseURL(srv.URL), WithRetries(3, -time.Second))
+	if _, err := e.Embed(context.Background(), "x"); err != nil {
+		t.Fatal(err)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("server saw %d requests, want 2", got)
+	}
+}
+
+func TestRetryCancel(t *testing.T) {
+	srv, calls := flakyServer(t, 100, http.StatusServiceUnavailable, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	e := NewOllama("m", WithBaseURL(srv.URL), WithRetries(10, time.Hour))
+	if _, err := e.Embed(ctx, "x"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("server saw %d requests, want 1", got)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	srv, calls := flakyServer(t, 0, 0, nil)
+	e := NewOllama("m", WithBaseURL(srv.URL), WithRateLimit(50))
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if _, err := e.Embed(context.Background(), "x"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first request goes at once, and each later one waits 20ms.
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("5 requests at 50/s took %v, want >= 80ms", elapsed)
+	}
+	if got := calls.Load(); got != 5 {
+		t.Errorf("server saw %d requests, want 5", got)
+	}
+}
+
+func TestEmptyBatch(t *testing.T) {
+	srv, calls := flakyServer(t, 0, 0, nil)
+	if vecs, err := NewOpenAI("m", WithBaseURL(srv.URL)).EmbedBatch(context.Background(), nil); err != nil || vecs != nil {
+		t.Errorf("EmbedBatch(nil) = %v, %v", vecs, err)
+	}
+	if got := calls.Load(); got != 0 {
+		t.Errorf("server saw %d requests, want 0", got)
+	}
+}
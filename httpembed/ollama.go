@@ -0,0 +1,55 @@
+package httpembed
+
+import (
+	"context"
+
+	vector "github.com/justintout/go-sqlite-vector"
+)
+
+// DefaultOllamaBaseURL is the address a local Ollama server listens on.
+const DefaultOllamaBaseURL = "http://localhost:11434"
+
+// Ollama embeds text with the POST /api/embed endpoint of an Ollama server.
+type Ollama struct {
+	model string
+	cfg   *config
+}
+
+var _ vector.BatchEmbedder = (*Ollama)(nil)
+
+// NewOllama returns an Embedder for model. Without WithBaseURL it calls
+// DefaultOllamaBaseURL.
+func NewOllama(model string, opts ...Option) *Ollama {
+	return &Ollama{model: model, cfg: newConfig(DefaultOllamaBaseURL, opts)}
+}
+
+type ollamaRequest struct {
+	Model      string   `json:"model"`
+	Input      []string `json:"input"`
+	Dimensions int      `json:"dimensions,omitempty"`
+}
+
+type ollamaResponse struct {
+	Embeddings [][]float32 `json:"embeddings"`
+}
+
+// Embed embeds a single text.
+func (e *Ollama) Embed(ctx context.Context, text string) ([]float32, error) {
+	return single(ctx, e.EmbedBatch, text)
+}
+
+// EmbedBatch embeds texts in one request.
+func (e *Ollama) EmbedBatch(ctx context.Context, texts []string) ([][]float32, error) {
+	if len(texts) == 0 {
+		return nil, nil
+	}
+	var resp ollamaResponse
+	req := ollamaRequest{Model: e.model, Input: texts, Dimensions: e.cfg.dimensions}
+	if err := e.cfg.post(ctx, "/api/embed", req, &resp); err != nil {
+		return nil, err
+	}
+	if err := checkCount(len(resp.Embeddings), len(texts)); err != nil {
+		return nil, err
+	}
+	return resp.Embeddings, nil
+}
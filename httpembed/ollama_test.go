@@ -0,0 +1,35 @@
+package httpembed
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestOllama(t *testing.T) {
+	var got ollamaRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/embed" {
+			t.Errorf("request = %s %s, want POST /api/embed", r.Method, r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		w.Write([]byte(`{"model":"nomic-embed-text","embeddings":[[0.5,0.25]]}`))
+	}))
+	defer srv.Close()
+
+	v, err := NewOllama("nomic-embed-text", WithBaseURL(srv.URL)).Embed(context.Background(), "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(v, []float32{0.5, 0.25}) {
+		t.Errorf("Embed = %v, want [0.5 0.25]", v)
+	}
+	if got.Model != "nomic-embed-text" || !slices.Equal(got.Input, []string{"hello"}) || got.Dimensions != 0 {
+		t.Errorf("request = %+v", got)
+	}
+}
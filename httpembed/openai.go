@@ -0,0 +1,70 @@
+package httpembed
+
+import (
+	"context"
+	"fmt"
+
+	vector "github.com/justintout/go-sqlite-vector"
+)
+
+// DefaultOpenAIBaseURL is the base URL of the OpenAI API.
+const DefaultOpenAIBaseURL = "https://api.openai.com/v1"
+
+// OpenAI embeds text with the POST /embeddings endpoint of the OpenAI API
+// or a server compatible with it, such as vLLM, LiteLLM or llama.cpp.
+type OpenAI struct {
+	model string
+	cfg   *config
+}
+
+var _ vector.BatchEmbedder = (*OpenAI)(nil)
+
+// NewOpenAI returns an Embedder for model. Without WithBaseURL it calls
+// DefaultOpenAIBaseURL; pass WithAPIKey to authenticate.
+func NewOpenAI(model string, opts ...Option) *OpenAI {
+	return &OpenAI{model: model, cfg: newConfig(DefaultOpenAIBaseURL, opts)}
+}
+
+type openAIRequest struct {
+	Model          string   `json:"model"`
+	Input          []string `json:"input"`
+	Dimensions     int      `json:"dimensions,omitempty"`
+	EncodingFormat string   `json:"encoding_format"`
+}
+
+type openAIResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+}
+
+// Embed embeds a single text.
+func (e *OpenAI) Embed(ctx context.Context, text string) ([]float32, error) {
+	return single(ctx, e.EmbedBatch, text)
+}
+
+// EmbedBatch embeds texts in one request.
+func (e *OpenAI) EmbedBatch(ctx context.Context, texts []string) ([][]float32, error) {
+	if len(texts) == 0 {
+		return nil, nil
+	}
+	var resp openAIResponse
+	req := openAIRequest{Model: e.model, Input: texts, Dimensions: e.cfg.dimensions, EncodingFormat: "float"}
+	if err := e.cfg.post(ctx, "/embeddings", req, &resp); err != nil {
+		return nil, err
+	}
+	if err := checkCount(len(resp.Data), len(texts)); err != nil {
+		return nil, err
+	}
+	// The API documents the index of each embedding rather than promising
+	// the input order.
+	out := make([][]float32, len(texts))
+	for _, d := range resp.Data {
+		if d.Index < 0 || d.Index >= len(out) || out[d.Index] != nil {
+			return nil, fmt.Errorf("httpembed: server returned an embedding with invalid index %d", d.Index)
+		}
+		out[d.Index] = d.Embedding
+	}
+	return out, nil
+}
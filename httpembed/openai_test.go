@@ -0,0 +1,58 @@
+package httpembed
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestOpenAI(t *testing.T) {
+	var got openAIRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/embeddings" {
+			t.Errorf("request = %s %s, want POST /v1/embeddings", r.Method, r.URL.Path)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer sk-test" {
+			t.Errorf("Authorization = %q", auth)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		// Out of order, as the API allows.
+		w.Write([]byte(`{"data":[{"index":1,"embedding":[3,4]},{"index":0,"embedding":[1,2]}]}`))
+	}))
+	defer srv.Close()
+
+	e := NewOpenAI("text-embedding-3-small", WithBaseURL(srv.URL+"/v1/"), WithAPIKey("sk-test"), WithDimensions(2))
+	vecs, err := e.EmbedBatch(context.Background(), []string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(vecs[0], []float32{1, 2}) || !slices.Equal(vecs[1], []float32{3, 4}) {
+		t.Errorf("EmbedBatch = %v, want [[1 2] [3 4]]", vecs)
+	}
+	want := openAIRequest{Model: "text-embedding-3-small", Input: []string{"a", "b"}, Dimensions: 2, EncodingFormat: "float"}
+	if got.Model != want.Model || !slices.Equal(got.Input, want.Input) || got.Dimensions != want.Dimensions || got.EncodingFormat != want.EncodingFormat {
+		t.Errorf("request = %+v, want %+v", got, want)
+	}
+}
+
+func TestOpenAIBadResponse(t *testing.T) {
+	for _, body := range []string{
+		`{"data":[{"index":0,"embedding":[1]}]}`,
+		`{"data":[{"index":0,"embedding":[1]},{"index":0,"embedding":[2]}]}`,
+		`{"data":[{"index":0,"embedding":[1]},{"index":5,"embedding":[2]}]}`,
+		`not json`,
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		}))
+		if _, err := NewOpenAI("m", WithBaseURL(srv.URL)).EmbedBatch(context.Background(), []string{"a", "b"}); err == nil {
+			t.Errorf("EmbedBatch accepted response %s", body)
+		}
+		srv.Close()
+	}
+}
@@ -0,0 +1,167 @@
+package vector
+
+import (
+	"fmt"
+	"sort"
+
+	"zombiezen.com/go/sqlite"
+)
+
+const (
+	// defaultRRFK is the reciprocal rank fusion constant from Cormack et
+	// al., which damps the influence of the very top ranks.
+	defaultRRFK = 60
+	// hybridDepth is how many candidates, as a multiple of k, each side of a
+	// hybrid search ranks before fusion, so that a row ranked just outside
+	// the top k on both sides can still win.
+	hybridDepth = 4
+)
+
+// hybridFunc returns the vector_hybrid table-valued function, which fuses a
+// full-text search over an FTS5 table with a vector search over a column of
+// the table it indexes using weighted reciprocal rank fusion:
+//
+//	score = fts_weight/(rrf_k + fts_rank) + vector_weight/(rrf_k + vector_rank)
+//
+// Ranks start at 1. A row missing from one side gets no score from it.
+func hybridFunc(conn *sqlite.Conn, cfg *config) *tableFunc {
+	return &tableFunc{
+		name:     cfg.funcName("_hybrid"),
+		columns:  []string{"id INTEGER", "score REAL", "fts_rank INTEGER", "vector_rank INTEGER"},
+		params:   []string{"fts_table", "match", "table_name", "column_name", "query", "k", "rrf_k", "fts_weight", "vector_weight"},
+		required: 6,
+		run: func(params []sqlite.Value) ([]tableFuncRow, error) {
+			k := params[5].Int()
+			if k < 0 {
+				return nil, fmt.Errorf("k must be >= 0, got %d", k)
+			}
+			rrfK := float64(defaultRRFK)
+			if params[6].Type() != sqlite.TypeNull {
+				if rrfK = params[6].Float(); rrfK < 0 {
+					return nil, fmt.Errorf("rrf_k must be >= 0, got %v", rrfK)
+				}
+			}
+			weights := [2]float64{1, 1}
+			for i, name := range [2]string{"fts_weight", "vector_weight"} {
+				if p := params[7+i]; p.Type() != sqlite.TypeNull {
+					if weights[i] = p.Float(); weights[i] < 0 {
+						return nil, fmt.Errorf("%s must be >= 0, got %v", name, weights[i])
+					}
+				}
+			}
+			// Neither side can rank more rows than the table holds, so
+			// bound k by its size before scaling it; a k from SQL could
+			// otherwise overflow or size the searches' buffers.
+			n, err := countRows(conn, params[2].Text())
+			if err != nil {
+				return nil, err
+			}
+			depth := min(min(k, n)*hybridDepth, n)
+
+			var lists [2][]int64
+			if params[1].Type() != sqlite.TypeNull {
+				ids, err := ftsSearch(conn, params[0].Text(), params[1].Text(), depth)
+				if err != nil {
+					return nil, err
+				}
+				lists[0] = ids
+			}
+			if params[4].Type() != sqlite.TypeNull {
+				q, model, err := scanQuery(cfg, params[4])
+				if err != nil {
+					return nil, fmt.Errorf("query: %v", err)
+				}
+				neighbors, err := scanTopK(conn, cfg, params[2].Text(), params[3].Text(), "", q, model, depth)
+				if err != nil {
+					return nil, err
+				}
+				for _, n := range neighbors {
+					lists[1] = append(lists[1], n.id)
+				}
+			}
+			return fuseRanks(lists, weights, rrfK, k), nil
+		},
+	}
+}
+
+// countRows returns the number of rows in table.
+func countRows(conn *sqlite.Conn, table string) (int, error) {
+	stmt, err := prepareTransient(conn, "SELECT count(*) FROM "+quoteIdent(table))
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Finalize()
+	if _, err := stmt.Step(); err != nil {
+		return 0, err
+	}
+	return stmt.ColumnInt(0), nil
+}
+
+// ftsSearch returns the row IDs of the first limit matches of match in the
+// FTS5 table, best first by its rank.
+func ftsSearch(conn *sqlite.Conn, table, match string, limit int) ([]int64, error) {
+	stmt, err := prepareTransient(conn, fmt.Sprintf("SELECT rowid FROM %s WHERE %[1]s MATCH ? ORDER BY rank LIMIT ?", quoteIdent(table)))
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Finalize()
+	stmt.BindText(1, match)
+	stmt.BindInt64(2, int64(limit))
+	var ids []int64
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, fmt.Errorf("full-text search: %v", err)
+		}
+		if !hasRow {
+			return ids, nil
+		}
+		ids = append(ids, stmt.ColumnInt64(0))
+	}
+}
+
+type fusedRow struct {
+	id    int64
+	score float64
+	ranks [2]int
+}
+
+// fuseRanks combines ranked lists of row IDs with weighted reciprocal rank
+// fusion and returns the k best rows, highest score first with ties broken
+// by row ID.
+func fuseRanks(lists [2][]int64, weights [2]float64, rrfK float64, k int) []tableFuncRow {
+	byID := make(map[int64]*fusedRow)
+	var fused []*fusedRow
+	for side, ids := range lists {
+		for i, id := range ids {
+			r := byID[id]
+			if r == nil {
+				r = &fusedRow{id: id}
+				byID[id] = r
+				fused = append(fused, r)
+			}
+			r.ranks[side] = i + 1
+			r.score += weights[side] / (rrfK + float64(i+1))
+		}
+	}
+	sort.Slice(fused, func(i, j int) bool {
+		if fused[i].score != fused[j].score {
+			return fused[i].score > fused[j].score
+		}
+		return fused[i].id < fused[j].id
+	})
+	if k < len(fused) {
+		fused = fused[:k]
+	}
+	rows := make([]tableFuncRow, len(fused))
+	for i, r := range fused {
+		values := []sqlite.Value{sqlite.IntegerValue(r.id), sqlite.FloatValue(r.score), {}, {}}
+		for side, rank := range r.ranks {
+			if rank > 0 {
+				values[2+side] = sqlite.IntegerValue(int64(rank))
+			}
+		}
+		rows[i] = tableFuncRow{rowID: r.id, values: values}
+	}
+	return rows
+}
@@ -0,0 +1,121 @@
+package vector
+
+import (
+	"math"
+	"slices"
+	"strings"
+	"testing"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestFuseRanks(t *testing.T) {
+	lists := [2][]int64{{1, 2, 3}, {3, 4, 1}}
+	rows := fuseRanks(lists, [2]float64{1, 1}, 60, 10)
+	var ids []int64
+	for _, r := range rows {
+		ids = append(ids, r.rowID)
+	}
+	// 1 and 3 appear on both sides with ranks {1,3} and {3,1}; the tie is
+	// broken by row ID.
+	if want := []int64{1, 3, 2, 4}; !slices.Equal(ids, want) {
+		t.Fatalf("fused order = %v, want %v", ids, want)
+	}
+	if got, want := rows[0].values[1].Float(), 1.0/61+1.0/63; math.Abs(got-want) > 1e-12 {
+		t.Errorf("score of row 1 = %v, want %v", got, want)
+	}
+	if rows[2].values[3].Type() != sqlite.TypeNull {
+		t.Errorf("vector_rank of a full-text-only row = %v, want NULL", rows[2].values[3])
+	}
+
+	rows = fuseRanks(lists, [2]float64{0, 1}, 60, 2)
+	if len(rows) != 2 || rows[0].rowID != 3 || rows[1].rowID != 4 {
+		t.Errorf("vector-only fusion = %v, want rows 3 and 4", rows)
+	}
+}
+
+func TestVectorHybrid(t *testing.T) {
+	conn := openTestConn(t)
+	if err := Register(conn, 2); err != nil {
+		t.Fatal(err)
+	}
+	err := sqlitex.ExecuteScript(conn, `
+		CREATE TABLE docs (body TEXT, embedding BLOB);
+		CREATE VIRTUAL TABLE docs_fts USING fts5(body, content='docs', content_rowid='rowid');
+		INSERT INTO docs (rowid, body, embedding) VALUES
+			(1, 'sqlite vector search', vector_encode('[0,1]')),
+			(2, 'cooking with garlic', vector_encode('[1,0]')),
+			(3, 'vector databases compared', vector_encode('[0.9,0.1]')),
+			(4, 'gardening in spring', vector_encode('[0,0.9]'));
+		INSERT INTO docs_fts (docs_fts) VALUES ('rebuild');
+	`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		id         int64
+		ftsRank    int64
+		vectorRank int64
+	}
+	query := func(q string) []result {
+		var got []result
+		err := sqlitex.ExecuteTransient(conn, q, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				got = append(got, result{stmt.ColumnInt64(0), stmt.ColumnInt64(1), stmt.ColumnInt64(2)})
+				return nil
+			},
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+		return got
+	}
+
+	got := query("SELECT id, fts_rank, vector_rank FROM vector_hybrid('docs_fts', 'vector', 'docs', 'embedding', '[1,0]', 2)")
+	// Row 3 ranks second on both sides, which beats row 1 (first for the text,
+	// last for the vector) and row 2 (nearest, but no text match).
+	want := []result{{3, 2, 2}, {1, 1, 4}}
+	if !slices.Equal(got, want) {
+		t.Errorf("hybrid = %v, want %v", got, want)
+	}
+
+	got = query("SELECT id, fts_rank, vector_rank FROM vector_hybrid('docs_fts', NULL, 'docs', 'embedding', '[0,1]', 2)")
+	if want := []result{{1, 0, 1}, {4, 0, 2}}; !slices.Equal(got, want) {
+		t.Errorf("vector-only hybrid = %v, want %v", got, want)
+	}
+
+	got = query("SELECT id, fts_rank, vector_rank FROM vector_hybrid('docs_fts', 'garlic', 'docs', 'embedding', NULL, 5)")
+	if want := []result{{2, 1, 0}}; !slices.Equal(got, want) {
+		t.Errorf("text-only hybrid = %v, want %v", got, want)
+	}
+
+	got = query("SELECT id, fts_rank, vector_rank FROM vector_hybrid('docs_fts', 'vector', 'docs', 'embedding', '[1,0]', 9223372036854775807)")
+	if len(got) != 4 || got[0] != (result{3, 2, 2}) {
+		t.Errorf("hybrid with huge k = %v, want all 4 rows starting with row 3", got)
+	}
+
+	err = sqlitex.ExecuteTransient(conn, "SELECT * FROM vector_hybrid('docs_fts', 'x', 'docs', 'embedding', NULL, 5, -1)", nil)
+	if err == nil || !strings.Contains(err.Error(), "rrf_k must be >= 0") {
+		t.Errorf("err = %v, want rrf_k error", err)
+	}
+	err = sqlitex.ExecuteTransient(conn, "SELECT * FROM vector_hybrid('docs_fts', 'AND', 'docs', 'embedding', NULL, 5)", nil)
+	if err == nil || !strings.Contains(err.Error(), "full-text search") {
+		t.Errorf("err = %v, want full-text search syntax error", err)
+	}
+
+	// A hybrid search inside a cached statement with the text of its row
+	// count must not reset or finalize that statement.
+	outer := 0
+	err = sqlitex.Execute(conn, `SELECT count(*) FROM "docs"`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			outer = stmt.ColumnInt(0)
+			query("SELECT id, fts_rank, vector_rank FROM vector_hybrid('docs_fts', 'vector', 'docs', 'embedding', '[1,0]', 2)")
+			return nil
+		},
+	})
+	if err != nil || outer != 4 {
+		t.Errorf("outer count = %d, %v, want 4", outer, err)
+	}
+}
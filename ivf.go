@@ -0,0 +1,498 @@
+package vector
+
+import (
+	"fmt"
+	"math/rand"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// An IVF (inverted file) index over a BLOB column of an ordinary table.
+// vector_ivf_train runs k-means over the column and assigns every row to
+// its nearest centroid. The index lives in two side tables:
+//
+//	<table>_<column>_ivf_centroids (list, centroid)  float32 centroid blobs
+//	<table>_<column>_ivf_lists (list, id)            row IDs of each list
+//
+// A search ranks the centroids by squared L2 distance to the query and scans
+// only the rows of the nprobe nearest lists. The base table is not watched:
+// vector_ivf_assign indexes rows inserted since the last training run and
+// drops deleted ones, and training again rebuilds the index from scratch.
+
+const (
+	defaultIVFIterations = 25
+	defaultIVFNProbe     = 8
+	// ivfSamplesPerList caps the number of vectors k-means trains on.
+	ivfSamplesPerList = 256
+)
+
+type ivfIndex struct {
+	conn   *sqlite.Conn
+	cfg    *config
+	table  string
+	column string
+}
+
+func (ix *ivfIndex) sideName(suffix string) string {
+	return ix.table + "_" + ix.column + suffix
+}
+
+func (ix *ivfIndex) centroidsTable() string { return quoteIdent(ix.sideName("_ivf_centroids")) }
+func (ix *ivfIndex) listsTable() string     { return quoteIdent(ix.sideName("_ivf_lists")) }
+
+func (ix *ivfIndex) createTables() error {
+	stmts := []string{
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (list INTEGER PRIMARY KEY, centroid BLOB NOT NULL)", ix.centroidsTable()),
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (list INTEGER NOT NULL, id INTEGER NOT NULL, PRIMARY KEY (list, id)) WITHOUT ROWID", ix.listsTable()),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (id)", quoteIdent(ix.sideName("_ivf_lists_id")), ix.listsTable()),
+	}
+	for _, s := range stmts {
+		if err := sqlitex.ExecuteTransient(ix.conn, s, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trained reports whether vector_ivf_train has created the side tables.
+func (ix *ivfIndex) trained() (bool, error) {
+	found := false
+	err := sqlitex.Execute(ix.conn, "SELECT 1 FROM sqlite_schema WHERE type = 'table' AND name = ?", &sqlitex.ExecOptions{
+		Args: []any{ix.sideName("_ivf_centroids")},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			found = true
+			return nil
+		},
+	})
+	return found, err
+}
+
+func (ix *ivfIndex) eachRow(fn func(id int64, vec []float32) error) error {
+	return eachVector(ix.conn, ix.cfg, ix.table, ix.column, fn)
+}
+
+// eachVector calls fn with the row ID and decoded vector of every non-NULL
+// value in table.column.
+func eachVector(conn *sqlite.Conn, cfg *config, table, column string, fn func(id int64, vec []float32) error) error {
+	stmt, err := prepareTransient(conn, fmt.Sprintf("SELECT rowid, %s FROM %s WHERE %[1]s IS NOT NULL",
+		quoteIdent(column), quoteIdent(table)))
+	if err != nil {
+		return err
+	}
+	defer stmt.Finalize()
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return err
+		}
+		if !hasRow {
+			return nil
+		}
+		id := stmt.ColumnInt64(0)
+		b := make([]byte, stmt.ColumnLen(1))
+		stmt.ColumnBytes(1, b)
+		vec, err := cfg.decodeVector(b)
+		if err != nil {
+			return fmt.Errorf("row %d: %v", id, err)
+		}
+		if err := fn(id, vec); err != nil {
+			return err
+		}
+	}
+}
+
+// sampleVectors returns a uniform reservoir sample of at most max vectors
+// from table.column.
+func sampleVectors(conn *sqlite.Conn, cfg *config, table, column string, max int, rng *rand.Rand) ([][]float32, error) {
+	var sample [][]float32
+	seen := 0
+	err := eachVector(conn, cfg, table, column, func(id int64, vec []float32) error {
+		seen++
+		if len(sample) < max {
+			sample = append(sample, vec)
+		} else if j := rng.Intn(seen); j < max {
+			sample[j] = vec
+		}
+		return nil
+	})
+	return sample, err
+}
+
+// train runs k-means with nlist centroids over a sample of the column,
+// replaces any previous index and assigns every row. It returns the size of
+// each list.
+func (ix *ivfIndex) train(nlist, iterations int) ([]int, error) {
+	rng := rand.New(rand.NewSource(1))
+	sample, err := sampleVectors(ix.conn, ix.cfg, ix.table, ix.column, nlist*ivfSamplesPerList, rng)
+	if err != nil {
+		return nil, err
+	}
+	if len(sample) < nlist {
+		return nil, fmt.Errorf("nlist %d exceeds the %d vectors in %s.%s", nlist, len(sample), ix.table, ix.column)
+	}
+	centroids := kmeans(sample, nlist, iterations, rng)
+
+	if err := ix.createTables(); err != nil {
+		return nil, err
+	}
+	for _, table := range []string{ix.centroidsTable(), ix.listsTable()} {
+		if err := sqlitex.ExecuteTransient(ix.conn, "DELETE FROM "+table, nil); err != nil {
+			return nil, err
+		}
+	}
+	insert := fmt.Sprintf("INSERT INTO %s (list, centroid) VALUES (?, ?)", ix.centroidsTable())
+	for i, c := range centroids {
+		if err := sqlitex.Execute(ix.conn, insert, &sqlitex.ExecOptions{Args: []any{i, Float32ToBlob(c)}}); err != nil {
+			return nil, err
+		}
+	}
+
+	sizes := make([]int, nlist)
+	var ids []int64
+	var lists []int
+	err = ix.eachRow(func(id int64, vec []float32) error {
+		list := nearestCentroid(centroids, vec)
+		ids = append(ids, id)
+		lists = append(lists, list)
+		sizes[list]++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sizes, ix.insertAssignments(ids, lists)
+}
+
+// assign drops rows that no longer exist from the index and assigns rows
+// that are not yet in any list. It returns the number of rows assigned.
+func (ix *ivfIndex) assign() (int, error) {
+	if err := ix.requireTrained(); err != nil {
+		return 0, err
+	}
+	err := sqlitex.ExecuteTransient(ix.conn, fmt.Sprintf("DELETE FROM %s WHERE id NOT IN (SELECT rowid FROM %s WHERE %s IS NOT NULL)",
+		ix.listsTable(), quoteIdent(ix.table), quoteIdent(ix.column)), nil)
+	if err != nil {
+		return 0, err
+	}
+	centroids, err := ix.loadCentroids()
+	if err != nil {
+		return 0, err
+	}
+	assigned := make(map[int64]bool)
+	err = sqlitex.ExecuteTransient(ix.conn, "SELECT id FROM "+ix.listsTable(), &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			assigned[stmt.ColumnInt64(0)] = true
+			return nil
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	var lists []int
+	err = ix.eachRow(func(id int64, vec []float32) error {
+		if !assigned[id] {
+			ids = append(ids, id)
+			lists = append(lists, nearestCentroid(centroids, vec))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(ids), ix.insertAssignments(ids, lists)
+}
+
+func (ix *ivfIndex) insertAssignments(ids []int64, lists []int) error {
+	insert := fmt.Sprintf("INSERT INTO %s (list, id) VALUES (?, ?)", ix.listsTable())
+	for i, id := range ids {
+		if err := sqlitex.Execute(ix.conn, insert, &sqlitex.ExecOptions{Args: []any{lists[i], id}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ix *ivfIndex) requireTrained() error {
+	ok, err := ix.trained()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("no IVF index on %s.%s, call vector_ivf_train first", ix.table, ix.column)
+	}
+	return nil
+}
+
+func (ix *ivfIndex) loadCentroids() ([][]float32, error) {
+	var centroids [][]float32
+	err := sqlitex.ExecuteTransient(ix.conn, fmt.Sprintf("SELECT centroid FROM %s ORDER BY list", ix.centroidsTable()), &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			b := make([]byte, stmt.ColumnLen(0))
+			stmt.ColumnBytes(0, b)
+			c, err := BlobToFloat32(b)
+			if err != nil {
+				return err
+			}
+			if len(c) != ix.cfg.dim {
+				return fmt.Errorf("IVF index on %s.%s was trained for dimension %d, expected %d", ix.table, ix.column, len(c), ix.cfg.dim)
+			}
+			centroids = append(centroids, c)
+			return nil
+		},
+	})
+	return centroids, err
+}
+
+// search returns the k rows nearest to q among the nprobe lists whose
+// centroids are nearest to q, by squared L2 distance.
+func (ix *ivfIndex) search(q []float32, k, nprobe int) ([]neighbor, error) {
+	if err := ix.requireTrained(); err != nil {
+		return nil, err
+	}
+	centroids, err := ix.loadCentroids()
+	if err != nil {
+		return nil, err
+	}
+	probes := make([]neighbor, len(centroids))
+	for i, c := range centroids {
+		probes[i] = neighbor{id: int64(i), distance: l2Squared(q, c)}
+	}
+	sortNeighbors(probes)
+	if nprobe < len(probes) {
+		probes = probes[:nprobe]
+	}
+
+	stmt, err := prepareTransient(ix.conn, fmt.Sprintf("SELECT l.id, t.%s FROM %s AS l JOIN %s AS t ON t.rowid = l.id WHERE l.list = ?",
+		quoteIdent(ix.column), ix.listsTable(), quoteIdent(ix.table)))
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Finalize()
+	top := newTopK(k)
+	for _, p := range probes {
+		if err := stmt.Reset(); err != nil {
+			return nil, err
+		}
+		stmt.BindInt64(1, p.id)
+		for {
+			hasRow, err := stmt.Step()
+			if err != nil {
+				return nil, err
+			}
+			if !hasRow {
+				break
+			}
+			if stmt.ColumnType(1) == sqlite.TypeNull {
+				continue
+			}
+			id := stmt.ColumnInt64(0)
+			b := make([]byte, stmt.ColumnLen(1))
+			stmt.ColumnBytes(1, b)
+			vec, err := ix.cfg.decodeVector(b)
+			if err != nil {
+				return nil, fmt.Errorf("row %d: %v", id, err)
+			}
+			top.push(id, l2Squared(q, vec))
+		}
+	}
+	return top.sorted(), nil
+}
+
+func nearestCentroid(centroids [][]float32, v []float32) int {
+	best, bestDist := 0, l2Squared(v, centroids[0])
+	for i := 1; i < len(centroids); i++ {
+		if d := l2Squared(v, centroids[i]); d < bestDist {
+			best, bestDist = i, d
+		}
+	}
+	return best
+}
+
+// kmeans clusters data into k centroids using k-means++ seeding followed by
+// at most iterations rounds of Lloyd's algorithm. It requires len(data) >= k.
+func kmeans(data [][]float32, k, iterations int, rng *rand.Rand) [][]float32 {
+	dim := len(data[0])
+	centroids := make([][]float32, 0, k)
+	centroids = append(centroids, append([]float32(nil), data[rng.Intn(len(data))]...))
+	nearest := make([]float64, len(data))
+	for i, v := range data {
+		nearest[i] = l2Squared(v, centroids[0])
+	}
+	for len(centroids) < k {
+		var total float64
+		for _, d := range nearest {
+			total += d
+		}
+		pick := rng.Intn(len(data))
+		if total > 0 {
+			r := rng.Float64() * total
+			for i, d := range nearest {
+				if r -= d; r <= 0 {
+					pick = i
+					break
+				}
+			}
+		}
+		c := append([]float32(nil), data[pick]...)
+		centroids = append(centroids, c)
+		for i, v := range data {
+			if d := l2Squared(v, c); d < nearest[i] {
+				nearest[i] = d
+			}
+		}
+	}
+
+	assignment := make([]int, len(data))
+	for i := range assignment {
+		assignment[i] = -1
+	}
+	sums := make([][]float64, k)
+	for i := range sums {
+		sums[i] = make([]float64, dim)
+	}
+	counts := make([]int, k)
+	for iter := 0; iter < iterations; iter++ {
+		changed := false
+		for i, v := range data {
+			if c := nearestCentroid(centroids, v); c != assignment[i] {
+				assignment[i] = c
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+		for c := range sums {
+			counts[c] = 0
+			for j := range sums[c] {
+				sums[c][j] = 0
+			}
+		}
+		for i, v := range data {
+			c := assignment[i]
+			counts[c]++
+			for j, f := range v {
+				sums[c][j] += float64(f)
+			}
+		}
+		for c := range centroids {
+			if counts[c] == 0 {
+				// Reseed an empty cluster on a random vector.
+				copy(centroids[c], data[rng.Intn(len(data))])
+				continue
+			}
+			for j := range centroids[c] {
+				centroids[c][j] = float32(sums[c][j] / float64(counts[c]))
+			}
+		}
+	}
+	return centroids
+}
+
+// ivfFuncs returns the table-valued functions that train, maintain and
+// query IVF indexes.
+func ivfFuncs(conn *sqlite.Conn, cfg *config) []*tableFunc {
+	index := func(params []sqlite.Value) *ivfIndex {
+		return &ivfIndex{conn: conn, cfg: cfg, table: params[0].Text(), column: params[1].Text()}
+	}
+	return []*tableFunc{
+		{
+			name:     cfg.funcName("_ivf_train"),
+			columns:  []string{"list INTEGER", "size INTEGER"},
+			params:   []string{"table_name", "column_name", "nlist", "iterations"},
+			required: 3,
+			run: func(params []sqlite.Value) ([]tableFuncRow, error) {
+				nlist := params[2].Int()
+				if nlist < 1 {
+					return nil, fmt.Errorf("nlist must be >= 1, got %d", nlist)
+				}
+				iterations := defaultIVFIterations
+				if params[3].Type() != sqlite.TypeNull {
+					if iterations = params[3].Int(); iterations < 1 {
+						return nil, fmt.Errorf("iterations must be >= 1, got %d", iterations)
+					}
+				}
+				sizes, err := index(params).train(nlist, iterations)
+				if err != nil {
+					return nil, err
+				}
+				rows := make([]tableFuncRow, len(sizes))
+				for i, n := range sizes {
+					rows[i] = tableFuncRow{rowID: int64(i), values: []sqlite.Value{sqlite.IntegerValue(int64(i)), sqlite.IntegerValue(int64(n))}}
+				}
+				return rows, nil
+			},
+		},
+		{
+			name:     cfg.funcName("_ivf_assign"),
+			columns:  []string{"assigned INTEGER"},
+			params:   []string{"table_name", "column_name"},
+			required: 2,
+			run: func(params []sqlite.Value) ([]tableFuncRow, error) {
+				n, err := index(params).assign()
+				if err != nil {
+					return nil, err
+				}
+				return []tableFuncRow{{values: []sqlite.Value{sqlite.IntegerValue(int64(n))}}}, nil
+			},
+		},
+		{
+			name:     cfg.funcName("_ivf_search"),
+			columns:  []string{"id INTEGER", "distance REAL"},
+			params:   []string{"table_name", "column_name", "query", "k", "nprobe"},
+			required: 4,
+			run: func(params []sqlite.Value) ([]tableFuncRow, error) {
+				if params[2].Type() == sqlite.TypeNull {
+					return nil, nil
+				}
+				q, err := queryVector(cfg, params[2])
+				if err != nil {
+					return nil, err
+				}
+				k := params[3].Int()
+				if k < 0 {
+					return nil, fmt.Errorf("k must be >= 0, got %d", k)
+				}
+				nprobe := defaultIVFNProbe
+				if params[4].Type() != sqlite.TypeNull {
+					if nprobe = params[4].Int(); nprobe < 1 {
+						return nil, fmt.Errorf("nprobe must be >= 1, got %d", nprobe)
+					}
+				}
+				neighbors, err := index(params).search(q, k, nprobe)
+				if err != nil {
+					return nil, err
+				}
+				return neighborRows(neighbors), nil
+			},
+		},
+	}
+}
+
+// queryVector decodes a query argument given as a float32 blob, a quantized
+// blob or a JSON array.
+func queryVector(cfg *config, v sqlite.Value) ([]float32, error) {
+	if v.Type() == sqlite.TypeText {
+		floats, err := parseJSONVector(v.Text())
+		if err != nil {
+			return nil, err
+		}
+		if len(floats) != cfg.dim {
+			return nil, fmt.Errorf("expected dimension %d, got %d", cfg.dim, len(floats))
+		}
+		return floats, nil
+	}
+	return cfg.decodeVector(v.Blob())
+}
+
+// neighborRows converts search results to (id, distance) rows whose row ID
+// is the matching row's ID.
+func neighborRows(neighbors []neighbor) []tableFuncRow {
+	rows := make([]tableFuncRow, len(neighbors))
+	for i, n := range neighbors {
+		rows[i] = tableFuncRow{rowID: n.id, values: []sqlite.Value{sqlite.IntegerValue(n.id), sqlite.FloatValue(n.distance)}}
+	}
+	return rows
+}
@@ -0,0 +1,284 @@
+package vector
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestKMeans(t *testing.T) {
+	centers := [][]float32{{0, 0}, {10, 10}, {-10, 10}}
+	rng := rand.New(rand.NewSource(1))
+	var data [][]float32
+	for i := 0; i < 300; i++ {
+		c := centers[i%len(centers)]
+		data = append(data, []float32{c[0] + rng.Float32() - 0.5, c[1] + rng.Float32() - 0.5})
+	}
+	got := kmeans(data, len(centers), 25, rng)
+	for _, c := range centers {
+		if d := l2Squared(c, got[nearestCentroid(got, c)]); d > 0.1 {
+			t.Errorf("no centroid near %v, got %v", c, got)
+		}
+	}
+}
+
+func setupIVFTable(t *testing.T, n, dim int, opts ...Option) (*sqlite.Conn, map[int64][]float32) {
+	t.Helper()
+	conn := openTestConn(t)
+	if err := Register(conn, dim, opts...); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlitex.ExecuteTransient(conn, "CREATE TABLE items (embedding BLOB)", nil); err != nil {
+		t.Fatal(err)
+	}
+	return conn, insertRandomVectors(t, conn, "items", rand.New(rand.NewSource(1)), n, dim)
+}
+
+func trainIVF(t *testing.T, conn *sqlite.Conn, nlist int) []int {
+	t.Helper()
+	var sizes []int
+	err := sqlitex.Execute(conn, "SELECT size FROM vector_ivf_train('items', 'embedding', ?) ORDER BY list",
+		&sqlitex.ExecOptions{
+			Args: []any{nlist},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				sizes = append(sizes, stmt.ColumnInt(0))
+				return nil
+			},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sizes
+}
+
+func TestIVFSearch(t *testing.T) {
+	const (
+		n     = 1000
+		dim   = 16
+		nlist = 16
+		k     = 10
+	)
+	conn, vectors := setupIVFTable(t, n, dim)
+	sizes := trainIVF(t, conn, nlist)
+	if len(sizes) != nlist {
+		t.Fatalf("got %d lists, want %d", len(sizes), nlist)
+	}
+	total := 0
+	for _, s := range sizes {
+		total += s
+	}
+	if total != n {
+		t.Errorf("lists hold %d rows, want %d", total, n)
+	}
+
+	rng := rand.New(rand.NewSource(2))
+	var partial float64
+	for i := 0; i < 20; i++ {
+		q := make([]float32, dim)
+		for j := range q {
+			q[j] = rng.Float32()*2 - 1
+		}
+		want := bruteForceKNN(vectors, q, k)
+		all := queryKNN(t, conn, "SELECT rowid FROM vector_ivf_search('items', 'embedding', ?, ?, ?)", Float32ToBlob(q), k, nlist)
+		if r := recall(all, want); r != 1 {
+			t.Errorf("query %d: recall with every list probed = %.2f, want 1", i, r)
+		}
+		partial += recall(queryKNN(t, conn, "SELECT id FROM vector_ivf_search('items', 'embedding', ?, ?, 4)", Float32ToBlob(q), k), want)
+	}
+	if r := partial / 20; r < 0.4 {
+		t.Errorf("recall@%d with nprobe=4 = %.3f, want >= 0.4", k, r)
+	} else {
+		t.Logf("recall@%d with nprobe=4 = %.3f", k, r)
+	}
+}
+
+func TestIVFDistances(t *testing.T) {
+	conn, vectors := setupIVFTable(t, 50, 4)
+	trainIVF(t, conn, 4)
+	q := vectors[7]
+	var ids []int64
+	var distances []float64
+	err := sqlitex.Execute(conn, "SELECT id, distance FROM vector_ivf_search('items', 'embedding', ?, 3, 4)",
+		&sqlitex.ExecOptions{
+			Args: []any{Float32ToBlob(q)},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				ids = append(ids, stmt.ColumnInt64(0))
+				distances = append(distances, stmt.ColumnFloat(1))
+				return nil
+			},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 3 || ids[0] != 7 || distances[0] != 0 {
+		t.Fatalf("got ids %v distances %v, want row 7 first at distance 0", ids, distances)
+	}
+	for i, id := range ids {
+		if want := l2Squared(q, vectors[id]); math.Abs(distances[i]-want) > 1e-9 {
+			t.Errorf("distance to %d = %v, want %v", id, distances[i], want)
+		}
+	}
+}
+
+func TestIVFQuantized(t *testing.T) {
+	const dim = 8
+	conn := openTestConn(t)
+	if err := Register(conn, dim, WithQuantRange(-1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlitex.ExecuteTransient(conn, "CREATE TABLE items (embedding BLOB)", nil); err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	vectors := make(map[int64][]float32)
+	for i := int64(1); i <= 200; i++ {
+		v := make([]float32, dim)
+		for j := range v {
+			v[j] = rng.Float32()*2 - 1
+		}
+		b := quantize(v, -1, 1)
+		vectors[i], _ = dequantize(b, -1, 1)
+		err := sqlitex.Execute(conn, "INSERT INTO items (rowid, embedding) VALUES (?, ?)", &sqlitex.ExecOptions{Args: []any{i, b}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	trainIVF(t, conn, 8)
+
+	q := vectors[42]
+	want := bruteForceKNN(vectors, q, 5)
+	for _, query := range [][]byte{Float32ToBlob(q), quantize(q, -1, 1)} {
+		got := queryKNN(t, conn, "SELECT rowid FROM vector_ivf_search('items', 'embedding', ?, 5, 8)", query)
+		if r := recall(got, want); r != 1 {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestIVFAssignAndRetrain(t *testing.T) {
+	conn, _ := setupIVFTable(t, 100, 4)
+	trainIVF(t, conn, 4)
+
+	far := Float32ToBlob([]float32{5, 5, 5, 5})
+	if err := sqlitex.Execute(conn, "INSERT INTO items (rowid, embedding) VALUES (1000, ?)", &sqlitex.ExecOptions{Args: []any{far}}); err != nil {
+		t.Fatal(err)
+	}
+	search := "SELECT rowid FROM vector_ivf_search('items', 'embedding', ?, 1, 4)"
+	if got := queryKNN(t, conn, search, far); len(got) != 1 || got[0] == 1000 {
+		t.Errorf("unassigned row found before vector_ivf_assign: %v", got)
+	}
+
+	assigned := queryKNN(t, conn, "SELECT assigned FROM vector_ivf_assign('items', 'embedding')")
+	if len(assigned) != 1 || assigned[0] != 1 {
+		t.Errorf("assigned = %v, want [1]", assigned)
+	}
+	if got := queryKNN(t, conn, search, far); len(got) != 1 || got[0] != 1000 {
+		t.Errorf("got %v after assign, want [1000]", got)
+	}
+
+	if err := sqlitex.ExecuteTransient(conn, "DELETE FROM items WHERE rowid = 1000", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := queryKNN(t, conn, search, far); len(got) != 1 || got[0] == 1000 {
+		t.Errorf("deleted row returned: %v", got)
+	}
+	if assigned := queryKNN(t, conn, "SELECT assigned FROM vector_ivf_assign('items', 'embedding')"); assigned[0] != 0 {
+		t.Errorf("assigned = %v, want [0]", assigned)
+	}
+
+	sizes := trainIVF(t, conn, 2)
+	if len(sizes) != 2 || sizes[0]+sizes[1] != 100 {
+		t.Errorf("retrain sizes = %v, want 2 lists holding 100 rows", sizes)
+	}
+	var lists int
+	err := sqlitex.ExecuteTransient(conn, "SELECT count(*) FROM items_embedding_ivf_centroids", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			lists = stmt.ColumnInt(0)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lists != 2 {
+		t.Errorf("%d centroids stored after retrain, want 2", lists)
+	}
+}
+
+func TestIVFNested(t *testing.T) {
+	conn, vectors := setupIVFTable(t, 50, 4)
+
+	// Train while a cached statement with the text of the training scan is
+	// being stepped; training must neither reset nor finalize it.
+	rows := 0
+	err := sqlitex.Execute(conn, `SELECT rowid, "embedding" FROM "items" WHERE "embedding" IS NOT NULL`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			if rows++; rows == 1 {
+				trainIVF(t, conn, 4)
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows != len(vectors) {
+		t.Errorf("outer scan returned %d rows, want %d", rows, len(vectors))
+	}
+
+	// A search per row of an outer scan finds each row itself.
+	var mismatches int
+	err = sqlitex.ExecuteTransient(conn,
+		"SELECT i.rowid = (SELECT s.id FROM vector_ivf_search('items', 'embedding', i.embedding, 1, 4) AS s) FROM items AS i",
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				if !stmt.ColumnBool(0) {
+					mismatches++
+				}
+				return nil
+			},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mismatches != 0 {
+		t.Errorf("%d rows were not their own nearest neighbor", mismatches)
+	}
+}
+
+func TestIVFErrors(t *testing.T) {
+	conn, _ := setupIVFTable(t, 10, 4)
+	q := Float32ToBlob([]float32{0, 0, 0, 0})
+	tests := []struct {
+		name  string
+		query string
+		args  []any
+		want  string
+	}{
+		{"search before train", "SELECT * FROM vector_ivf_search('items', 'embedding', ?, 1)", []any{q}, "call vector_ivf_train first"},
+		{"assign before train", "SELECT * FROM vector_ivf_assign('items', 'embedding')", nil, "call vector_ivf_train first"},
+		{"too many lists", "SELECT * FROM vector_ivf_train('items', 'embedding', 11)", nil, "nlist 11 exceeds the 10 vectors"},
+		{"missing nlist", "SELECT * FROM vector_ivf_train('items', 'embedding')", nil, "missing argument nlist"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := sqlitex.Execute(conn, tt.query, &sqlitex.ExecOptions{Args: tt.args})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want containing %q", err, tt.want)
+			}
+		})
+	}
+
+	err := sqlitex.Execute(conn, "INSERT INTO items (embedding) VALUES (?)", &sqlitex.ExecOptions{Args: []any{quantize(make([]float32, 4), -1, 1)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sqlitex.Execute(conn, "SELECT * FROM vector_ivf_train('items', 'embedding', 2)", nil)
+	if err == nil || !strings.Contains(err.Error(), "WithQuantRange") {
+		t.Errorf("err = %v, want quantization not configured", err)
+	}
+}
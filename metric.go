@@ -0,0 +1,188 @@
+package vector
+
+import (
+	"fmt"
+	"math"
+
+	"zombiezen.com/go/sqlite"
+)
+
+// Metric selects a distance function. Every metric returns a value where
+// smaller means closer, so results can be ordered ascending.
+type Metric int
+
+const (
+	// MetricL2 is squared Euclidean distance: sum((a[i] - b[i])^2).
+	MetricL2 Metric = iota
+	// MetricCosine is cosine distance: 1 - dot(a, b) / (|a| * |b|).
+	MetricCosine
+	// MetricDot is negative inner product: -dot(a, b).
+	MetricDot
+)
+
+// String returns the metric name as accepted in SQL arguments.
+func (m Metric) String() string {
+	switch m {
+	case MetricL2:
+		return "l2"
+	case MetricCosine:
+		return "cosine"
+	case MetricDot:
+		return "dot"
+	default:
+		return fmt.Sprintf("Metric(%d)", int(m))
+	}
+}
+
+// valid reports whether m is one of the Metric constants.
+func (m Metric) valid() bool {
+	return m >= MetricL2 && m <= MetricDot
+}
+
+// WithMetric sets the metric computed by vector_distance and
+// vector_distance_q. The default is MetricL2. RegisterNamed returns an
+// error for a value that is not one of the Metric constants.
+func WithMetric(m Metric) Option {
+	return func(c *config) {
+		c.metric = m
+	}
+}
+
+func (m Metric) distance(a, b []float32) float64 {
+	switch m {
+	case MetricCosine:
+		return cosineDistance(a, b)
+	case MetricDot:
+		return -dot(a, b)
+	default:
+		return l2Squared(a, b)
+	}
+}
+
+func dot(a, b []float32) float64 {
+	var sum float64
+	for i := range a {
+		sum += float64(a[i]) * float64(b[i])
+	}
+	return sum
+}
+
+// cosineDistance returns 1 - cos(a, b). If either vector has zero norm the
+// similarity is undefined and treated as 0, giving a distance of 1.
+func cosineDistance(a, b []float32) float64 {
+	var ab, aa, bb float64
+	for i := range a {
+		x, y := float64(a[i]), float64(b[i])
+		ab += x * y
+		aa += x * x
+		bb += y * y
+	}
+	if aa == 0 || bb == 0 {
+		return 1
+	}
+	return 1 - ab/math.Sqrt(aa*bb)
+}
+
+// floatDistanceFunc returns a SQL function named name that applies dist to
+// two float32, float16, bfloat16 or typed blobs of the configured dimension.
+// The formats may be mixed, but typed blobs from different models may not.
+func floatDistanceFunc(name string, cfg *config, dist func(a, b []float32) float64) *sqlite.FunctionImpl {
+	return &sqlite.FunctionImpl{
+		NArgs:         2,
+		Deterministic: true,
+		Scalar: func(ctx sqlite.Context, args []sqlite.Value) (sqlite.Value, error) {
+			if args[0].Type() == sqlite.TypeNull || args[1].Type() == sqlite.TypeNull {
+				return sqlite.Value{}, nil
+			}
+			blobA := args[0].Blob()
+			blobB := args[1].Blob()
+			for _, b := range [][]byte{blobA, blobB} {
+				if isQuantizedBlob(b) && len(b) != cfg.dim*4 {
+					return sqlite.Value{}, fmt.Errorf("%s: input is quantized, use %s_q", name, name)
+				}
+			}
+			vs, err := cfg.decodeFloatArgs(name, blobA, blobB)
+			if err != nil {
+				return sqlite.Value{}, err
+			}
+			return sqlite.FloatValue(dist(vs[0], vs[1])), nil
+		},
+	}
+}
+
+// quantDistanceFunc returns a SQL function named name that computes m
+// between two quantized int8 blobs. Version-2 blobs carry their own range,
+// so blobs quantized with different ranges compare correctly.
+func quantDistanceFunc(name string, cfg *config, m Metric) *sqlite.FunctionImpl {
+	return &sqlite.FunctionImpl{
+		NArgs:         2,
+		Deterministic: true,
+		Scalar: func(ctx sqlite.Context, args []sqlite.Value) (sqlite.Value, error) {
+			if args[0].Type() == sqlite.TypeNull || args[1].Type() == sqlite.TypeNull {
+				return sqlite.Value{}, nil
+			}
+			if !cfg.quantEnabled {
+				return sqlite.Value{}, fmt.Errorf("%s: quantization not configured, call Register with WithQuantRange", name)
+			}
+			blobA := args[0].Blob()
+			blobB := args[1].Blob()
+			for i, b := range [][]byte{blobA, blobB} {
+				if isQuantizedBlob(b) {
+					continue
+				}
+				if f := blobFormatName(b); f != "" {
+					return sqlite.Value{}, fmt.Errorf("%s: input %c is %s, expected int8-quantized", name, "ab"[i], f)
+				}
+				return sqlite.Value{}, fmt.Errorf("%s: input %c is not quantized (missing magic bytes)", name, "ab"[i])
+			}
+			a, ma, err := cfg.parseQuant(blobA)
+			if err != nil {
+				return sqlite.Value{}, fmt.Errorf("%s: input a: %v", name, err)
+			}
+			b, mb, err := cfg.parseQuant(blobB)
+			if err != nil {
+				return sqlite.Value{}, fmt.Errorf("%s: input b: %v", name, err)
+			}
+			return sqlite.FloatValue(quantDistance(m, a, ma, b, mb)), nil
+		},
+	}
+}
+
+// asymDistanceFunc returns a SQL function named name that computes m between
+// a quantized int8 blob and a float32 blob of the configured dimension.
+func asymDistanceFunc(name string, cfg *config, m Metric) *sqlite.FunctionImpl {
+	return &sqlite.FunctionImpl{
+		NArgs:         2,
+		Deterministic: true,
+		Scalar: func(ctx sqlite.Context, args []sqlite.Value) (sqlite.Value, error) {
+			if args[0].Type() == sqlite.TypeNull || args[1].Type() == sqlite.TypeNull {
+				return sqlite.Value{}, nil
+			}
+			if !cfg.quantEnabled {
+				return sqlite.Value{}, fmt.Errorf("%s: quantization not configured, call Register with WithQuantRange", name)
+			}
+			blobA := args[0].Blob()
+			blobB := args[1].Blob()
+			if !isQuantizedBlob(blobA) {
+				if len(blobA) == cfg.dim*4 {
+					return sqlite.Value{}, fmt.Errorf("%s: input a is float32, expected int8-quantized (arguments are quantized, then float32)", name)
+				}
+				if f := blobFormatName(blobA); f != "" {
+					return sqlite.Value{}, fmt.Errorf("%s: input a is %s, expected int8-quantized", name, f)
+				}
+				return sqlite.Value{}, fmt.Errorf("%s: input a is not quantized (missing magic bytes)", name)
+			}
+			if expected := cfg.dim * 4; len(blobB) != expected {
+				if f := blobFormatName(blobB); f != "" {
+					return sqlite.Value{}, fmt.Errorf("%s: input b is %s, expected float32", name, f)
+				}
+				return sqlite.Value{}, fmt.Errorf("%s: input b: expected %d bytes (dim=%d), got %d", name, expected, cfg.dim, len(blobB))
+			}
+			a, ma, err := cfg.parseQuant(blobA)
+			if err != nil {
+				return sqlite.Value{}, fmt.Errorf("%s: input a: %v", name, err)
+			}
+			return sqlite.FloatValue(quantFloatDistance(m, a, ma, blobB)), nil
+		},
+	}
+}
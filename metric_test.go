@@ -0,0 +1,208 @@
+package vector
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestCosineDistance(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []float32
+		want float64
+	}{
+		{
+			name: "same direction",
+			a:    []float32{1, 2, 3},
+			b:    []float32{2, 4, 6},
+			want: 0,
+		},
+		{
+			name: "orthogonal",
+			a:    []float32{1, 0, 0},
+			b:    []float32{0, 1, 0},
+			want: 1,
+		},
+		{
+			name: "opposite",
+			a:    []float32{1, 0, 0},
+			b:    []float32{-3, 0, 0},
+			want: 2,
+		},
+		{
+			name: "zero vector",
+			a:    []float32{0, 0, 0},
+			b:    []float32{1, 2, 3},
+			want: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := cosineDistance(tt.a, tt.b)
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("cosineDistance(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDot(t *testing.T) {
+	got := dot([]float32{1, 2, 3}, []float32{4, 5, 6})
+	if got != 32 {
+		t.Errorf("dot = %v, want 32", got)
+	}
+	if d := MetricDot.distance([]float32{1, 2, 3}, []float32{4, 5, 6}); d != -32 {
+		t.Errorf("MetricDot.distance = %v, want -32", d)
+	}
+}
+
+func TestMetricString(t *testing.T) {
+	tests := []struct {
+		m    Metric
+		want string
+	}{
+		{MetricL2, "l2"},
+		{MetricCosine, "cosine"},
+		{MetricDot, "dot"},
+		{Metric(42), "Metric(42)"},
+	}
+	for _, tt := range tests {
+		if got := tt.m.String(); got != tt.want {
+			t.Errorf("Metric(%d).String() = %q, want %q", int(tt.m), got, tt.want)
+		}
+	}
+}
+
+func TestVectorDistanceMetrics(t *testing.T) {
+	conn := openTestConn(t)
+	if err := Register(conn, 3, WithQuantRange(-1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		query string
+		want  float64
+		tol   float64
+	}{
+		{
+			name:  "cosine orthogonal",
+			query: "SELECT vector_distance_cosine(vector_encode('[1,0,0]'), vector_encode('[0,1,0]'))",
+			want:  1,
+		},
+		{
+			name:  "cosine scaled",
+			query: "SELECT vector_distance_cosine(vector_encode('[1,2,3]'), vector_encode('[2,4,6]'))",
+			want:  0,
+			tol:   1e-9,
+		},
+		{
+			name:  "dot",
+			query: "SELECT vector_distance_dot(vector_encode('[1,2,3]'), vector_encode('[4,5,6]'))",
+			want:  -32,
+		},
+		{
+			name:  "cosine quantized",
+			query: "SELECT vector_distance_cosine_q(vector_quantize(vector_encode('[1,0,0]')), vector_quantize(vector_encode('[1,0,0]')))",
+			want:  0,
+			tol:   1e-6,
+		},
+		{
+			name:  "dot quantized",
+			query: "SELECT vector_distance_dot_q(vector_quantize(vector_encode('[1,0,0]')), vector_quantize(vector_encode('[1,0,0]')))",
+			want:  -1,
+			tol:   1e-2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got float64
+			err := sqlitex.ExecuteTransient(conn, tt.query, &sqlitex.ExecOptions{
+				ResultFunc: func(stmt *sqlite.Stmt) error {
+					got = stmt.ColumnFloat(0)
+					return nil
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(got-tt.want) > tt.tol {
+				t.Errorf("%s = %v, want %v", tt.query, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("NULL inputs return NULL", func(t *testing.T) {
+		for _, fn := range []string{"vector_distance_cosine", "vector_distance_dot", "vector_distance_cosine_q", "vector_distance_dot_q"} {
+			var isNull bool
+			err := sqlitex.ExecuteTransient(conn, "SELECT "+fn+"(NULL, NULL)", &sqlitex.ExecOptions{
+				ResultFunc: func(stmt *sqlite.Stmt) error {
+					isNull = stmt.ColumnType(0) == sqlite.TypeNull
+					return nil
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !isNull {
+				t.Errorf("%s(NULL, NULL) is not NULL", fn)
+			}
+		}
+	})
+
+	t.Run("quantized blob input error", func(t *testing.T) {
+		t.Skip("blocked on zombiezen/go/sqlite fix: resultError shadows err variable")
+		err := sqlitex.ExecuteTransient(conn,
+			"SELECT vector_distance_cosine(vector_encode('[1,2,3]'), vector_quantize(vector_encode('[1,2,3]')))", nil)
+		if err == nil {
+			t.Fatal("expected error for quantized blob input")
+		}
+	})
+}
+
+func TestWithMetric(t *testing.T) {
+	conn := openTestConn(t)
+	if err := Register(conn, 3, WithMetric(MetricCosine)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlitex.ExecuteScript(conn, `
+		CREATE TABLE documents (
+			id INTEGER PRIMARY KEY,
+			content TEXT,
+			embedding BLOB
+		);
+		INSERT INTO documents (content, embedding) VALUES ('long', vector_encode('[10.0, 1.0, 0.0]'));
+		INSERT INTO documents (content, embedding) VALUES ('near', vector_encode('[0.5, 0.5, 0.0]'));
+	`, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Under L2 'near' wins; under cosine the direction of 'long' is closer.
+	var nearest string
+	err := sqlitex.ExecuteTransient(conn,
+		"SELECT content FROM documents ORDER BY vector_distance(embedding, vector_encode('[1.0, 0.0, 0.0]')) LIMIT 1",
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				nearest = stmt.ColumnText(0)
+				return nil
+			},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nearest != "long" {
+		t.Errorf("nearest = %q, want 'long'", nearest)
+	}
+}
+
+func TestWithMetricUnknown(t *testing.T) {
+	conn := openTestConn(t)
+	for _, m := range []Metric{-1, MetricDot + 1} {
+		if err := Register(conn, 3, WithMetric(m)); err == nil || !strings.Contains(err.Error(), "unknown metric") {
+			t.Errorf("Register(WithMetric(%v)) = %v, want unknown metric error", m, err)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package vector
+
+import (
+	"fmt"
+	"math"
+
+	"zombiezen.com/go/sqlite"
+)
+
+const defaultMMRLambda = 0.5
+
+// mmrFunc returns the vector_mmr table-valued function, which re-ranks a
+// candidate set by maximal marginal relevance. candidates is an SQL query
+// whose rows are (row ID, vector); the function greedily picks the k
+// candidates that balance similarity to the query against similarity to the
+// candidates already picked.
+func mmrFunc(conn *sqlite.Conn, cfg *config) *tableFunc {
+	return &tableFunc{
+		name:     cfg.funcName("_mmr"),
+		columns:  []string{"id INTEGER", "distance REAL", "rank INTEGER"},
+		params:   []string{"candidates", "query", "k", "lambda"},
+		required: 3,
+		run: func(params []sqlite.Value) ([]tableFuncRow, error) {
+			if params[1].Type() == sqlite.TypeNull {
+				return nil, nil
+			}
+			q, model, err := scanQuery(cfg, params[1])
+			if err != nil {
+				return nil, fmt.Errorf("query: %v", err)
+			}
+			k := params[2].Int()
+			if k < 0 {
+				return nil, fmt.Errorf("k must be >= 0, got %d", k)
+			}
+			lambda := defaultMMRLambda
+			if params[3].Type() != sqlite.TypeNull {
+				if lambda = params[3].Float(); lambda < 0 || lambda > 1 {
+					return nil, fmt.Errorf("lambda must be between 0 and 1, got %v", lambda)
+				}
+			}
+			ids, vecs, err := loadCandidates(conn, cfg, params[0].Text(), model)
+			if err != nil {
+				return nil, err
+			}
+			picked := mmr(cfg.metric, q, vecs, lambda, k)
+			rows := make([]tableFuncRow, len(picked))
+			for i, p := range picked {
+				rows[i] = tableFuncRow{rowID: ids[p], values: []sqlite.Value{
+					sqlite.IntegerValue(ids[p]),
+					sqlite.FloatValue(cfg.metric.distance(q, vecs[p])),
+					sqlite.IntegerValue(int64(i + 1)),
+				}}
+			}
+			return rows, nil
+		},
+	}
+}
+
+// loadCandidates runs query, which must return (row ID, vector) rows, and
+// decodes every vector. Rows with a NULL vector are skipped.
+func loadCandidates(conn *sqlite.Conn, cfg *config, query, model string) ([]int64, [][]float32, error) {
+	stmt, err := prepareRowQuery(conn, query, "id", "vector")
+	if err != nil {
+		return nil, nil, fmt.Errorf("candidates: %v", err)
+	}
+	defer stmt.Finalize()
+	var ids []int64
+	var vecs [][]float32
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, nil, fmt.Errorf("candidates: %v", err)
+		}
+		if !hasRow {
+			return ids, vecs, nil
+		}
+		if stmt.ColumnType(1) == sqlite.TypeNull {
+			continue
+		}
+		id := stmt.ColumnInt64(0)
+		b := make([]byte, stmt.ColumnLen(1))
+		stmt.ColumnBytes(1, b)
+		vec, rowModel, err := cfg.decodeTagged(b)
+		if err != nil {
+			return nil, nil, fmt.Errorf("candidate %d: %v", id, err)
+		}
+		if err := checkModels(model, rowModel); err != nil {
+			return nil, nil, fmt.Errorf("candidate %d: %v", id, err)
+		}
+		ids = append(ids, id)
+		vecs = append(vecs, vec)
+	}
+}
+
+// mmr returns the indexes of up to k candidates in the order maximal
+// marginal relevance picks them. Similarity is the negated distance under m,
+// and each step picks the candidate maximizing
+//
+//	lambda*sim(q, c) - (1-lambda)*max(sim(c, s) for each picked s)
+//
+// so lambda 1 ranks by relevance alone and lambda 0 by diversity alone.
+// Ties go to the earlier candidate.
+func mmr(m Metric, q []float32, candidates [][]float32, lambda float64, k int) []int {
+	n := len(candidates)
+	k = min(k, n)
+	relevance := make([]float64, n)
+	redundancy := make([]float64, n)
+	picked := make([]bool, n)
+	for i, c := range candidates {
+		relevance[i] = -m.distance(q, c)
+	}
+	order := make([]int, 0, k)
+	for len(order) < k {
+		best, bestScore := -1, math.Inf(-1)
+		for i := range candidates {
+			if picked[i] {
+				continue
+			}
+			score := lambda * relevance[i]
+			if len(order) > 0 {
+				score -= (1 - lambda) * redundancy[i]
+			}
+			if best < 0 || score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		picked[best] = true
+		order = append(order, best)
+		for i, c := range candidates {
+			if picked[i] {
+				continue
+			}
+			sim := -m.distance(candidates[best], c)
+			if len(order) == 1 || sim > redundancy[i] {
+				redundancy[i] = sim
+			}
+		}
+	}
+	return order
+}
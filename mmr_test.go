@@ -0,0 +1,84 @@
+package vector
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestMMR(t *testing.T) {
+	q := []float32{1, 0.1}
+	candidates := [][]float32{
+		{0.6, 0.6}, // relevant, different
+		{1, 0},     // most relevant
+		{0.95, 0},  // near-duplicate of the most relevant
+		{-1, -1},   // irrelevant
+	}
+	tests := []struct {
+		lambda float64
+		k      int
+		want   []int
+	}{
+		{1, 4, []int{1, 2, 0, 3}},
+		{0.5, 2, []int{1, 0}},
+		{0.5, 10, []int{1, 0, 2, 3}},
+		{0.5, 0, []int{}},
+	}
+	for _, tt := range tests {
+		if got := mmr(MetricL2, q, candidates, tt.lambda, tt.k); !slices.Equal(got, tt.want) {
+			t.Errorf("mmr(lambda=%v, k=%d) = %v, want %v", tt.lambda, tt.k, got, tt.want)
+		}
+	}
+}
+
+func TestVectorMMR(t *testing.T) {
+	conn := openTestConn(t)
+	if err := Register(conn, 2); err != nil {
+		t.Fatal(err)
+	}
+	err := sqlitex.ExecuteScript(conn, `
+		CREATE TABLE chunks (doc INTEGER, embedding BLOB);
+		INSERT INTO chunks (rowid, doc, embedding) VALUES
+			(1, 1, vector_encode('[0.6,0.6]')),
+			(2, 2, vector_encode('[1,0]')),
+			(3, 2, vector_encode('[0.95,0]')),
+			(4, 3, NULL);
+	`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := queryKNN(t, conn, "SELECT id FROM vector_mmr('SELECT rowid, embedding FROM chunks', '[1,0.1]', 2, 0.5) ORDER BY rank")
+	if want := []int64{2, 1}; !slices.Equal(got, want) {
+		t.Errorf("vector_mmr = %v, want %v", got, want)
+	}
+	got = queryKNN(t, conn, "SELECT id FROM vector_mmr('SELECT rowid, embedding FROM chunks', '[1,0.1]', 5, 1) ORDER BY rank")
+	if want := []int64{2, 3, 1}; !slices.Equal(got, want) {
+		t.Errorf("vector_mmr with lambda 1 = %v, want %v", got, want)
+	}
+
+	// Candidates from a nested vector_top_k.
+	got = queryKNN(t, conn, `SELECT id FROM vector_mmr(
+		'SELECT s.id, c.embedding FROM vector_top_k(''chunks'', ''embedding'', ' || quote(vector_encode('[1,0.1]')) || ', 3) AS s JOIN chunks AS c ON c.rowid = s.id',
+		'[1,0.1]', 2) ORDER BY rank`)
+	if want := []int64{2, 1}; !slices.Equal(got, want) {
+		t.Errorf("vector_mmr over vector_top_k = %v, want %v", got, want)
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT * FROM vector_mmr('SELECT rowid FROM chunks', '[1,0]', 2)", "want 2 (id, vector)"},
+		{"SELECT * FROM vector_mmr('SELECT rowid, embedding FROM chunks; SELECT 1', '[1,0]', 2)", "single statement"},
+		{"SELECT * FROM vector_mmr('SELECT rowid, embedding FROM chunks', '[1,0]', 2, 1.5)", "lambda must be between 0 and 1"},
+		{"SELECT * FROM vector_mmr('SELECT rowid, doc FROM chunks', '[1,0]', 2)", "candidate 1"},
+	}
+	for _, tt := range tests {
+		err := sqlitex.ExecuteTransient(conn, tt.query, nil)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: err = %v, want containing %q", tt.query, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package vector
+
+import (
+	"fmt"
+	"math/rand"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// Product quantization splits a vector into m equal subvectors and replaces
+// each with the index of its nearest centroid in a per-subspace codebook of
+// up to 256 entries, so a vector is stored in m bytes. Codebooks are trained
+// with vector_pq_train and stored by name in the vector_pq_codebooks table.
+//
+// Distances are computed asymmetrically: the float32 query is compared with
+// every centroid once to build an m x ksub lookup table of squared L2
+// distances, and the distance to a code is the sum of m table entries.
+
+const (
+	pqVersion = 0x01
+
+	pqMaxCentroids       = 256
+	pqMaxTrainingSamples = 40 * pqMaxCentroids
+	defaultPQIterations  = 15
+
+	pqCodebooksTable = "vector_pq_codebooks"
+)
+
+type pqCodebook struct {
+	dim  int
+	m    int
+	ksub int
+	// centroids holds m*ksub centroids of dim/m values, subspace-major.
+	centroids []float32
+}
+
+func (cb *pqCodebook) subDim() int { return cb.dim / cb.m }
+
+func (cb *pqCodebook) centroid(sub, c int) []float32 {
+	d := cb.subDim()
+	off := (sub*cb.ksub + c) * d
+	return cb.centroids[off : off+d]
+}
+
+// trainPQ learns m codebooks from data with k-means in each subspace.
+func trainPQ(data [][]float32, m, iterations int, rng *rand.Rand) *pqCodebook {
+	dim := len(data[0])
+	cb := &pqCodebook{dim: dim, m: m, ksub: min(len(data), pqMaxCentroids)}
+	d := cb.subDim()
+	cb.centroids = make([]float32, 0, m*cb.ksub*d)
+	sub := make([][]float32, len(data))
+	for s := 0; s < m; s++ {
+		for i, v := range data {
+			sub[i] = v[s*d : (s+1)*d]
+		}
+		for _, c := range kmeans(sub, cb.ksub, iterations, rng) {
+			cb.centroids = append(cb.centroids, c...)
+		}
+	}
+	return cb
+}
+
+// encode returns the PQ blob for v: the two-byte header followed by the
+// nearest centroid index in each subspace.
+func (cb *pqCodebook) encode(v []float32) []byte {
+	d := cb.subDim()
+	b := make([]byte, 2+cb.m)
+	b[0] = formatPQ
+	b[1] = pqVersion
+	for s := 0; s < cb.m; s++ {
+		sv := v[s*d : (s+1)*d]
+		best, bestDist := 0, l2Squared(sv, cb.centroid(s, 0))
+		for c := 1; c < cb.ksub; c++ {
+			if dist := l2Squared(sv, cb.centroid(s, c)); dist < bestDist {
+				best, bestDist = c, dist
+			}
+		}
+		b[2+s] = byte(best)
+	}
+	return b
+}
+
+// decode reconstructs the vector approximated by a PQ blob.
+func (cb *pqCodebook) decode(b []byte) []float32 {
+	v := make([]float32, 0, cb.dim)
+	for s, c := range b[2:] {
+		v = append(v, cb.centroid(s, int(c))...)
+	}
+	return v
+}
+
+// lookupTable returns the squared L2 distance from each subvector of q to
+// each centroid of its subspace, indexed by sub*ksub + c.
+func (cb *pqCodebook) lookupTable(q []float32) []float64 {
+	d := cb.subDim()
+	lut := make([]float64, cb.m*cb.ksub)
+	for s := 0; s < cb.m; s++ {
+		sq := q[s*d : (s+1)*d]
+		for c := 0; c < cb.ksub; c++ {
+			lut[s*cb.ksub+c] = l2Squared(sq, cb.centroid(s, c))
+		}
+	}
+	return lut
+}
+
+// asymmetricDistance returns the squared L2 distance between the query
+// lut was built from and the vector encoded by b.
+func (cb *pqCodebook) asymmetricDistance(lut []float64, b []byte) float64 {
+	var sum float64
+	for s, c := range b[2:] {
+		sum += lut[s*cb.ksub+int(c)]
+	}
+	return sum
+}
+
+// checkCode validates that b is a PQ blob produced by this codebook.
+func (cb *pqCodebook) checkCode(b []byte) error {
+	if !isPQBlob(b) {
+		return fmt.Errorf("input is not PQ-encoded (missing magic bytes)")
+	}
+	if len(b) != 2+cb.m {
+		return fmt.Errorf("expected %d bytes (m=%d), got %d", 2+cb.m, cb.m, len(b))
+	}
+	for _, c := range b[2:] {
+		if int(c) >= cb.ksub {
+			return fmt.Errorf("code %d out of range for %d centroids", c, cb.ksub)
+		}
+	}
+	return nil
+}
+
+func isPQBlob(b []byte) bool {
+	return len(b) >= 2 && b[0] == formatPQ && b[1] == pqVersion
+}
+
+func createPQCodebooksTable(conn *sqlite.Conn) error {
+	return sqlitex.ExecuteTransient(conn, "CREATE TABLE IF NOT EXISTS "+pqCodebooksTable+
+		" (name TEXT PRIMARY KEY, dim INTEGER NOT NULL, m INTEGER NOT NULL, ksub INTEGER NOT NULL, centroids BLOB NOT NULL)", nil)
+}
+
+func savePQCodebook(conn *sqlite.Conn, name string, cb *pqCodebook) error {
+	if err := createPQCodebooksTable(conn); err != nil {
+		return err
+	}
+	return sqlitex.Execute(conn, "INSERT OR REPLACE INTO "+pqCodebooksTable+" (name, dim, m, ksub, centroids) VALUES (?, ?, ?, ?, ?)",
+		&sqlitex.ExecOptions{Args: []any{name, cb.dim, cb.m, cb.ksub, Float32ToBlob(cb.centroids)}})
+}
+
+func loadPQCodebook(conn *sqlite.Conn, name string) (*pqCodebook, error) {
+	found := false
+	err := sqlitex.Execute(conn, "SELECT 1 FROM sqlite_schema WHERE type = 'table' AND name = ?", &sqlitex.ExecOptions{
+		Args: []any{pqCodebooksTable},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			found = true
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var cb *pqCodebook
+	if found {
+		err = sqlitex.Execute(conn, "SELECT dim, m, ksub, centroids FROM "+pqCodebooksTable+" WHERE name = ?", &sqlitex.ExecOptions{
+			Args: []any{name},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				b := make([]byte, stmt.ColumnLen(3))
+				stmt.ColumnBytes(3, b)
+				centroids, err := BlobToFloat32(b)
+				if err != nil {
+					return err
+				}
+				cb = &pqCodebook{dim: stmt.ColumnInt(0), m: stmt.ColumnInt(1), ksub: stmt.ColumnInt(2), centroids: centroids}
+				return nil
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cb == nil {
+		return nil, fmt.Errorf("no codebook named %q, call vector_pq_train first", name)
+	}
+	if len(cb.centroids) != cb.m*cb.ksub*cb.subDim() {
+		return nil, fmt.Errorf("codebook %q is corrupt", name)
+	}
+	return cb, nil
+}
+
+// pqCodebookArg loads the codebook named by args[i], caching it for the rest
+// of the statement when the argument is constant.
+func pqCodebookArg(ctx sqlite.Context, cfg *config, args []sqlite.Value, i int) (*pqCodebook, error) {
+	if cb, ok := ctx.AuxData(i).(*pqCodebook); ok {
+		return cb, nil
+	}
+	cb, err := loadPQCodebook(ctx.Conn(), args[i].Text())
+	if err != nil {
+		return nil, err
+	}
+	if cb.dim != cfg.dim {
+		return nil, fmt.Errorf("codebook %q has dimension %d, expected %d", args[i].Text(), cb.dim, cfg.dim)
+	}
+	ctx.SetAuxData(i, cb)
+	return cb, nil
+}
+
+// pqLookup is a query lookup table cached as auxiliary data.
+type pqLookup struct {
+	cb  *pqCodebook
+	lut []float64
+}
+
+// pqEncodeFunc returns the vector_pq_encode SQL function. PQ functions are
+// not deterministic because retraining a codebook changes their results.
+func pqEncodeFunc(cfg *config) *sqlite.FunctionImpl {
+	name := cfg.funcName("_pq_encode")
+	return &sqlite.FunctionImpl{
+		NArgs:         2,
+		Deterministic: false,
+		Scalar: func(ctx sqlite.Context, args []sqlite.Value) (sqlite.Value, error) {
+			if args[0].Type() == sqlite.TypeNull || args[1].Type() == sqlite.TypeNull {
+				return sqlite.Value{}, nil
+			}
+			cb, err := pqCodebookArg(ctx, cfg, args, 0)
+			if err != nil {
+				return sqlite.Value{}, fmt.Errorf("%s: %v", name, err)
+			}
+			v, err := queryVector(cfg, args[1])
+			if err != nil {
+				return sqlite.Value{}, fmt.Errorf("%s: %v", name, err)
+			}
+			return sqlite.BlobValue(cb.encode(v)), nil
+		},
+	}
+}
+
+// pqDistanceFunc returns the vector_distance_pq SQL function.
+func pqDistanceFunc(cfg *config) *sqlite.FunctionImpl {
+	name := cfg.funcName("_distance_pq")
+	return &sqlite.FunctionImpl{
+		NArgs:         3,
+		Deterministic: false,
+		Scalar: func(ctx sqlite.Context, args []sqlite.Value) (sqlite.Value, error) {
+			for _, a := range args {
+				if a.Type() == sqlite.TypeNull {
+					return sqlite.Value{}, nil
+				}
+			}
+			cb, err := pqCodebookArg(ctx, cfg, args, 0)
+			if err != nil {
+				return sqlite.Value{}, fmt.Errorf("%s: %v", name, err)
+			}
+			code := args[2].Blob()
+			if err := cb.checkCode(code); err != nil {
+				return sqlite.Value{}, fmt.Errorf("%s: %v", name, err)
+			}
+			lookup, ok := ctx.AuxData(1).(*pqLookup)
+			if !ok || lookup.cb != cb {
+				q, err := queryVector(cfg, args[1])
+				if err != nil {
+					return sqlite.Value{}, fmt.Errorf("%s: %v", name, err)
+				}
+				lookup = &pqLookup{cb: cb, lut: cb.lookupTable(q)}
+				ctx.SetAuxData(1, lookup)
+			}
+			return sqlite.FloatValue(cb.asymmetricDistance(lookup.lut, code)), nil
+		},
+	}
+}
+
+// pqTrainFunc returns the vector_pq_train table-valued function.
+func pqTrainFunc(conn *sqlite.Conn, cfg *config) *tableFunc {
+	return &tableFunc{
+		name:     cfg.funcName("_pq_train"),
+		columns:  []string{"sub_dim INTEGER", "ksub INTEGER", "samples INTEGER"},
+		params:   []string{"codebook", "table_name", "column_name", "m", "iterations"},
+		required: 4,
+		run: func(params []sqlite.Value) ([]tableFuncRow, error) {
+			m := params[3].Int()
+			if m < 1 || cfg.dim%m != 0 {
+				return nil, fmt.Errorf("m must divide the dimension %d, got %d", cfg.dim, m)
+			}
+			iterations := defaultPQIterations
+			if params[4].Type() != sqlite.TypeNull {
+				if iterations = params[4].Int(); iterations < 1 {
+					return nil, fmt.Errorf("iterations must be >= 1, got %d", iterations)
+				}
+			}
+			rng := rand.New(rand.NewSource(1))
+			table, column := params[1].Text(), params[2].Text()
+			sample, err := sampleVectors(conn, cfg, table, column, pqMaxTrainingSamples, rng)
+			if err != nil {
+				return nil, err
+			}
+			if len(sample) == 0 {
+				return nil, fmt.Errorf("no vectors in %s.%s", table, column)
+			}
+			cb := trainPQ(sample, m, iterations, rng)
+			if err := savePQCodebook(conn, params[0].Text(), cb); err != nil {
+				return nil, err
+			}
+			return []tableFuncRow{{values: []sqlite.Value{
+				sqlite.IntegerValue(int64(cb.subDim())),
+				sqlite.IntegerValue(int64(cb.ksub)),
+				sqlite.IntegerValue(int64(len(sample))),
+			}}}, nil
+		},
+	}
+}
@@ -0,0 +1,289 @@
+package vector
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+)
+
+// Int8-quantized blobs come in two versions. Version 1 is the two-byte
+// header followed by the levels; decoding it relies on the connection's
+// range. Version 2, which vector_quantize writes, records the dimension
+// and the parameters used, so a blob is never silently decoded with the
+// wrong range:
+//
+//	[0x00] [0x02] [kind] [dim uint16 LE] [params, 8 bytes] [int8] ... [int8]
+//
+// kind quantKindRange stores the min and max as float32 LE. kind
+// quantKindCalibration stores the calibration's ID as uint32 LE followed by
+// four zero bytes. The header is a fixed 13 bytes, which keeps every
+// version-2 length distinct from the float32 length of the same dimension.
+
+const (
+	quantVersion1 = 0x01
+	quantVersion2 = 0x02
+
+	quantHeaderV2 = 13
+	maxQuantDim   = math.MaxUint16
+
+	quantKindRange       = 0x00
+	quantKindCalibration = 0x01
+)
+
+// quantBlob is a parsed int8-quantized blob.
+type quantBlob struct {
+	version       byte
+	kind          byte
+	dim           int
+	min, max      float32
+	calibrationID uint32
+	levels        []byte
+}
+
+func parseQuantBlob(b []byte) (quantBlob, error) {
+	if !isQuantizedBlob(b) {
+		return quantBlob{}, fmt.Errorf("input is not quantized (missing magic bytes)")
+	}
+	if b[1] == quantVersion1 {
+		return quantBlob{version: quantVersion1, dim: len(b) - 2, levels: b[2:]}, nil
+	}
+	if len(b) < quantHeaderV2 {
+		return quantBlob{}, fmt.Errorf("quantized blob header truncated to %d bytes", len(b))
+	}
+	q := quantBlob{
+		version: quantVersion2,
+		kind:    b[2],
+		dim:     int(binary.LittleEndian.Uint16(b[3:])),
+		levels:  b[quantHeaderV2:],
+	}
+	if len(q.levels) != q.dim {
+		return quantBlob{}, fmt.Errorf("quantized blob header says dimension %d, got %d values", q.dim, len(q.levels))
+	}
+	switch q.kind {
+	case quantKindRange:
+		q.min = math.Float32frombits(binary.LittleEndian.Uint32(b[5:]))
+		q.max = math.Float32frombits(binary.LittleEndian.Uint32(b[9:]))
+	case quantKindCalibration:
+		q.calibrationID = binary.LittleEndian.Uint32(b[5:])
+	default:
+		return quantBlob{}, fmt.Errorf("unknown quantization kind %#x", q.kind)
+	}
+	return q, nil
+}
+
+// quantize quantizes v to a version-2 blob with the configured calibration
+// or global range. Register rejects dimensions above maxQuantDim.
+func (cfg *config) quantize(v []float32) []byte {
+	b := make([]byte, quantHeaderV2+len(v))
+	b[0] = formatInt8
+	b[1] = quantVersion2
+	binary.LittleEndian.PutUint16(b[3:], uint16(len(v)))
+	levels := b[quantHeaderV2:]
+	if cal := cfg.quantCal; cal != nil {
+		b[2] = quantKindCalibration
+		binary.LittleEndian.PutUint32(b[5:], cfg.quantCalID)
+		for i, f := range v {
+			levels[i] = quantizeValue(f, cal.Min[i], cal.Max[i])
+		}
+		return b
+	}
+	b[2] = quantKindRange
+	binary.LittleEndian.PutUint32(b[5:], math.Float32bits(cfg.quantMin))
+	binary.LittleEndian.PutUint32(b[9:], math.Float32bits(cfg.quantMax))
+	for i, f := range v {
+		levels[i] = quantizeValue(f, cfg.quantMin, cfg.quantMax)
+	}
+	return b
+}
+
+// dequantize decodes a quantized blob of the configured dimension. Version-2
+// blobs decode with the range in their header; calibrated ones require the
+// connection to use the same calibration. Version-1 blobs decode with the
+// connection's range or calibration.
+func (cfg *config) dequantize(b []byte) ([]float32, error) {
+	q, m, err := cfg.parseQuant(b)
+	if err != nil {
+		return nil, err
+	}
+	v := make([]float32, q.dim)
+	for i, raw := range q.levels {
+		v[i] = m.value(i, raw)
+	}
+	return v, nil
+}
+
+// quantMap maps the int8 levels of a blob back to floats, with either a
+// single range or a calibration's per-dimension ranges.
+type quantMap struct {
+	min, max float32
+	cal      *Calibration
+}
+
+func (m quantMap) value(i int, raw byte) float32 {
+	if m.cal != nil {
+		return dequantizeValue(raw, m.cal.Min[i], m.cal.Max[i])
+	}
+	return dequantizeValue(raw, m.min, m.max)
+}
+
+// parseQuant parses a quantized blob of the configured dimension and
+// resolves the map that dequantizes it, as described for dequantize.
+func (cfg *config) parseQuant(b []byte) (quantBlob, quantMap, error) {
+	q, err := parseQuantBlob(b)
+	if err != nil {
+		return quantBlob{}, quantMap{}, err
+	}
+	if q.version == quantVersion1 && q.dim != cfg.dim {
+		return quantBlob{}, quantMap{}, fmt.Errorf("expected %d bytes (dim=%d), got %d", 2+cfg.dim, cfg.dim, len(b))
+	}
+	if q.dim != cfg.dim {
+		return quantBlob{}, quantMap{}, fmt.Errorf("quantized blob has dimension %d, expected %d", q.dim, cfg.dim)
+	}
+	switch {
+	case q.version == quantVersion2 && q.kind == quantKindRange:
+		return q, quantMap{min: q.min, max: q.max}, nil
+	case q.version == quantVersion2 && (cfg.quantCal == nil || q.calibrationID != cfg.quantCalID):
+		return quantBlob{}, quantMap{}, fmt.Errorf("blob was quantized with calibration %08x, connection uses %s", q.calibrationID, cfg.quantDescription())
+	case cfg.quantCal != nil:
+		return q, quantMap{cal: cfg.quantCal}, nil
+	default:
+		return q, quantMap{min: cfg.quantMin, max: cfg.quantMax}, nil
+	}
+}
+
+// quantDistance computes m between two parsed quantized blobs without
+// allocating. When both blobs use the same single range, level q maps to
+// q*scale + offset on both sides, so the sums the metric needs are taken
+// over the int8 levels with integer accumulators and scaled once. Otherwise
+// each value is dequantized as it is used.
+func quantDistance(m Metric, a quantBlob, ma quantMap, b quantBlob, mb quantMap) float64 {
+	if ma.cal == nil && mb.cal == nil && ma.min == mb.min && ma.max == mb.max {
+		return quantDistanceInt(m, a.levels, b.levels, ma.min, ma.max)
+	}
+	var s metricSums
+	for i := range a.levels {
+		s.add(float64(ma.value(i, a.levels[i])), float64(mb.value(i, b.levels[i])))
+	}
+	return s.distance(m)
+}
+
+// quantFloatDistance computes m between a parsed quantized blob and a
+// float32 blob of the same dimension without allocating. Only the stored
+// side is quantized, so the query keeps its full precision.
+func quantFloatDistance(m Metric, a quantBlob, ma quantMap, b []byte) float64 {
+	var s metricSums
+	for i, raw := range a.levels {
+		y := math.Float32frombits(binary.LittleEndian.Uint32(b[i*4:]))
+		s.add(float64(ma.value(i, raw)), float64(y))
+	}
+	return s.distance(m)
+}
+
+// metricSums accumulates what any Metric needs from two vectors that are
+// decoded one value at a time.
+type metricSums struct {
+	l2, ab, aa, bb float64
+}
+
+func (s *metricSums) add(x, y float64) {
+	d := x - y
+	s.l2 += d * d
+	s.ab += x * y
+	s.aa += x * x
+	s.bb += y * y
+}
+
+// distance matches Metric.distance on the accumulated vectors.
+func (s *metricSums) distance(m Metric) float64 {
+	switch m {
+	case MetricCosine:
+		if s.aa == 0 || s.bb == 0 {
+			return 1
+		}
+		return 1 - s.ab/math.Sqrt(s.aa*s.bb)
+	case MetricDot:
+		return -s.ab
+	default:
+		return s.l2
+	}
+}
+
+// quantDistanceInt computes m between two sets of int8 levels quantized
+// with the range [min, max].
+func quantDistanceInt(m Metric, a, b []byte, min, max float32) float64 {
+	scale := (float64(max) - float64(min)) / 255
+	offset := float64(min) + 128*scale
+	if m == MetricL2 {
+		return scale * scale * float64(int8L2(a, b))
+	}
+	ab, aa, bb, sa, sb := int8Sums(a, b)
+	n := float64(len(a))
+	c := n * offset * offset
+	dot := scale*scale*float64(ab) + scale*offset*float64(sa+sb) + c
+	if m == MetricDot {
+		return -dot
+	}
+	na := scale*scale*float64(aa) + 2*scale*offset*float64(sa) + c
+	nb := scale*scale*float64(bb) + 2*scale*offset*float64(sb) + c
+	if na <= 0 || nb <= 0 {
+		return 1
+	}
+	return 1 - dot/math.Sqrt(na*nb)
+}
+
+// int8L2Block is the most squared level differences, each at most 255^2,
+// that an int32 can sum without overflowing.
+const int8L2Block = 1 << 15
+
+// int8L2 returns the sum of squared differences between int8 levels.
+func int8L2(a, b []byte) int64 {
+	var sum int64
+	for len(a) > 0 {
+		n := len(a)
+		if n > int8L2Block {
+			n = int8L2Block
+		}
+		x, y := a[:n], b[:n]
+		var s int32
+		for i := range x {
+			d := int32(int8(x[i])) - int32(int8(y[i]))
+			s += d * d
+		}
+		sum += int64(s)
+		a, b = a[n:], b[n:]
+	}
+	return sum
+}
+
+// int8Sums returns the sums of a[i]*b[i], a[i]^2, b[i]^2, a[i] and b[i] over
+// int8 levels. Each product is at most 128^2, so none of the sums can
+// overflow an int32 for dimensions up to maxQuantDim.
+func int8Sums(a, b []byte) (ab, aa, bb, sa, sb int32) {
+	b = b[:len(a)]
+	for i := range a {
+		x, y := int32(int8(a[i])), int32(int8(b[i]))
+		ab += x * y
+		aa += x * x
+		bb += y * y
+		sa += x
+		sb += y
+	}
+	return ab, aa, bb, sa, sb
+}
+
+func (cfg *config) quantDescription() string {
+	if cfg.quantCal != nil {
+		return fmt.Sprintf("calibration %08x", cfg.quantCalID)
+	}
+	return fmt.Sprintf("range [%v, %v]", cfg.quantMin, cfg.quantMax)
+}
+
+// id identifies a calibration in version-2 blob headers: the CRC-32 (IEEE)
+// of its min values followed by its max values as float32 LE.
+func (c *Calibration) id() uint32 {
+	h := crc32.NewIEEE()
+	h.Write(Float32ToBlob(c.Min))
+	h.Write(Float32ToBlob(c.Max))
+	return h.Sum32()
+}
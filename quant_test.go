@@ -0,0 +1,363 @@
+package vector
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestQuantBlobV2(t *testing.T) {
+	v := []float32{0.5, -0.25, 1, -1}
+	ranged := &config{dim: 4, quantMin: -1, quantMax: 1, quantEnabled: true}
+	cal := &Calibration{Min: []float32{0, -1, 0, -2}, Max: []float32{1, 0, 2, 0}}
+	calibrated := &config{dim: 4, quantCal: cal, quantCalID: cal.id(), quantEnabled: true}
+	other := &Calibration{Min: []float32{-1, -1, -1, -1}, Max: []float32{1, 1, 1, 1}}
+
+	tests := []struct {
+		name    string
+		encode  *config
+		decode  *config
+		wantErr string
+	}{
+		{"range", ranged, ranged, ""},
+		{"different connection range", ranged, &config{dim: 4, quantMin: -10, quantMax: 10, quantEnabled: true}, ""},
+		{"range blob on calibrated connection", ranged, calibrated, ""},
+		{"calibration", calibrated, calibrated, ""},
+		{"calibration on range connection", calibrated, ranged, "connection uses range [-1, 1]"},
+		{"different calibration", calibrated, &config{dim: 4, quantCal: other, quantCalID: other.id()}, "quantized with calibration"},
+		{"different dimension", ranged, &config{dim: 3, quantMin: -1, quantMax: 1}, "dimension 4, expected 3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.encode.quantize(v)
+			if len(b) != quantHeaderV2+len(v) || b[0] != formatInt8 || b[1] != quantVersion2 {
+				t.Fatalf("quantize = %x, want a version-2 header and %d values", b, len(v))
+			}
+			got, err := tt.decode.dequantize(b)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("dequantize error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range v {
+				if math.Abs(float64(got[i]-v[i])) > 0.01 {
+					t.Errorf("dequantize = %v, want about %v", got, v)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestQuantBlobV1(t *testing.T) {
+	v := []float32{0.5, -0.25, 1}
+	cfg := &config{dim: 3, quantMin: -1, quantMax: 1}
+	got, err := cfg.dequantize(quantize(v, -1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := dequantize(quantize(v, -1, 1), -1, 1)
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("dequantize = %v, want %v", got, want)
+		}
+	}
+
+	if _, err := (&config{dim: 4}).dequantize(quantize(v, -1, 1)); err == nil {
+		t.Error("dequantize accepted a version-1 blob of the wrong dimension")
+	}
+}
+
+func TestParseQuantBlob(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"not quantized", []byte{0x01, 0x01, 0x00}},
+		{"truncated header", []byte{0x00, 0x02, 0x00, 0x02}},
+		{"values do not match dimension", []byte{0x00, 0x02, 0x00, 0x03, 0x00, 0, 0, 0, 0, 0, 0, 0, 0, 1, 2}},
+		{"unknown kind", []byte{0x00, 0x02, 0x07, 0x01, 0x00, 0, 0, 0, 0, 0, 0, 0, 0, 1}},
+	}
+	for _, tt := range tests {
+		if _, err := parseQuantBlob(tt.b); err == nil {
+			t.Errorf("%s: parseQuantBlob(%x) succeeded, want error", tt.name, tt.b)
+		}
+	}
+}
+
+func TestDistanceQAcrossRanges(t *testing.T) {
+	conn := openTestConn(t)
+	if err := Register(conn, 3, WithQuantRange(-1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlitex.ExecuteTransient(conn, "CREATE TABLE items (q BLOB)", nil); err != nil {
+		t.Fatal(err)
+	}
+	err := sqlitex.ExecuteTransient(conn, "INSERT INTO items VALUES (vector_quantize(vector_encode('[0.5, 0.5, 0]')))", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Re-registering with a different range must not change the stored
+	// blob's meaning.
+	if err := Register(conn, 3, WithQuantRange(-2, 2)); err != nil {
+		t.Fatal(err)
+	}
+	var dist float64
+	err = sqlitex.ExecuteTransient(conn,
+		"SELECT vector_distance_q(q, vector_quantize(vector_encode('[0.5, 0.5, 0]'))) FROM items",
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				dist = stmt.ColumnFloat(0)
+				return nil
+			},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dist > 0.05 {
+		t.Errorf("distance between identical vectors quantized with different ranges = %v, want about 0", dist)
+	}
+
+	if err := Register(conn, maxQuantDim+1, WithQuantRange(-1, 1)); err == nil {
+		t.Error("Register accepted a quantized dimension that does not fit the header")
+	}
+}
+
+func TestQuantDistance(t *testing.T) {
+	const dim = 64
+	cal := &Calibration{Min: make([]float32, dim), Max: make([]float32, dim)}
+	for i := range cal.Min {
+		cal.Min[i] = -float32(i+1) / dim
+		cal.Max[i] = float32(i+1) / dim
+	}
+	ranged := &config{dim: dim, quantMin: -1, quantMax: 1, quantEnabled: true}
+	shifted := &config{dim: dim, quantMin: 0, quantMax: 2, quantEnabled: true}
+	calibrated := &config{dim: dim, quantCal: cal, quantCalID: cal.id(), quantEnabled: true}
+
+	tests := []struct {
+		name   string
+		encode [2]*config
+		decode *config
+	}{
+		{"same range", [2]*config{ranged, ranged}, ranged},
+		{"offset range", [2]*config{shifted, shifted}, shifted},
+		{"different ranges", [2]*config{ranged, shifted}, ranged},
+		{"calibration", [2]*config{calibrated, calibrated}, calibrated},
+		{"version 1", [2]*config{nil, nil}, ranged},
+	}
+	for _, tt := range tests {
+		for _, m := range []Metric{MetricL2, MetricCosine, MetricDot} {
+			t.Run(tt.name+"/"+m.String(), func(t *testing.T) {
+				var blobs [2][]byte
+				for i, cfg := range tt.encode {
+					v := randomFloat32s(dim)
+					if cfg == nil {
+						blobs[i] = quantize(v, -1, 1)
+					} else {
+						blobs[i] = cfg.quantize(v)
+					}
+				}
+				a, ma, err := tt.decode.parseQuant(blobs[0])
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, mb, err := tt.decode.parseQuant(blobs[1])
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := quantDistance(m, a, ma, b, mb)
+
+				fa, _ := tt.decode.dequantize(blobs[0])
+				fb, _ := tt.decode.dequantize(blobs[1])
+				want := m.distance(fa, fb)
+				if math.Abs(got-want) > 1e-6*math.Max(1, math.Abs(want)) {
+					t.Errorf("quantDistance = %v, want %v", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestQuantDistanceZeroNorm(t *testing.T) {
+	// With the range [0, 255], level -128 is exactly 0.
+	cfg := &config{dim: 3, quantMin: 0, quantMax: 255, quantEnabled: true}
+	a, ma, _ := cfg.parseQuant(cfg.quantize([]float32{0, 0, 0}))
+	b, mb, _ := cfg.parseQuant(cfg.quantize([]float32{1, 2, 3}))
+	if got := quantDistance(MetricCosine, a, ma, b, mb); got != 1 {
+		t.Errorf("cosine distance from a zero vector = %v, want 1", got)
+	}
+}
+
+func TestQuantDistanceAllocs(t *testing.T) {
+	const dim = 1536
+	cfg := &config{dim: dim, quantMin: -1, quantMax: 1, quantEnabled: true}
+	blobA, blobB := cfg.quantize(randomFloat32s(dim)), cfg.quantize(randomFloat32s(dim))
+	for _, m := range []Metric{MetricL2, MetricCosine, MetricDot} {
+		allocs := testing.AllocsPerRun(100, func() {
+			a, ma, _ := cfg.parseQuant(blobA)
+			b, mb, _ := cfg.parseQuant(blobB)
+			quantDistance(m, a, ma, b, mb)
+		})
+		if allocs != 0 {
+			t.Errorf("%v: %v allocations per distance, want 0", m, allocs)
+		}
+	}
+}
+
+func TestInt8L2Blocks(t *testing.T) {
+	// Enough maximal differences to overflow a single int32 accumulator.
+	n := 2*int8L2Block + 5
+	a, b := make([]byte, n), make([]byte, n)
+	for i := range a {
+		a[i] = byte(0x80) // -128
+		b[i] = 0x7f
+	}
+	if got, want := int8L2(a, b), int64(n)*255*255; got != want {
+		t.Errorf("int8L2 = %d, want %d", got, want)
+	}
+}
+
+func TestQuantFloatDistance(t *testing.T) {
+	const dim = 64
+	cal := &Calibration{Min: make([]float32, dim), Max: make([]float32, dim)}
+	for i := range cal.Min {
+		cal.Min[i], cal.Max[i] = -1, float32(i+1)/dim
+	}
+	for _, cfg := range []*config{
+		{dim: dim, quantMin: -1, quantMax: 1, quantEnabled: true},
+		{dim: dim, quantCal: cal, quantCalID: cal.id(), quantEnabled: true},
+	} {
+		for _, m := range []Metric{MetricL2, MetricCosine, MetricDot} {
+			blob := cfg.quantize(randomFloat32s(dim))
+			query := randomFloat32s(dim)
+			a, ma, err := cfg.parseQuant(blob)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := quantFloatDistance(m, a, ma, Float32ToBlob(query))
+			v, _ := cfg.dequantize(blob)
+			if want := m.distance(v, query); math.Abs(got-want) > 1e-9 {
+				t.Errorf("%s, %v: quantFloatDistance = %v, want %v", cfg.quantDescription(), m, got, want)
+			}
+		}
+	}
+}
+
+func TestVectorDistanceAQ(t *testing.T) {
+	const (
+		n   = 300
+		dim = 32
+		k   = 10
+	)
+	conn := openTestConn(t)
+	if err := Register(conn, dim, WithQuantRange(-1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlitex.ExecuteTransient(conn, "CREATE TABLE items (embedding BLOB, q BLOB)", nil); err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	vectors := insertRandomVectors(t, conn, "items", rng, n, dim)
+	if err := sqlitex.ExecuteTransient(conn, "UPDATE items SET q = vector_quantize(embedding)", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the stored side loses precision, so ranking should be at least
+	// as good as quantizing the query too.
+	var symmetric, asymmetric float64
+	for i := 0; i < 10; i++ {
+		q := make([]float32, dim)
+		for j := range q {
+			q[j] = rng.Float32()*2 - 1
+		}
+		want := bruteForceKNN(vectors, q, k)
+		symmetric += recall(queryKNN(t, conn,
+			"SELECT rowid FROM items ORDER BY vector_distance_q(q, vector_quantize(?1)) LIMIT ?2", Float32ToBlob(q), k), want)
+		asymmetric += recall(queryKNN(t, conn,
+			"SELECT rowid FROM items ORDER BY vector_distance_aq(q, ?1) LIMIT ?2", Float32ToBlob(q), k), want)
+	}
+	if asymmetric < symmetric {
+		t.Errorf("total recall: vector_distance_aq %.2f, vector_distance_q %.2f, want aq >= q", asymmetric, symmetric)
+	}
+
+	var typ sqlite.ColumnType
+	err := sqlitex.ExecuteTransient(conn, "SELECT vector_distance_aq(NULL, NULL)", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			typ = stmt.ColumnType(0)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != sqlite.TypeNull {
+		t.Errorf("vector_distance_aq(NULL, NULL) type = %v, want NULL", typ)
+	}
+}
+
+// The helpers below write and read version-1 quantized blobs, the format
+// before the version-2 header, so tests can check that blobs written by
+// earlier releases still read correctly.
+
+// quantize quantizes v with a single range for every dimension.
+func quantize(v []float32, min, max float32) []byte {
+	b := quantizedHeader(len(v))
+	for i, f := range v {
+		b[2+i] = quantizeValue(f, min, max)
+	}
+	return b
+}
+
+// quantizeRanges quantizes v with a separate range for each dimension.
+func quantizeRanges(v []float32, min, max []float32) []byte {
+	b := quantizedHeader(len(v))
+	for i, f := range v {
+		b[2+i] = quantizeValue(f, min[i], max[i])
+	}
+	return b
+}
+
+func quantizedHeader(dim int) []byte {
+	b := make([]byte, 2+dim)
+	b[0] = formatInt8
+	b[1] = quantVersion1
+	return b
+}
+
+func dequantize(b []byte, min, max float32) ([]float32, error) {
+	if len(b) < 2 || b[0] != 0x00 || b[1] != 0x01 {
+		return nil, fmt.Errorf("dequantize: missing quantized format magic bytes")
+	}
+	data := b[2:]
+	v := make([]float32, len(data))
+	for i, raw := range data {
+		v[i] = dequantizeValue(raw, min, max)
+	}
+	return v, nil
+}
+
+// dequantizeRanges dequantizes b with a separate range for each dimension.
+func dequantizeRanges(b []byte, min, max []float32) ([]float32, error) {
+	if len(b) < 2 || b[0] != formatInt8 || b[1] != quantVersion1 {
+		return nil, fmt.Errorf("dequantize: missing quantized format magic bytes")
+	}
+	data := b[2:]
+	if len(data) != len(min) {
+		return nil, fmt.Errorf("dequantize: expected %d values, got %d", len(min), len(data))
+	}
+	v := make([]float32, len(data))
+	for i, raw := range data {
+		v[i] = dequantizeValue(raw, min[i], max[i])
+	}
+	return v, nil
+}
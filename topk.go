@@ -0,0 +1,102 @@
+package vector
+
+import (
+	"fmt"
+	"strings"
+
+	"zombiezen.com/go/sqlite"
+)
+
+// topKFunc returns the vector_top_k table-valued function, an exact k-nearest
+// neighbor search over any table column. It scans the column once and keeps
+// the k nearest rows in a bounded max-heap, so it never sorts the whole table
+// the way ORDER BY vector_distance(...) LIMIT k does.
+func topKFunc(conn *sqlite.Conn, cfg *config) *tableFunc {
+	return &tableFunc{
+		name:     cfg.funcName("_top_k"),
+		columns:  []string{"id INTEGER", "distance REAL"},
+		params:   []string{"table_name", "column_name", "query", "k", "filter"},
+		required: 4,
+		run: func(params []sqlite.Value) ([]tableFuncRow, error) {
+			if params[2].Type() == sqlite.TypeNull {
+				return nil, nil
+			}
+			q, model, err := scanQuery(cfg, params[2])
+			if err != nil {
+				return nil, fmt.Errorf("query: %v", err)
+			}
+			k := params[3].Int()
+			if k < 0 {
+				return nil, fmt.Errorf("k must be >= 0, got %d", k)
+			}
+			var filter string
+			if params[4].Type() != sqlite.TypeNull {
+				filter = params[4].Text()
+			}
+			neighbors, err := scanTopK(conn, cfg, params[0].Text(), params[1].Text(), filter, q, model, k)
+			if err != nil {
+				return nil, err
+			}
+			return neighborRows(neighbors), nil
+		},
+	}
+}
+
+// scanTopK returns the k rows of table whose column is nearest to q under
+// the configured metric, nearest first.
+func scanTopK(conn *sqlite.Conn, cfg *config, table, column, filter string, q []float32, model string, k int) ([]neighbor, error) {
+	top := newTopK(k)
+	err := scanVectors(conn, cfg, table, column, filter, model, func(id int64, vec []float32) {
+		top.push(id, cfg.metric.distance(q, vec))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return top.sorted(), nil
+}
+
+// scanVectors calls fn with the row ID and decoded vector of every row of
+// table. filter, if not empty, is an SQL expression that rows must also
+// satisfy. Rows whose column is NULL are skipped; any other value that does
+// not decode, or is tagged with a model other than model, is an error.
+func scanVectors(conn *sqlite.Conn, cfg *config, table, column, filter, model string, fn func(id int64, vec []float32)) error {
+	query := fmt.Sprintf("SELECT rowid, %s FROM %s WHERE %[1]s IS NOT NULL", quoteIdent(column), quoteIdent(table))
+	if strings.TrimSpace(filter) != "" {
+		query += " AND (" + filter + ")"
+	}
+	stmt, err := prepareTransient(conn, query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Finalize()
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return err
+		}
+		if !hasRow {
+			return nil
+		}
+		id := stmt.ColumnInt64(0)
+		b := make([]byte, stmt.ColumnLen(1))
+		stmt.ColumnBytes(1, b)
+		vec, rowModel, err := cfg.decodeTagged(b)
+		if err != nil {
+			return fmt.Errorf("row %d: %v", id, err)
+		}
+		if err := checkModels(model, rowModel); err != nil {
+			return fmt.Errorf("row %d: %v", id, err)
+		}
+		fn(id, vec)
+	}
+}
+
+// scanQuery decodes the query argument of vector_top_k and vector_within:
+// a JSON array or any blob decodeTagged accepts.
+func scanQuery(cfg *config, v sqlite.Value) ([]float32, string, error) {
+	if v.Type() == sqlite.TypeText {
+		q, err := queryVector(cfg, v)
+		return q, "", err
+	}
+	return cfg.decodeTagged(v.Blob())
+}
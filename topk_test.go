@@ -0,0 +1,138 @@
+package vector
+
+import (
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestVectorTopK(t *testing.T) {
+	const (
+		n   = 500
+		dim = 8
+		k   = 10
+	)
+	conn, vectors := setupIVFTable(t, n, dim)
+	rng := rand.New(rand.NewSource(2))
+	for i := 0; i < 10; i++ {
+		q := make([]float32, dim)
+		for j := range q {
+			q[j] = rng.Float32()*2 - 1
+		}
+		want := bruteForceKNN(vectors, q, k)
+		got := queryKNN(t, conn, "SELECT rowid FROM vector_top_k('items', 'embedding', ?, ?)", Float32ToBlob(q), k)
+		if !slices.Equal(got, want) {
+			t.Errorf("query %d: vector_top_k = %v, want %v", i, got, want)
+		}
+	}
+
+	q := vectors[7]
+	var distances []float64
+	err := sqlitex.Execute(conn, "SELECT distance FROM vector_top_k('items', 'embedding', ?, 3)",
+		&sqlitex.ExecOptions{
+			Args: []any{Float32ToBlob(q)},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				distances = append(distances, stmt.ColumnFloat(0))
+				return nil
+			},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(distances) != 3 || distances[0] != 0 || !slices.IsSorted(distances) {
+		t.Errorf("distances = %v, want 3 ascending starting at 0", distances)
+	}
+}
+
+func TestVectorTopKFilter(t *testing.T) {
+	conn, vectors := setupIVFTable(t, 100, 4)
+	if err := sqlitex.ExecuteTransient(conn, "INSERT INTO items (rowid, embedding) VALUES (101, NULL)", nil); err != nil {
+		t.Fatal(err)
+	}
+	even := make(map[int64][]float32)
+	for id, v := range vectors {
+		if id%2 == 0 {
+			even[id] = v
+		}
+	}
+	q := vectors[3]
+	want := bruteForceKNN(even, q, 5)
+	got := queryKNN(t, conn, "SELECT id FROM vector_top_k('items', 'embedding', ?, 5, 'rowid % 2 = 0')", Float32ToBlob(q))
+	if !slices.Equal(got, want) {
+		t.Errorf("filtered vector_top_k = %v, want %v", got, want)
+	}
+	if got := queryKNN(t, conn, "SELECT id FROM vector_top_k('items', 'embedding', ?, 500)", Float32ToBlob(q)); len(got) != 100 {
+		t.Errorf("k larger than the table returned %d rows, want 100", len(got))
+	}
+	if got := queryKNN(t, conn, "SELECT id FROM vector_top_k('items', 'embedding', NULL, 5)"); len(got) != 0 {
+		t.Errorf("NULL query returned %v", got)
+	}
+	if got := queryKNN(t, conn, "SELECT id FROM vector_top_k('items', 'embedding', '[0,0,0,0]', 1)"); len(got) != 1 {
+		t.Errorf("JSON query returned %v", got)
+	}
+}
+
+func TestVectorTopKHugeK(t *testing.T) {
+	conn, vectors := setupIVFTable(t, 20, 4)
+	got := queryKNN(t, conn, "SELECT id FROM vector_top_k('items', 'embedding', ?, ?)", Float32ToBlob(vectors[1]), int64(100_000_000_000))
+	if len(got) != 20 || got[0] != 1 {
+		t.Errorf("vector_top_k with huge k = %v, want all 20 rows starting at 1", got)
+	}
+}
+
+func TestVectorTopKInsideCachedStatement(t *testing.T) {
+	conn, vectors := setupIVFTable(t, 20, 4)
+	// The outer statement has the text vector_top_k scans with and comes
+	// from the connection's statement cache.
+	rows := 0
+	err := sqlitex.Execute(conn, `SELECT rowid, "embedding" FROM "items" WHERE "embedding" IS NOT NULL`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			rows++
+			id := stmt.ColumnInt64(0)
+			if got := queryKNN(t, conn, "SELECT id FROM vector_top_k('items', 'embedding', ?, 1)", Float32ToBlob(vectors[id])); !slices.Equal(got, []int64{id}) {
+				t.Errorf("nearest to row %d = %v", id, got)
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows != len(vectors) {
+		t.Errorf("outer scan returned %d rows, want %d", rows, len(vectors))
+	}
+}
+
+func TestVectorTopKErrors(t *testing.T) {
+	conn, _ := setupIVFTable(t, 10, 4)
+	tagged, _ := TypedToBlob([]float32{0, 0, 0, 0}, ElementFloat32, "a")
+	err := sqlitex.Execute(conn, "INSERT INTO items (embedding) VALUES (?)", &sqlitex.ExecOptions{Args: []any{tagged}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := TypedToBlob([]float32{0, 0, 0, 0}, ElementFloat32, "b")
+	tests := []struct {
+		name  string
+		query string
+		args  []any
+		want  string
+	}{
+		{"missing k", "SELECT * FROM vector_top_k('items', 'embedding', '[0,0,0,0]')", nil, "missing argument k"},
+		{"negative k", "SELECT * FROM vector_top_k('items', 'embedding', '[0,0,0,0]', -1)", nil, "k must be >= 0"},
+		{"wrong dimension", "SELECT * FROM vector_top_k('items', 'embedding', '[0,0]', 1)", nil, "expected dimension 4"},
+		{"bad filter", "SELECT * FROM vector_top_k('items', 'embedding', '[0,0,0,0]', 1, 'no_such_column = 1')", nil, "no_such_column"},
+		{"different models", "SELECT * FROM vector_top_k('items', 'embedding', ?, 1)", []any{other}, "cannot compare vectors"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := sqlitex.Execute(conn, tt.query, &sqlitex.ExecOptions{Args: tt.args})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want containing %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package vector
+
+import (
+	"fmt"
+	"strings"
+
+	"zombiezen.com/go/sqlite"
+)
+
+// tableFunc is an eponymous table-valued function whose result columns are
+// followed by hidden parameter columns, so it can be called as
+// name(param, ...). Results are materialized: run receives one value per
+// parameter (NULL when omitted) and returns every row up front.
+type tableFunc struct {
+	name     string
+	columns  []string // result column definitions, e.g. "id INTEGER"
+	params   []string // hidden parameter column names
+	required int      // number of leading params that must be supplied
+	run      func(params []sqlite.Value) ([]tableFuncRow, error)
+}
+
+type tableFuncRow struct {
+	rowID  int64
+	values []sqlite.Value
+}
+
+func (tf *tableFunc) module() *sqlite.Module {
+	return &sqlite.Module{
+		Connect: func(c *sqlite.Conn, opts *sqlite.VTableConnectOptions) (sqlite.VTable, *sqlite.VTableConfig, error) {
+			return &tableFuncVTable{fn: tf}, &sqlite.VTableConfig{Declaration: tf.declaration()}, nil
+		},
+	}
+}
+
+func (tf *tableFunc) declaration() string {
+	cols := append([]string(nil), tf.columns...)
+	for _, p := range tf.params {
+		cols = append(cols, p+" HIDDEN")
+	}
+	return "CREATE TABLE x(" + strings.Join(cols, ", ") + ")"
+}
+
+type tableFuncVTable struct {
+	fn *tableFunc
+}
+
+// BestIndex passes equality constraints on parameter columns as arguments,
+// in parameter order. IndexID.Num is a bitmask of the parameters supplied.
+func (vt *tableFuncVTable) BestIndex(inputs *sqlite.IndexInputs) (*sqlite.IndexOutputs, error) {
+	first := len(vt.fn.columns)
+	byParam := make([]int, len(vt.fn.params))
+	for i := range byParam {
+		byParam[i] = -1
+	}
+	for i, c := range inputs.Constraints {
+		p := c.Column - first
+		if p < 0 || c.Op != sqlite.IndexConstraintEq {
+			continue
+		}
+		if !c.Usable {
+			if p < vt.fn.required {
+				// Another plan must supply this argument first.
+				return nil, sqlite.ResultConstraint.ToError()
+			}
+			continue
+		}
+		byParam[p] = i
+	}
+
+	outputs := &sqlite.IndexOutputs{
+		ConstraintUsage: make([]sqlite.IndexConstraintUsage, len(inputs.Constraints)),
+		EstimatedCost:   1,
+		EstimatedRows:   100,
+	}
+	argv := 0
+	for p, i := range byParam {
+		if i < 0 {
+			if p < vt.fn.required {
+				outputs.EstimatedCost = 1e12
+			}
+			continue
+		}
+		argv++
+		outputs.ConstraintUsage[i] = sqlite.IndexConstraintUsage{ArgvIndex: argv, Omit: true}
+		outputs.ID.Num |= 1 << p
+	}
+	return outputs, nil
+}
+
+func (vt *tableFuncVTable) Open() (sqlite.VTableCursor, error) {
+	return &tableFuncCursor{fn: vt.fn}, nil
+}
+
+func (vt *tableFuncVTable) Disconnect() error { return nil }
+func (vt *tableFuncVTable) Destroy() error    { return nil }
+
+type tableFuncCursor struct {
+	fn   *tableFunc
+	rows []tableFuncRow
+	pos  int
+}
+
+func (cur *tableFuncCursor) Filter(id sqlite.IndexID, argv []sqlite.Value) error {
+	cur.rows = nil
+	cur.pos = 0
+	params := make([]sqlite.Value, len(cur.fn.params))
+	for p := range params {
+		if id.Num&(1<<p) != 0 {
+			params[p] = argv[0]
+			argv = argv[1:]
+		}
+	}
+	for p := 0; p < cur.fn.required; p++ {
+		if id.Num&(1<<p) == 0 {
+			return fmt.Errorf("%s: missing argument %s", cur.fn.name, cur.fn.params[p])
+		}
+	}
+	rows, err := cur.fn.run(params)
+	if err != nil {
+		return fmt.Errorf("%s: %w", cur.fn.name, err)
+	}
+	cur.rows = rows
+	return nil
+}
+
+func (cur *tableFuncCursor) Next() error {
+	cur.pos++
+	return nil
+}
+
+func (cur *tableFuncCursor) Column(i int, noChange bool) (sqlite.Value, error) {
+	if i >= len(cur.fn.columns) {
+		return sqlite.Value{}, nil
+	}
+	return cur.rows[cur.pos].values[i], nil
+}
+
+func (cur *tableFuncCursor) RowID() (int64, error) {
+	return cur.rows[cur.pos].rowID, nil
+}
+
+func (cur *tableFuncCursor) EOF() bool {
+	return cur.pos >= len(cur.rows)
+}
+
+func (cur *tableFuncCursor) Close() error {
+	return nil
+}
+
+// prepareTransient prepares query outside conn's statement cache. The
+// cache hands every caller of conn.Prepare the same statement for the same
+// text and resets it, so a statement that stays open while other
+// statements run, such as a cursor's, must not come from it. The caller
+// must finalize the statement.
+func prepareTransient(conn *sqlite.Conn, query string) (*sqlite.Stmt, error) {
+	stmt, trailing, err := conn.PrepareTransient(query)
+	if err != nil {
+		return nil, err
+	}
+	if stmt == nil {
+		return nil, fmt.Errorf("sqlite: prepare %q: empty statement", query)
+	}
+	if strings.TrimSpace(query[len(query)-trailing:]) != "" {
+		stmt.Finalize()
+		return nil, fmt.Errorf("sqlite: prepare %q: statement has trailing bytes", query)
+	}
+	return stmt, nil
+}
+
+// prepareRowQuery prepares query, a single SQL statement passed to a
+// table-valued function as an argument, and checks that its rows have the
+// named columns. The caller must finalize the statement.
+func prepareRowQuery(conn *sqlite.Conn, query string, columns ...string) (*sqlite.Stmt, error) {
+	stmt, trailing, err := conn.PrepareTransient(query)
+	if err != nil {
+		return nil, err
+	}
+	if stmt == nil {
+		return nil, fmt.Errorf("empty query")
+	}
+	if strings.TrimSpace(query[len(query)-trailing:]) != "" {
+		stmt.Finalize()
+		return nil, fmt.Errorf("must be a single statement")
+	}
+	if n := stmt.ColumnCount(); n != len(columns) {
+		stmt.Finalize()
+		return nil, fmt.Errorf("query returns %d columns, want %d (%s)", n, len(columns), strings.Join(columns, ", "))
+	}
+	return stmt, nil
+}
@@ -0,0 +1,271 @@
+package vector
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"zombiezen.com/go/sqlite"
+)
+
+// A typed vector blob records its element type, its dimension and the model
+// that produced it, so its bytes are never mistaken for another layout and
+// vectors from different models are never compared:
+//
+//	[0x05] [0x01] [type] [dim uint32 LE] [tag length] [tag] [pad] [values]
+//
+// The tag is at most maxModelTagLen bytes of UTF-8. pad is a zero byte
+// present when the tag length is even, which gives the header an odd length.
+// Values are at least two bytes wide, so every typed blob has an odd length
+// and never the length of a float32 blob.
+
+const (
+	typedVersion = 0x01
+
+	typedFixedHeader = 8
+	maxModelTagLen   = 255
+)
+
+// ElementType is the type of the values stored in a typed vector blob.
+type ElementType byte
+
+const (
+	// ElementFloat32 stores IEEE 754 single-precision values.
+	ElementFloat32 ElementType = iota
+	// ElementFloat16 stores IEEE 754 half-precision values.
+	ElementFloat16
+	// ElementBFloat16 stores bfloat16 values: the upper half of a float32.
+	ElementBFloat16
+)
+
+// String returns the element type name used by vector_info.
+func (t ElementType) String() string {
+	switch t {
+	case ElementFloat32:
+		return "float32"
+	case ElementFloat16:
+		return "float16"
+	case ElementBFloat16:
+		return "bfloat16"
+	default:
+		return fmt.Sprintf("ElementType(%d)", int(t))
+	}
+}
+
+func (t ElementType) size() int {
+	if t == ElementFloat32 {
+		return 4
+	}
+	return 2
+}
+
+// VectorInfo describes a typed vector blob.
+type VectorInfo struct {
+	Type  ElementType
+	Dim   int
+	Model string
+}
+
+func isTypedBlob(b []byte) bool {
+	return len(b) >= 2 && b[0] == formatTyped && b[1] == typedVersion
+}
+
+// typedHeaderLen returns the header length of a typed blob whose tag has n
+// bytes.
+func typedHeaderLen(n int) int {
+	if n%2 == 0 {
+		return typedFixedHeader + n + 1
+	}
+	return typedFixedHeader + n
+}
+
+// TypedToBlob converts v to a typed vector blob of element type t tagged
+// with model, which may be empty. Returns an error if t is unknown or model
+// is longer than 255 bytes.
+func TypedToBlob(v []float32, t ElementType, model string) ([]byte, error) {
+	if t > ElementBFloat16 {
+		return nil, fmt.Errorf("unknown element type %v", t)
+	}
+	if len(model) > maxModelTagLen {
+		return nil, fmt.Errorf("model tag is %d bytes, at most %d allowed", len(model), maxModelTagLen)
+	}
+	if uint64(len(v)) > math.MaxUint32 {
+		return nil, fmt.Errorf("dimension %d does not fit the header", len(v))
+	}
+	h := typedHeaderLen(len(model))
+	b := make([]byte, h+len(v)*t.size())
+	b[0] = formatTyped
+	b[1] = typedVersion
+	b[2] = byte(t)
+	binary.LittleEndian.PutUint32(b[3:], uint32(len(v)))
+	b[7] = byte(len(model))
+	copy(b[typedFixedHeader:], model)
+	data := b[h:]
+	for i, f := range v {
+		switch t {
+		case ElementFloat32:
+			binary.LittleEndian.PutUint32(data[i*4:], math.Float32bits(f))
+		case ElementFloat16:
+			binary.LittleEndian.PutUint16(data[i*2:], float32ToFloat16(f))
+		case ElementBFloat16:
+			binary.LittleEndian.PutUint16(data[i*2:], float32ToBFloat16(f))
+		}
+	}
+	return b, nil
+}
+
+// BlobToTyped converts a typed vector blob back to []float32 and returns its
+// header. Returns an error if b is not a well-formed typed vector blob.
+func BlobToTyped(b []byte) ([]float32, VectorInfo, error) {
+	info, data, err := parseTypedBlob(b)
+	if err != nil {
+		return nil, VectorInfo{}, err
+	}
+	v := make([]float32, info.Dim)
+	decodeTyped(v, info.Type, data)
+	return v, info, nil
+}
+
+// parseTypedBlob validates a typed blob's header and returns it with the
+// encoded values.
+func parseTypedBlob(b []byte) (VectorInfo, []byte, error) {
+	if !isTypedBlob(b) {
+		return VectorInfo{}, nil, fmt.Errorf("missing typed vector magic bytes")
+	}
+	if len(b) < typedFixedHeader {
+		return VectorInfo{}, nil, fmt.Errorf("typed vector header truncated to %d bytes", len(b))
+	}
+	t := ElementType(b[2])
+	if t > ElementBFloat16 {
+		return VectorInfo{}, nil, fmt.Errorf("unknown element type %#x", b[2])
+	}
+	dim := binary.LittleEndian.Uint32(b[3:])
+	h := typedHeaderLen(int(b[7]))
+	if len(b) < h {
+		return VectorInfo{}, nil, fmt.Errorf("typed vector header truncated to %d bytes", len(b))
+	}
+	data := b[h:]
+	if uint64(len(data)) != uint64(dim)*uint64(t.size()) {
+		return VectorInfo{}, nil, fmt.Errorf("typed vector header says %d %v values, got %d bytes", dim, t, len(data))
+	}
+	info := VectorInfo{Type: t, Dim: int(dim), Model: string(b[typedFixedHeader : typedFixedHeader+int(b[7])])}
+	return info, data, nil
+}
+
+// decodeTyped decodes values of type t from data into dst without
+// allocating.
+func decodeTyped(dst []float32, t ElementType, data []byte) {
+	switch t {
+	case ElementFloat32:
+		decodeFloat32(dst, data)
+	case ElementFloat16:
+		decodeHalfInto(dst, formatFloat16, data)
+	case ElementBFloat16:
+		decodeHalfInto(dst, formatBFloat16, data)
+	}
+}
+
+// checkModels returns an error if both tags are set and differ. An empty
+// tag matches any model, so untagged queries can search tagged rows.
+func checkModels(a, b string) error {
+	if a != "" && b != "" && a != b {
+		return fmt.Errorf("cannot compare vectors from model %q and model %q", a, b)
+	}
+	return nil
+}
+
+// blobInfo describes any blob with a recognized format for vector_info.
+// Dim is omitted when the blob does not record it.
+type blobInfo struct {
+	Type  string `json:"type"`
+	Dim   int    `json:"dim,omitempty"`
+	Model string `json:"model,omitempty"`
+}
+
+func (cfg *config) describeBlob(b []byte) (blobInfo, error) {
+	switch {
+	case len(b) == cfg.dim*4:
+		return blobInfo{Type: "float32", Dim: cfg.dim}, nil
+	case isTypedBlob(b):
+		info, _, err := parseTypedBlob(b)
+		if err != nil {
+			return blobInfo{}, err
+		}
+		return blobInfo{Type: info.Type.String(), Dim: info.Dim, Model: info.Model}, nil
+	case isQuantizedBlob(b):
+		q, err := parseQuantBlob(b)
+		if err != nil {
+			return blobInfo{}, err
+		}
+		return blobInfo{Type: "int8", Dim: q.dim}, nil
+	}
+	if f, ok := halfFormat(b); ok && len(b)%2 == 0 {
+		return blobInfo{Type: halfName(f), Dim: (len(b) - 2) / 2}, nil
+	}
+	if isBinaryBlob(b) {
+		return blobInfo{Type: "binary"}, nil
+	}
+	if isPQBlob(b) {
+		return blobInfo{Type: "pq"}, nil
+	}
+	return blobInfo{}, fmt.Errorf("unrecognized blob of %d bytes (dim=%d)", len(b), cfg.dim)
+}
+
+// vectorInfoFunc returns the vector_info SQL function.
+func vectorInfoFunc(cfg *config) *sqlite.FunctionImpl {
+	name := cfg.funcName("_info")
+	return &sqlite.FunctionImpl{
+		NArgs:         1,
+		Deterministic: true,
+		Scalar: func(ctx sqlite.Context, args []sqlite.Value) (sqlite.Value, error) {
+			if args[0].Type() == sqlite.TypeNull {
+				return sqlite.Value{}, nil
+			}
+			info, err := cfg.describeBlob(args[0].Blob())
+			if err != nil {
+				return sqlite.Value{}, fmt.Errorf("%s: %v", name, err)
+			}
+			data, err := json.Marshal(info)
+			if err != nil {
+				return sqlite.Value{}, fmt.Errorf("%s: %v", name, err)
+			}
+			return sqlite.TextValue(string(data)), nil
+		},
+	}
+}
+
+// vectorTagFunc returns the vector_tag SQL function, which converts a
+// float32 or half-precision blob to a typed blob of the same element type.
+func vectorTagFunc(cfg *config) *sqlite.FunctionImpl {
+	name := cfg.funcName("_tag")
+	return &sqlite.FunctionImpl{
+		NArgs:         2,
+		Deterministic: true,
+		Scalar: func(ctx sqlite.Context, args []sqlite.Value) (sqlite.Value, error) {
+			if args[0].Type() == sqlite.TypeNull || args[1].Type() == sqlite.TypeNull {
+				return sqlite.Value{}, nil
+			}
+			blob := args[0].Blob()
+			t := ElementFloat32
+			if f, ok := halfFormat(blob); ok && len(blob) != cfg.dim*4 {
+				t = ElementFloat16
+				if f == formatBFloat16 {
+					t = ElementBFloat16
+				}
+			}
+			v, model, err := cfg.decodeFloats(blob)
+			if err != nil {
+				return sqlite.Value{}, fmt.Errorf("%s: %v", name, err)
+			}
+			if model != "" {
+				return sqlite.Value{}, fmt.Errorf("%s: input is already tagged with model %q", name, model)
+			}
+			b, err := TypedToBlob(v, t, args[1].Text())
+			if err != nil {
+				return sqlite.Value{}, fmt.Errorf("%s: %v", name, err)
+			}
+			return sqlite.BlobValue(b), nil
+		},
+	}
+}
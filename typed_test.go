@@ -0,0 +1,145 @@
+package vector
+
+import (
+	"strings"
+	"testing"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestTypedBlobRoundTrip(t *testing.T) {
+	v := []float32{0.5, -0.25, 1, 3.140625}
+	for _, typ := range []ElementType{ElementFloat32, ElementFloat16, ElementBFloat16} {
+		for _, model := range []string{"", "m", "text-embedding-3-small"} {
+			b, err := TypedToBlob(v, typ, model)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(b)%2 != 1 {
+				t.Errorf("%v %q: length %d is even", typ, model, len(b))
+			}
+			got, info, err := BlobToTyped(b)
+			if err != nil {
+				t.Fatalf("%v %q: %v", typ, model, err)
+			}
+			if want := (VectorInfo{Type: typ, Dim: len(v), Model: model}); info != want {
+				t.Errorf("info = %+v, want %+v", info, want)
+			}
+			for i := range v {
+				if got[i] != v[i] {
+					t.Fatalf("%v %q: BlobToTyped = %v, want %v", typ, model, got, v)
+				}
+			}
+		}
+	}
+}
+
+func TestTypedToBlobErrors(t *testing.T) {
+	if _, err := TypedToBlob([]float32{1}, ElementFloat32, strings.Repeat("x", maxModelTagLen+1)); err == nil {
+		t.Error("TypedToBlob accepted a model tag longer than the maximum")
+	}
+	if _, err := TypedToBlob([]float32{1}, ElementBFloat16+1, ""); err == nil {
+		t.Error("TypedToBlob accepted an unknown element type")
+	}
+}
+
+func TestParseTypedBlob(t *testing.T) {
+	valid, _ := TypedToBlob([]float32{1, 2}, ElementFloat16, "m")
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"not typed", Float32ToBlob([]float32{1, 2})},
+		{"truncated header", valid[:5]},
+		{"truncated tag", []byte{0x05, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x09, 'a'}},
+		{"too few values", valid[:len(valid)-2]},
+		{"unknown type", append([]byte{0x05, 0x01, 0x07}, valid[3:]...)},
+	}
+	for _, tt := range tests {
+		if _, _, err := parseTypedBlob(tt.b); err == nil {
+			t.Errorf("%s: parseTypedBlob(%x) succeeded, want error", tt.name, tt.b)
+		}
+	}
+}
+
+func TestDecodeFloatsModels(t *testing.T) {
+	cfg := &config{name: "vector", dim: 2}
+	a, _ := TypedToBlob([]float32{1, 2}, ElementFloat32, "a")
+	b, _ := TypedToBlob([]float32{1, 2}, ElementBFloat16, "b")
+	_, modelA, err := cfg.decodeFloats(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, modelB, err := cfg.decodeFloats(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkModels(modelA, modelB); err == nil {
+		t.Error("checkModels accepted vectors from different models")
+	}
+	if err := checkModels(modelA, ""); err != nil {
+		t.Errorf("checkModels rejected an untagged vector: %v", err)
+	}
+
+	wrongDim, _ := TypedToBlob([]float32{1, 2, 3}, ElementFloat32, "a")
+	if _, _, err := cfg.decodeFloats(wrongDim); err == nil || !strings.Contains(err.Error(), "dimension 3") {
+		t.Errorf("decodeFloats(wrong dimension) error = %v", err)
+	}
+}
+
+func TestVectorInfo(t *testing.T) {
+	conn := openTestConn(t)
+	if err := Register(conn, 3, WithQuantRange(-1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT vector_info(vector_tag(vector_encode('[1,2,3]'), 'minilm-v2'))", `{"type":"float32","dim":3,"model":"minilm-v2"}`},
+		{"SELECT vector_info(vector_tag(vector_to_bf16(vector_encode('[1,2,3]')), 'm'))", `{"type":"bfloat16","dim":3,"model":"m"}`},
+		{"SELECT vector_info(vector_encode('[1,2,3]'))", `{"type":"float32","dim":3}`},
+		{"SELECT vector_info(vector_to_f16(vector_encode('[1,2,3]')))", `{"type":"float16","dim":3}`},
+		{"SELECT vector_info(vector_quantize(vector_encode('[1,2,3]')))", `{"type":"int8","dim":3}`},
+		{"SELECT vector_info(vector_quantize_binary(vector_encode('[1,2,3]')))", `{"type":"binary"}`},
+		{"SELECT vector_info(NULL) IS NULL", "1"},
+	}
+	for _, tt := range tests {
+		var got string
+		err := sqlitex.ExecuteTransient(conn, tt.query, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				got = stmt.ColumnText(0)
+				return nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestVectorDistanceTyped(t *testing.T) {
+	conn := openTestConn(t)
+	if err := Register(conn, 3); err != nil {
+		t.Fatal(err)
+	}
+	var dist float64
+	err := sqlitex.ExecuteTransient(conn,
+		"SELECT vector_distance(vector_tag(vector_encode('[1,2,3]'), 'm'), vector_encode('[1,2,5]'))",
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				dist = stmt.ColumnFloat(0)
+				return nil
+			},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dist != 4 {
+		t.Errorf("distance between typed and untagged vectors = %v, want 4", dist)
+	}
+}
@@ -7,8 +7,13 @@ import (
 	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math"
+	"strconv"
+	"strings"
+	"time"
 
 	"zombiezen.com/go/sqlite"
 )
@@ -24,12 +29,20 @@ type Chunker interface {
 }
 
 type config struct {
+	name         string
 	dim          int
 	quantMin     float32
 	quantMax     float32
 	quantEnabled bool
+	quantCal     *Calibration
+	quantCalID   uint32
+	metric       Metric
 	embedder     Embedder
 	chunker      Chunker
+
+	embedBatchSize int
+	embedTimeout   time.Duration
+	cache          *embedCache
 }
 
 // Option configures vector function registration.
@@ -55,39 +68,65 @@ func WithQuantRange(min, max float32) Option {
 	return func(c *config) {
 		c.quantMin = min
 		c.quantMax = max
+		c.quantCal = nil
 		c.quantEnabled = true
 	}
 }
 
 // Register registers all SQL functions on the given connection for vectors
-// of dimension dim. Returns an error if dim < 1.
+// of dimension dim. Returns an error if dim < 1. It is RegisterNamed with
+// the name "vector".
 func Register(conn *sqlite.Conn, dim int, opts ...Option) error {
+	return RegisterNamed(conn, "vector", dim, opts...)
+}
+
+// RegisterNamed registers all SQL functions for vectors of dimension dim
+// under the given name: every function and module that Register names
+// vector or vector_* is named name or name_* instead. Registrations under
+// different names coexist on one connection, so columns of different
+// dimensions can be queried together. Registering a name again replaces
+// its functions. Returns an error if dim < 1, name is not a valid SQL
+// identifier or an option is invalid.
+func RegisterNamed(conn *sqlite.Conn, name string, dim int, opts ...Option) error {
+	if !validName(name) {
+		return fmt.Errorf("vector: invalid name %q (want letters, digits and underscores, not starting with a digit)", name)
+	}
 	if dim < 1 {
 		return fmt.Errorf("vector: dimension must be >= 1, got %d", dim)
 	}
-	cfg := &config{dim: dim}
+	cfg := &config{name: name, dim: dim, embedBatchSize: defaultEmbedBatchSize}
 	for _, o := range opts {
 		o(cfg)
 	}
+	if !cfg.metric.valid() {
+		return fmt.Errorf("vector: unknown metric %v", cfg.metric)
+	}
+	if cfg.embedBatchSize < 1 {
+		return fmt.Errorf("vector: embed batch size must be >= 1, got %d", cfg.embedBatchSize)
+	}
+	if cfg.quantCal != nil {
+		if err := cfg.quantCal.validate(dim); err != nil {
+			return fmt.Errorf("vector: %v", err)
+		}
+		cfg.quantCalID = cfg.quantCal.id()
+	}
+	if cfg.quantEnabled && dim > maxQuantDim {
+		return fmt.Errorf("vector: quantization supports at most %d dimensions, got %d", maxQuantDim, dim)
+	}
 
-	err := conn.CreateFunction("vector_encode", &sqlite.FunctionImpl{
+	err := conn.CreateFunction(cfg.funcName("_encode"), &sqlite.FunctionImpl{
 		NArgs:         1,
 		Deterministic: true,
 		Scalar: func(ctx sqlite.Context, args []sqlite.Value) (sqlite.Value, error) {
 			if args[0].Type() == sqlite.TypeNull {
 				return sqlite.Value{}, nil
 			}
-			text := args[0].Text()
-			var nums []float64
-			if err := json.Unmarshal([]byte(text), &nums); err != nil {
-				return sqlite.Value{}, fmt.Errorf("vector_encode: invalid JSON: %v", err)
-			}
-			if len(nums) != cfg.dim {
-				return sqlite.Value{}, fmt.Errorf("vector_encode: expected dimension %d, got %d", cfg.dim, len(nums))
+			floats, err := parseJSONVector(args[0].Text())
+			if err != nil {
+				return sqlite.Value{}, fmt.Errorf("%s: %v", cfg.funcName("_encode"), err)
 			}
-			floats := make([]float32, len(nums))
-			for i, n := range nums {
-				floats[i] = float32(n)
+			if len(floats) != cfg.dim {
+				return sqlite.Value{}, fmt.Errorf("%s: expected dimension %d, got %d", cfg.funcName("_encode"), cfg.dim, len(floats))
 			}
 			return sqlite.BlobValue(Float32ToBlob(floats)), nil
 		},
@@ -96,35 +135,106 @@ func Register(conn *sqlite.Conn, dim int, opts ...Option) error {
 		return err
 	}
 
-	err = conn.CreateFunction("vector_distance", &sqlite.FunctionImpl{
-		NArgs:         2,
-		Deterministic: true,
-		Scalar: func(ctx sqlite.Context, args []sqlite.Value) (sqlite.Value, error) {
-			if args[0].Type() == sqlite.TypeNull || args[1].Type() == sqlite.TypeNull {
-				return sqlite.Value{}, nil
-			}
-			blobA := args[0].Blob()
-			blobB := args[1].Blob()
-			if isQuantizedBlob(blobA) || isQuantizedBlob(blobB) {
-				return sqlite.Value{}, fmt.Errorf("vector_distance: input is quantized, use vector_distance_q")
-			}
-			expected := cfg.dim * 4
-			if len(blobA) != expected {
-				return sqlite.Value{}, fmt.Errorf("vector_distance: expected %d bytes (dim=%d), got %d", expected, cfg.dim, len(blobA))
-			}
-			if len(blobB) != expected {
-				return sqlite.Value{}, fmt.Errorf("vector_distance: expected %d bytes (dim=%d), got %d", expected, cfg.dim, len(blobB))
+	for _, suffix := range []string{"_to_json", "_decode"} {
+		for _, nargs := range []int{1, 2} {
+			err = conn.CreateFunction(cfg.funcName(suffix), toJSONFunc(cfg.funcName(suffix), cfg, nargs))
+			if err != nil {
+				return err
 			}
-			a, _ := BlobToFloat32(blobA)
-			b, _ := BlobToFloat32(blobB)
-			return sqlite.FloatValue(l2Squared(a, b)), nil
-		},
-	})
+		}
+	}
+
+	err = conn.CreateFunction(cfg.funcName("_distance"), floatDistanceFunc(cfg.funcName("_distance"), cfg, cfg.metric.distance))
+	if err != nil {
+		return err
+	}
+
+	err = conn.CreateFunction(cfg.funcName("_distance_cosine"), floatDistanceFunc(cfg.funcName("_distance_cosine"), cfg, cosineDistance))
 	if err != nil {
 		return err
 	}
 
-	err = conn.CreateFunction("vector_quantize", &sqlite.FunctionImpl{
+	err = conn.CreateFunction(cfg.funcName("_distance_dot"), floatDistanceFunc(cfg.funcName("_distance_dot"), cfg, MetricDot.distance))
+	if err != nil {
+		return err
+	}
+
+	err = conn.CreateFunction(cfg.funcName("_add"), elementwiseFunc(cfg.funcName("_add"), cfg, func(x, y float32) float32 { return x + y }))
+	if err != nil {
+		return err
+	}
+
+	err = conn.CreateFunction(cfg.funcName("_sub"), elementwiseFunc(cfg.funcName("_sub"), cfg, func(x, y float32) float32 { return x - y }))
+	if err != nil {
+		return err
+	}
+
+	err = conn.CreateFunction(cfg.funcName("_scale"), scaleFunc(cfg))
+	if err != nil {
+		return err
+	}
+
+	err = conn.CreateFunction(cfg.funcName("_normalize"), normalizeFunc(cfg))
+	if err != nil {
+		return err
+	}
+
+	err = conn.CreateFunction(cfg.funcName("_norm"), normFunc(cfg))
+	if err != nil {
+		return err
+	}
+
+	err = conn.CreateFunction(cfg.funcName("_dot"), dotFunc(cfg))
+	if err != nil {
+		return err
+	}
+
+	err = conn.CreateFunction(cfg.funcName("_dims"), dimsFunc(cfg))
+	if err != nil {
+		return err
+	}
+
+	err = conn.CreateFunction(cfg.funcName("_sum"), vectorAggregateFunc(cfg.funcName("_sum"), cfg, aggregateSum))
+	if err != nil {
+		return err
+	}
+
+	err = conn.CreateFunction(cfg.funcName("_avg"), vectorAggregateFunc(cfg.funcName("_avg"), cfg, aggregateAvg))
+	if err != nil {
+		return err
+	}
+
+	err = conn.CreateFunction(cfg.funcName("_min"), vectorAggregateFunc(cfg.funcName("_min"), cfg, aggregateMin))
+	if err != nil {
+		return err
+	}
+
+	err = conn.CreateFunction(cfg.funcName("_max"), vectorAggregateFunc(cfg.funcName("_max"), cfg, aggregateMax))
+	if err != nil {
+		return err
+	}
+
+	err = conn.CreateFunction(cfg.funcName("_to_f16"), toHalfFunc(cfg.funcName("_to_f16"), cfg, formatFloat16))
+	if err != nil {
+		return err
+	}
+
+	err = conn.CreateFunction(cfg.funcName("_to_bf16"), toHalfFunc(cfg.funcName("_to_bf16"), cfg, formatBFloat16))
+	if err != nil {
+		return err
+	}
+
+	err = conn.CreateFunction(cfg.funcName("_tag"), vectorTagFunc(cfg))
+	if err != nil {
+		return err
+	}
+
+	err = conn.CreateFunction(cfg.funcName("_info"), vectorInfoFunc(cfg))
+	if err != nil {
+		return err
+	}
+
+	err = conn.CreateFunction(cfg.funcName("_quantize"), &sqlite.FunctionImpl{
 		NArgs:         1,
 		Deterministic: true,
 		Scalar: func(ctx sqlite.Context, args []sqlite.Value) (sqlite.Value, error) {
@@ -132,83 +242,82 @@ func Register(conn *sqlite.Conn, dim int, opts ...Option) error {
 				return sqlite.Value{}, nil
 			}
 			if !cfg.quantEnabled {
-				return sqlite.Value{}, fmt.Errorf("vector_quantize: quantization not configured, call Register with WithQuantRange")
+				return sqlite.Value{}, fmt.Errorf("%s: quantization not configured, call Register with WithQuantRange", cfg.funcName("_quantize"))
 			}
 			blob := args[0].Blob()
 			expected := cfg.dim * 4
 			if len(blob) != expected {
-				return sqlite.Value{}, fmt.Errorf("vector_quantize: expected %d bytes (dim=%d), got %d", expected, cfg.dim, len(blob))
+				return sqlite.Value{}, fmt.Errorf("%s: expected %d bytes (dim=%d), got %d", cfg.funcName("_quantize"), expected, cfg.dim, len(blob))
 			}
 			floats, _ := BlobToFloat32(blob)
-			return sqlite.BlobValue(quantize(floats, cfg.quantMin, cfg.quantMax)), nil
+			return sqlite.BlobValue(cfg.quantize(floats)), nil
 		},
 	})
 	if err != nil {
 		return err
 	}
 
-	err = conn.CreateFunction("vector_distance_q", &sqlite.FunctionImpl{
-		NArgs:         2,
-		Deterministic: true,
-		Scalar: func(ctx sqlite.Context, args []sqlite.Value) (sqlite.Value, error) {
-			if args[0].Type() == sqlite.TypeNull || args[1].Type() == sqlite.TypeNull {
-				return sqlite.Value{}, nil
-			}
-			if !cfg.quantEnabled {
-				return sqlite.Value{}, fmt.Errorf("vector_distance_q: quantization not configured, call Register with WithQuantRange")
-			}
-			blobA := args[0].Blob()
-			blobB := args[1].Blob()
-			if !isQuantizedBlob(blobA) {
-				return sqlite.Value{}, fmt.Errorf("vector_distance_q: input a is not quantized (missing magic bytes)")
-			}
-			if !isQuantizedBlob(blobB) {
-				return sqlite.Value{}, fmt.Errorf("vector_distance_q: input b is not quantized (missing magic bytes)")
-			}
-			expected := 2 + cfg.dim
-			if len(blobA) != expected {
-				return sqlite.Value{}, fmt.Errorf("vector_distance_q: expected %d bytes (dim=%d), got %d", expected, cfg.dim, len(blobA))
-			}
-			if len(blobB) != expected {
-				return sqlite.Value{}, fmt.Errorf("vector_distance_q: expected %d bytes (dim=%d), got %d", expected, cfg.dim, len(blobB))
-			}
-			a, _ := dequantize(blobA, cfg.quantMin, cfg.quantMax)
-			b, _ := dequantize(blobB, cfg.quantMin, cfg.quantMax)
-			return sqlite.FloatValue(l2Squared(a, b)), nil
-		},
-	})
+	for _, nargs := range []int{1, 2} {
+		err = conn.CreateFunction(cfg.funcName("_quant_calibrate"), &sqlite.FunctionImpl{
+			NArgs:         nargs,
+			Deterministic: true,
+			MakeAggregate: func(ctx sqlite.Context) (sqlite.AggregateFunction, error) {
+				return &calibrateAggregate{cfg: cfg}, nil
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = conn.CreateFunction(cfg.funcName("_distance_q"), quantDistanceFunc(cfg.funcName("_distance_q"), cfg, cfg.metric))
 	if err != nil {
 		return err
 	}
 
-	err = conn.CreateFunction("vector_embed", &sqlite.FunctionImpl{
-		NArgs:         1,
-		Deterministic: false,
-		Scalar: func(ctx sqlite.Context, args []sqlite.Value) (sqlite.Value, error) {
-			if args[0].Type() == sqlite.TypeNull {
-				return sqlite.Value{}, nil
-			}
-			if cfg.embedder == nil {
-				return sqlite.Value{}, fmt.Errorf("vector_embed: no embedder configured, call Register with WithEmbedder")
-			}
-			text := args[0].Text()
-			floats, err := cfg.embedder.Embed(context.Background(), text)
-			if err != nil {
-				return sqlite.Value{}, fmt.Errorf("vector_embed: %w", err)
-			}
-			if len(floats) != cfg.dim {
-				return sqlite.Value{}, fmt.Errorf("vector_embed: embedder returned dimension %d, expected %d", len(floats), cfg.dim)
-			}
-			return sqlite.BlobValue(Float32ToBlob(floats)), nil
-		},
-	})
+	err = conn.CreateFunction(cfg.funcName("_distance_cosine_q"), quantDistanceFunc(cfg.funcName("_distance_cosine_q"), cfg, MetricCosine))
+	if err != nil {
+		return err
+	}
+
+	err = conn.CreateFunction(cfg.funcName("_distance_dot_q"), quantDistanceFunc(cfg.funcName("_distance_dot_q"), cfg, MetricDot))
+	if err != nil {
+		return err
+	}
+
+	err = conn.CreateFunction(cfg.funcName("_distance_aq"), asymDistanceFunc(cfg.funcName("_distance_aq"), cfg, cfg.metric))
+	if err != nil {
+		return err
+	}
+
+	err = conn.CreateFunction(cfg.funcName("_quantize_binary"), quantizeBinaryFunc(cfg))
+	if err != nil {
+		return err
+	}
+
+	err = conn.CreateFunction(cfg.funcName("_distance_hamming"), hammingDistanceFunc(cfg))
+	if err != nil {
+		return err
+	}
+
+	err = conn.CreateFunction(cfg.funcName("_pq_encode"), pqEncodeFunc(cfg))
+	if err != nil {
+		return err
+	}
+
+	err = conn.CreateFunction(cfg.funcName("_distance_pq"), pqDistanceFunc(cfg))
+	if err != nil {
+		return err
+	}
+
+	err = conn.CreateFunction(cfg.funcName("_embed"), embedFunc(cfg))
 	if err != nil {
 		return err
 	}
 
-	err = conn.SetModule("vector_chunk", &sqlite.Module{
+	err = conn.SetModule(cfg.funcName("_chunk"), &sqlite.Module{
 		Connect: func(c *sqlite.Conn, opts *sqlite.VTableConnectOptions) (sqlite.VTable, *sqlite.VTableConfig, error) {
-			return &chunkVTable{chunker: cfg.chunker}, &sqlite.VTableConfig{
+			return &chunkVTable{name: cfg.funcName("_chunk"), chunker: cfg.chunker}, &sqlite.VTableConfig{
 				Declaration: "CREATE TABLE x(value TEXT, chunk_index INTEGER, text TEXT HIDDEN)",
 			}, nil
 		},
@@ -217,9 +326,43 @@ func Register(conn *sqlite.Conn, dim int, opts ...Option) error {
 		return err
 	}
 
+	err = conn.SetModule(cfg.funcName(""), vecModule(cfg))
+	if err != nil {
+		return err
+	}
+
+	tableFuncs := append(ivfFuncs(conn, cfg), pqTrainFunc(conn, cfg), topKFunc(conn, cfg), withinFunc(conn, cfg), hybridFunc(conn, cfg), mmrFunc(conn, cfg), embedBatchFunc(conn, cfg))
+	tableFuncs = append(tableFuncs, cacheFuncs(conn, cfg)...)
+	for _, tf := range tableFuncs {
+		if err := conn.SetModule(tf.name, tf.module()); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// funcName returns the SQL name of the function or module that Register
+// names "vector" + suffix.
+func (cfg *config) funcName(suffix string) string {
+	return cfg.name + suffix
+}
+
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		switch {
+		case r == '_', r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		case r >= '0' && r <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 // Float32ToBlob converts a []float32 to a little-endian byte slice suitable
 // for storage as a SQLite blob.
 func Float32ToBlob(v []float32) []byte {
@@ -237,12 +380,130 @@ func BlobToFloat32(b []byte) ([]float32, error) {
 		return nil, fmt.Errorf("blob length %d is not a multiple of 4", len(b))
 	}
 	v := make([]float32, len(b)/4)
-	for i := range v {
-		v[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[i*4:]))
-	}
+	decodeFloat32(v, b)
 	return v, nil
 }
 
+// Float16ToBlob converts v to a float16 blob: a two-byte header followed by
+// IEEE 754 half-precision values, little-endian. Values are rounded to
+// nearest even; those beyond ±65504 become infinities.
+func Float16ToBlob(v []float32) []byte {
+	return encodeHalf(formatFloat16, v)
+}
+
+// BlobToFloat16 converts a float16 blob back to []float32. Returns an error
+// if b does not have the float16 header.
+func BlobToFloat16(b []byte) ([]float32, error) {
+	return decodeHalf(formatFloat16, b)
+}
+
+// BFloat16ToBlob converts v to a bfloat16 blob: a two-byte header followed
+// by the upper 16 bits of each float32, rounded to nearest even,
+// little-endian.
+func BFloat16ToBlob(v []float32) []byte {
+	return encodeHalf(formatBFloat16, v)
+}
+
+// BlobToBFloat16 converts a bfloat16 blob back to []float32. Returns an
+// error if b does not have the bfloat16 header.
+func BlobToBFloat16(b []byte) ([]float32, error) {
+	return decodeHalf(formatBFloat16, b)
+}
+
+// decodeFloat32 decodes little-endian float32 values from b into dst
+// without allocating.
+func decodeFloat32(dst []float32, b []byte) {
+	for i := range dst {
+		dst[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[i*4:]))
+	}
+}
+
+// parseJSONVector parses a JSON array of numbers into a []float32.
+func parseJSONVector(text string) ([]float32, error) {
+	// Numbers are rounded straight to float32, not through float64, so
+	// formatJSONVector's shortest float32 representation parses back to
+	// exactly the same value.
+	dec := json.NewDecoder(strings.NewReader(text))
+	dec.UseNumber()
+	var vals []any
+	if err := dec.Decode(&vals); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("invalid JSON: unexpected data after array")
+	}
+	floats := make([]float32, len(vals))
+	for i, val := range vals {
+		n, ok := val.(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("invalid JSON: element %d is not a number", i)
+		}
+		f, err := strconv.ParseFloat(string(n), 32)
+		if err != nil && !errors.Is(err, strconv.ErrRange) {
+			return nil, fmt.Errorf("invalid JSON: %v", err)
+		}
+		floats[i] = float32(f)
+	}
+	return floats, nil
+}
+
+// formatJSONVector formats v as a JSON array. A negative precision uses the
+// shortest representation that parseJSONVector reads back as the same
+// float32; otherwise each value has precision digits after the decimal
+// point.
+func formatJSONVector(v []float32, precision int) (string, error) {
+	b := make([]byte, 0, len(v)*10+2)
+	b = append(b, '[')
+	for i, f := range v {
+		if math.IsNaN(float64(f)) || math.IsInf(float64(f), 0) {
+			return "", fmt.Errorf("value %d is %v, which JSON cannot represent", i, f)
+		}
+		if i > 0 {
+			b = append(b, ',')
+		}
+		if precision < 0 {
+			b = strconv.AppendFloat(b, float64(f), 'g', -1, 32)
+		} else {
+			b = strconv.AppendFloat(b, float64(f), 'f', precision, 32)
+		}
+	}
+	b = append(b, ']')
+	return string(b), nil
+}
+
+// toJSONFunc returns a SQL function named name that formats a vector of any
+// format decodeVector accepts as JSON, with an optional precision.
+func toJSONFunc(name string, cfg *config, nargs int) *sqlite.FunctionImpl {
+	return &sqlite.FunctionImpl{
+		NArgs:         nargs,
+		Deterministic: true,
+		Scalar: func(ctx sqlite.Context, args []sqlite.Value) (sqlite.Value, error) {
+			if args[0].Type() == sqlite.TypeNull {
+				return sqlite.Value{}, nil
+			}
+			precision := -1
+			if len(args) > 1 && args[1].Type() != sqlite.TypeNull {
+				if precision = args[1].Int(); precision < 0 || precision > maxJSONPrecision {
+					return sqlite.Value{}, fmt.Errorf("%s: precision must be between 0 and %d, got %d", name, maxJSONPrecision, precision)
+				}
+			}
+			v, err := cfg.decodeVector(args[0].Blob())
+			if err != nil {
+				return sqlite.Value{}, fmt.Errorf("%s: %v", name, err)
+			}
+			text, err := formatJSONVector(v, precision)
+			if err != nil {
+				return sqlite.Value{}, fmt.Errorf("%s: %v", name, err)
+			}
+			return sqlite.TextValue(text), nil
+		},
+	}
+}
+
+// maxJSONPrecision bounds the precision argument of vector_to_json. The
+// smallest float32 has 45 digits after the decimal point.
+const maxJSONPrecision = 50
+
 func l2Squared(a, b []float32) float64 {
 	var sum float64
 	for i := range a {
@@ -252,40 +513,121 @@ func l2Squared(a, b []float32) float64 {
 	return sum
 }
 
+// Format identifiers stored in byte 0 of every blob with a header. Byte 1
+// is the format version. Float32 blobs have no header.
+const (
+	formatInt8   = 0x00
+	formatPQ     = 0x01
+	formatBinary = 0x02
+
+	formatFloat16  = 0x03
+	formatBFloat16 = 0x04
+	formatTyped    = 0x05
+)
+
+// isQuantizedBlob reports whether b has an int8-quantized header of either
+// version.
 func isQuantizedBlob(b []byte) bool {
-	return len(b) >= 2 && b[0] == 0x00 && b[1] == 0x01
+	return len(b) >= 2 && b[0] == formatInt8 && (b[1] == quantVersion1 || b[1] == quantVersion2)
+}
+
+// blobFormatName names the format of a blob with a header, for errors that
+// reject it. It returns "" for blobs without a recognized header.
+func blobFormatName(b []byte) string {
+	switch {
+	case isQuantizedBlob(b):
+		return "int8-quantized"
+	case isPQBlob(b):
+		return "PQ-encoded"
+	case isBinaryBlob(b):
+		return "binary-quantized"
+	}
+	if f, ok := halfFormat(b); ok {
+		return halfName(f)
+	}
+	if isTypedBlob(b) {
+		return "a typed vector"
+	}
+	return ""
 }
 
-func quantize(v []float32, min, max float32) []byte {
-	b := make([]byte, 2+len(v))
-	b[0] = 0x00
-	b[1] = 0x01
+// quantizeValue maps f from [min, max] onto an int8, clamping values
+// outside the range. An empty range maps everything to -128, which
+// dequantizes to min.
+func quantizeValue(f, min, max float32) byte {
 	r := max - min
-	for i, f := range v {
-		normalized := (f - min) / r * 255
-		q := math.Round(float64(normalized)) - 128
-		if q < -128 {
-			q = -128
-		} else if q > 127 {
-			q = 127
-		}
-		b[2+i] = byte(int8(q))
+	if r <= 0 {
+		return byte(0x80)
 	}
-	return b
+	normalized := (f - min) / r * 255
+	q := math.Round(float64(normalized)) - 128
+	if q < -128 {
+		q = -128
+	} else if q > 127 {
+		q = 127
+	}
+	return byte(int8(q))
 }
 
-func dequantize(b []byte, min, max float32) ([]float32, error) {
-	if len(b) < 2 || b[0] != 0x00 || b[1] != 0x01 {
-		return nil, fmt.Errorf("dequantize: missing quantized format magic bytes")
+func dequantizeValue(raw byte, min, max float32) float32 {
+	q := int8(raw)
+	return float32((float64(q)+128)/255*float64(max-min) + float64(min))
+}
+
+// decodeFloats decodes a float32, float16, bfloat16 or typed blob of the
+// configured dimension and returns its model tag, which is empty for all but
+// typed blobs. The float32 length is checked first, as for every float32
+// input.
+func (cfg *config) decodeFloats(b []byte) ([]float32, string, error) {
+	if len(b) == cfg.dim*4 {
+		v, _ := BlobToFloat32(b)
+		return v, "", nil
 	}
-	data := b[2:]
-	r := float64(max - min)
-	v := make([]float32, len(data))
-	for i, raw := range data {
-		q := int8(raw)
-		v[i] = float32((float64(q)+128)/255*r + float64(min))
+	if f, ok := halfFormat(b); ok {
+		if len(b) != halfLen(cfg.dim) {
+			return nil, "", fmt.Errorf("expected %d bytes for %s (dim=%d), got %d", halfLen(cfg.dim), halfName(f), cfg.dim, len(b))
+		}
+		v := make([]float32, cfg.dim)
+		decodeHalfInto(v, f, b[2:])
+		return v, "", nil
 	}
-	return v, nil
+	if isTypedBlob(b) {
+		info, data, err := parseTypedBlob(b)
+		if err != nil {
+			return nil, "", err
+		}
+		if info.Dim != cfg.dim {
+			return nil, "", fmt.Errorf("typed vector has dimension %d, expected %d", info.Dim, cfg.dim)
+		}
+		v := make([]float32, cfg.dim)
+		decodeTyped(v, info.Type, data)
+		return v, info.Model, nil
+	}
+	if f := blobFormatName(b); f != "" {
+		return nil, "", fmt.Errorf("input is %s, expected float32", f)
+	}
+	return nil, "", fmt.Errorf("expected %d bytes (dim=%d), got %d", cfg.dim*4, cfg.dim, len(b))
+}
+
+// decodeVector decodes any float blob accepted by decodeFloats or, when
+// quantization is configured, a quantized blob of the configured dimension.
+// No quantized blob has the length of a float32 blob of the same dimension.
+func (cfg *config) decodeVector(b []byte) ([]float32, error) {
+	v, _, err := cfg.decodeTagged(b)
+	return v, err
+}
+
+// decodeTagged is decodeVector that also returns the model tag of a typed
+// blob, or "" for any other format.
+func (cfg *config) decodeTagged(b []byte) ([]float32, string, error) {
+	if isQuantizedBlob(b) && len(b) != cfg.dim*4 {
+		if !cfg.quantEnabled {
+			return nil, "", fmt.Errorf("quantized input requires Register with WithQuantRange or WithQuantCalibration")
+		}
+		v, err := cfg.dequantize(b)
+		return v, "", err
+	}
+	return cfg.decodeFloats(b)
 }
 
 const chunkColValue = 0
@@ -293,6 +635,7 @@ const chunkColIndex = 1
 const chunkColText = 2
 
 type chunkVTable struct {
+	name    string
 	chunker Chunker
 }
 
@@ -333,7 +676,7 @@ type chunkCursor struct {
 
 func (cur *chunkCursor) Filter(id sqlite.IndexID, argv []sqlite.Value) error {
 	if cur.vtab.chunker == nil {
-		return fmt.Errorf("vector_chunk: no chunker configured, call Register with WithChunker")
+		return fmt.Errorf("%s: no chunker configured, call Register with WithChunker", cur.vtab.name)
 	}
 	cur.chunks = nil
 	cur.pos = 0
@@ -343,7 +686,7 @@ func (cur *chunkCursor) Filter(id sqlite.IndexID, argv []sqlite.Value) error {
 	text := argv[0].Text()
 	chunks, err := cur.vtab.chunker.Chunk(text)
 	if err != nil {
-		return fmt.Errorf("vector_chunk: %w", err)
+		return fmt.Errorf("%s: %w", cur.vtab.name, err)
 	}
 	cur.chunks = chunks
 	return nil
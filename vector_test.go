@@ -5,6 +5,9 @@ import (
 	"context"
 	"errors"
 	"io"
+	"math"
+	"math/rand"
+	"slices"
 	"testing"
 
 	"zombiezen.com/go/sqlite"
@@ -370,6 +373,11 @@ func TestIsQuantizedBlob(t *testing.T) {
 			b:    []byte{0x00, 0x01, 0x7f, 0x80},
 			want: true,
 		},
+		{
+			name: "version 2 blob",
+			b:    []byte{0x00, 0x02, 0x00, 0x01, 0x00, 0, 0, 0, 0, 0, 0, 0, 0, 0x7f},
+			want: true,
+		},
 		{
 			name: "wrong version byte",
 			b:    []byte{0x00, 0x00, 0x7f},
@@ -626,11 +634,11 @@ func TestVectorQuantize(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		if len(blob) != 5 {
-			t.Fatalf("blob length = %d, want 5", len(blob))
+		if len(blob) != 16 {
+			t.Fatalf("blob length = %d, want 16", len(blob))
 		}
-		if blob[0] != 0x00 || blob[1] != 0x01 {
-			t.Fatalf("magic bytes = [%#x, %#x], want [0x00, 0x01]", blob[0], blob[1])
+		if blob[0] != 0x00 || blob[1] != 0x02 {
+			t.Fatalf("magic bytes = [%#x, %#x], want [0x00, 0x02]", blob[0], blob[1])
 		}
 	})
 
@@ -708,14 +716,14 @@ func TestVectorQuantize(t *testing.T) {
 			t.Fatal(err)
 		}
 		// Values should be clamped, not error
-		if len(blob) != 5 {
-			t.Fatalf("blob length = %d, want 5", len(blob))
+		if len(blob) != 16 {
+			t.Fatalf("blob length = %d, want 16", len(blob))
 		}
-		if int8(blob[2]) != 127 {
-			t.Errorf("clamped 5.0 = %d, want 127", int8(blob[2]))
+		if int8(blob[13]) != 127 {
+			t.Errorf("clamped 5.0 = %d, want 127", int8(blob[13]))
 		}
-		if int8(blob[3]) != -128 {
-			t.Errorf("clamped -5.0 = %d, want -128", int8(blob[3]))
+		if int8(blob[14]) != -128 {
+			t.Errorf("clamped -5.0 = %d, want -128", int8(blob[14]))
 		}
 	})
 }
@@ -1008,6 +1016,56 @@ func TestE2ERegisterOverwrite(t *testing.T) {
 	}
 }
 
+func TestRegisterNamed(t *testing.T) {
+	conn := openTestConn(t)
+	if err := Register(conn, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterNamed(conn, "title", 2, WithMetric(MetricDot)); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterNamed(conn, "body", 4, WithQuantRange(-1, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each registration keeps its own dimension and options.
+	tests := []struct {
+		query string
+		want  float64
+	}{
+		{"SELECT vector_distance(vector_encode('[1,2,3]'), vector_encode('[1,2,5]'))", 4},
+		{"SELECT title_distance(title_encode('[1,2]'), title_encode('[3,4]'))", -11},
+		{"SELECT body_distance(body_encode('[1,0,0,0]'), body_encode('[0,0,0,0]'))", 1},
+		{"SELECT length(body_quantize(body_encode('[1,0,0,0]')))", 17},
+	}
+	for _, tt := range tests {
+		var got float64
+		err := sqlitex.ExecuteTransient(conn, tt.query, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				got = stmt.ColumnFloat(0)
+				return nil
+			},
+		})
+		if err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	if err := sqlitex.ExecuteTransient(conn, "CREATE VIRTUAL TABLE docs USING title(embedding float[2])", nil); err != nil {
+		t.Errorf("virtual table module under the registered name: %v", err)
+	}
+
+	for _, name := range []string{"", "1st", "body-text", "body text"} {
+		if err := RegisterNamed(conn, name, 3); err == nil {
+			t.Errorf("RegisterNamed(%q) succeeded, want error", name)
+		}
+	}
+}
+
 func TestE2EFloat32ToBlobWithBinding(t *testing.T) {
 	conn := openTestConn(t)
 	if err := Register(conn, 3); err != nil {
@@ -1361,3 +1419,73 @@ func TestE2EVectorChunkWithEmbed(t *testing.T) {
 		t.Errorf("nearest = %q, want 'part one' or 'part two'", nearest)
 	}
 }
+
+func TestFormatJSONVector(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	v := []float32{0, 1, -1, 0.1, math.MaxFloat32, math.SmallestNonzeroFloat32, -1e-20}
+	for i := 0; i < 1000; i++ {
+		v = append(v, math.Float32frombits(rng.Uint32()))
+	}
+	v = slices.DeleteFunc(v, func(f float32) bool { return math.IsNaN(float64(f)) || math.IsInf(float64(f), 0) })
+
+	text, err := formatJSONVector(v, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseJSONVector(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(Float32ToBlob(got), Float32ToBlob(v)) {
+		t.Error("parseJSONVector(formatJSONVector(v)) != v")
+	}
+
+	if text, _ := formatJSONVector([]float32{0.123456, -2}, 2); text != "[0.12,-2.00]" {
+		t.Errorf("formatJSONVector with precision 2 = %s, want [0.12,-2.00]", text)
+	}
+	if _, err := formatJSONVector([]float32{float32(math.Inf(1))}, -1); err == nil {
+		t.Error("formatJSONVector accepted infinity")
+	}
+}
+
+func TestParseJSONVectorRejects(t *testing.T) {
+	for _, text := range []string{`["1.5"]`, `[1, true]`, `[1] [2]`, `{"a": 1}`, `[1,`} {
+		if _, err := parseJSONVector(text); err == nil {
+			t.Errorf("parseJSONVector(%s) succeeded, want error", text)
+		}
+	}
+}
+
+func TestVectorToJSON(t *testing.T) {
+	conn := openTestConn(t)
+	if err := Register(conn, 3, WithQuantRange(-1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT vector_to_json(vector_encode('[0.1, -2.5, 3]'))", "[0.1,-2.5,3]"},
+		{"SELECT vector_decode(vector_encode('[0.1, -2.5, 3]'))", "[0.1,-2.5,3]"},
+		{"SELECT vector_to_json(vector_encode('[0.123456, 1, 2]'), 3)", "[0.123,1.000,2.000]"},
+		{"SELECT vector_to_json(vector_quantize(vector_encode('[-1, 1, 0.5]')), 2)", "[-1.00,1.00,0.50]"},
+		{"SELECT vector_to_json(vector_to_f16(vector_encode('[0.5, 1, 2]')))", "[0.5,1,2]"},
+		{"SELECT vector_encode(vector_to_json(vector_encode('[0.1, 0.2, 0.3]'))) = vector_encode('[0.1, 0.2, 0.3]')", "1"},
+		{"SELECT vector_to_json(NULL) IS NULL", "1"},
+	}
+	for _, tt := range tests {
+		var got string
+		err := sqlitex.ExecuteTransient(conn, tt.query, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				got = stmt.ColumnText(0)
+				return nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.query, got, tt.want)
+		}
+	}
+}
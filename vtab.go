@@ -0,0 +1,876 @@
+package vector
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// The vector module stores rows in a shadow table named "<table>_rows" and
+// answers k-nearest-neighbor queries of the form
+//
+//	SELECT rowid, distance FROM docs WHERE embedding MATCH ? AND k = 10
+//
+// Declared columns are the vector column, any auxiliary columns, and the
+// hidden columns distance, k and ef_search. Tables declared with index=hnsw
+// also maintain an HNSW graph (see hnsw.go) that k-NN queries search instead
+// of scanning every row.
+
+const (
+	vecPlanScan  = 0
+	vecPlanRowID = 1
+	vecPlanKNN   = 2
+	// vecPlanKNNNoLimit is a k-NN plan with no k constraint whose LIMIT
+	// SQLite withheld because other WHERE terms on the table remain. It
+	// only exists to explain that in Filter's error.
+	vecPlanKNNNoLimit = 3
+)
+
+var vecColumnPattern = regexp.MustCompile(`(?i)^([A-Za-z_][A-Za-z0-9_]*)\s+float(?:32)?\[(\d+)\]$`)
+var vecOptionPattern = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)\s*=\s*(.*)$`)
+var vecAuxPattern = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)(?:\s+(.*))?$`)
+
+type vecAuxColumn struct {
+	name string
+	typ  string
+}
+
+type vecTableSpec struct {
+	column string
+	dim    int
+	metric Metric
+	aux    []vecAuxColumn
+	index  string
+	hnsw   hnswParams
+}
+
+// parseVecTableArgs parses the arguments of a CREATE VIRTUAL TABLE ... USING
+// vector(...) statement. Exactly one "name float[dim]" column is required;
+// "key=value" arguments are options and anything else is an auxiliary column.
+func parseVecTableArgs(args []string, defaultMetric Metric) (*vecTableSpec, error) {
+	spec := &vecTableSpec{
+		metric: defaultMetric,
+		hnsw: hnswParams{
+			m:              defaultHNSWM,
+			efConstruction: defaultHNSWEfConstruction,
+			efSearch:       defaultHNSWEfSearch,
+		},
+	}
+	seen := map[string]bool{"distance": true, "k": true, "ef_search": true}
+	hnswOptions := false
+	for _, arg := range args {
+		arg = strings.TrimSpace(arg)
+		if m := vecColumnPattern.FindStringSubmatch(arg); m != nil {
+			if spec.column != "" {
+				return nil, fmt.Errorf("vector: only one vector column is supported, got %q and %q", spec.column, m[1])
+			}
+			dim, err := strconv.Atoi(m[2])
+			if err != nil || dim < 1 {
+				return nil, fmt.Errorf("vector: dimension must be >= 1, got %s", m[2])
+			}
+			spec.column = m[1]
+			spec.dim = dim
+			seen[strings.ToLower(m[1])] = true
+			continue
+		}
+		if m := vecOptionPattern.FindStringSubmatch(arg); m != nil {
+			key := strings.ToLower(m[1])
+			if err := spec.setOption(key, unquoteOption(m[2])); err != nil {
+				return nil, err
+			}
+			hnswOptions = hnswOptions || key == "m" || key == "ef_construction" || key == "ef_search"
+			continue
+		}
+		m := vecAuxPattern.FindStringSubmatch(arg)
+		if m == nil {
+			return nil, fmt.Errorf("vector: invalid column definition %q", arg)
+		}
+		if seen[strings.ToLower(m[1])] {
+			return nil, fmt.Errorf("vector: duplicate or reserved column name %q", m[1])
+		}
+		seen[strings.ToLower(m[1])] = true
+		spec.aux = append(spec.aux, vecAuxColumn{name: m[1], typ: m[2]})
+	}
+	if spec.column == "" {
+		return nil, fmt.Errorf("vector: missing vector column, declare one as \"name float[dim]\"")
+	}
+	if hnswOptions && spec.index != "hnsw" {
+		return nil, fmt.Errorf("vector: options m, ef_construction and ef_search require index=hnsw")
+	}
+	return spec, nil
+}
+
+func (spec *vecTableSpec) setOption(key, value string) error {
+	switch key {
+	case "distance_metric":
+		m, err := parseMetric(value)
+		if err != nil {
+			return fmt.Errorf("vector: %v", err)
+		}
+		spec.metric = m
+	case "index":
+		switch strings.ToLower(value) {
+		case "hnsw":
+			spec.index = "hnsw"
+		case "none", "":
+			spec.index = ""
+		default:
+			return fmt.Errorf("vector: unknown index %q (want hnsw)", value)
+		}
+	case "m":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 2 {
+			return fmt.Errorf("vector: m must be an integer >= 2, got %q", value)
+		}
+		spec.hnsw.m = n
+	case "ef_construction":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("vector: ef_construction must be an integer >= 1, got %q", value)
+		}
+		spec.hnsw.efConstruction = n
+	case "ef_search":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("vector: ef_search must be an integer >= 1, got %q", value)
+		}
+		spec.hnsw.efSearch = n
+	default:
+		return fmt.Errorf("vector: unknown option %q", key)
+	}
+	return nil
+}
+
+func unquoteOption(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && (s[0] == '\'' || s[0] == '"') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+func parseMetric(s string) (Metric, error) {
+	switch strings.ToLower(s) {
+	case "l2":
+		return MetricL2, nil
+	case "cosine":
+		return MetricCosine, nil
+	case "dot":
+		return MetricDot, nil
+	default:
+		return 0, fmt.Errorf("unknown distance metric %q (want l2, cosine or dot)", s)
+	}
+}
+
+// quoteIdent quotes s for use as an SQL identifier.
+func quoteIdent(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+func vecModule(cfg *config) *sqlite.Module {
+	connect := func(create bool) sqlite.VTableConnectFunc {
+		return func(c *sqlite.Conn, opts *sqlite.VTableConnectOptions) (sqlite.VTable, *sqlite.VTableConfig, error) {
+			spec, err := parseVecTableArgs(opts.Args, cfg.metric)
+			if err != nil {
+				return nil, nil, err
+			}
+			vt := &vecTable{conn: c, schema: opts.DatabaseName, name: opts.VTableName, spec: spec}
+			if create {
+				if err := vt.createShadowTables(); err != nil {
+					return nil, nil, err
+				}
+			}
+			return vt, &sqlite.VTableConfig{Declaration: vt.declaration()}, nil
+		}
+	}
+	return &sqlite.Module{
+		Create:  connect(true),
+		Connect: connect(false),
+	}
+}
+
+type vecTable struct {
+	conn   *sqlite.Conn
+	schema string
+	name   string
+	spec   *vecTableSpec
+}
+
+func (vt *vecTable) distanceColumn() int { return len(vt.spec.aux) + 1 }
+func (vt *vecTable) kColumn() int        { return len(vt.spec.aux) + 2 }
+func (vt *vecTable) efSearchColumn() int { return len(vt.spec.aux) + 3 }
+
+func (vt *vecTable) declaration() string {
+	var sb strings.Builder
+	sb.WriteString("CREATE TABLE x(")
+	sb.WriteString(quoteIdent(vt.spec.column))
+	sb.WriteString(" BLOB")
+	for _, col := range vt.spec.aux {
+		sb.WriteString(", ")
+		sb.WriteString(quoteIdent(col.name))
+		if col.typ != "" {
+			sb.WriteString(" ")
+			sb.WriteString(col.typ)
+		}
+	}
+	sb.WriteString(", distance REAL HIDDEN, k INTEGER HIDDEN, ef_search INTEGER HIDDEN)")
+	return sb.String()
+}
+
+func (vt *vecTable) shadowName(suffix string) string {
+	return quoteIdent(vt.schema) + "." + quoteIdent(vt.name+suffix)
+}
+
+func (vt *vecTable) rowsTable() string { return vt.shadowName("_rows") }
+
+// shadowSuffixes lists the suffixes of every shadow table owned by vt.
+func (vt *vecTable) shadowSuffixes() []string {
+	suffixes := []string{"_rows"}
+	if vt.spec.index == "hnsw" {
+		suffixes = append(suffixes, "_hnsw_edges", "_hnsw_meta")
+	}
+	return suffixes
+}
+
+// selectColumns returns the shadow table column list in declaration order,
+// preceded by the row ID.
+func (vt *vecTable) selectColumns() string {
+	cols := []string{"id", quoteIdent(vt.spec.column)}
+	for _, col := range vt.spec.aux {
+		cols = append(cols, quoteIdent(col.name))
+	}
+	return strings.Join(cols, ", ")
+}
+
+func (vt *vecTable) createShadowTables() error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "CREATE TABLE %s (id INTEGER PRIMARY KEY, %s BLOB NOT NULL", vt.rowsTable(), quoteIdent(vt.spec.column))
+	for _, col := range vt.spec.aux {
+		sb.WriteString(", ")
+		sb.WriteString(quoteIdent(col.name))
+		if col.typ != "" {
+			sb.WriteString(" ")
+			sb.WriteString(col.typ)
+		}
+	}
+	sb.WriteString(")")
+	if err := sqlitex.ExecuteTransient(vt.conn, sb.String(), nil); err != nil {
+		return fmt.Errorf("vector: create shadow table: %w", err)
+	}
+	if vt.spec.index == "hnsw" {
+		return vt.createHNSWTables()
+	}
+	return nil
+}
+
+// BestIndex picks a k-NN plan when the vector column has a MATCH
+// constraint. The plan's IndexID.String lists the meaning of each argv
+// entry: 'q' query vector, 'k' k constraint, 'l' LIMIT, 'o' OFFSET,
+// 'e' ef_search.
+//
+// SQLite passes LIMIT and OFFSET only when the table is the sole source of
+// rows and every other WHERE term is a constraint on it, and drops them
+// again unless every constraint before them is given an argv entry. The
+// OFFSET is therefore always consumed along with the LIMIT.
+func (vt *vecTable) BestIndex(inputs *sqlite.IndexInputs) (*sqlite.IndexOutputs, error) {
+	matchIdx, kIdx, limitIdx, offsetIdx, efIdx, rowIDIdx := -1, -1, -1, -1, -1, -1
+	others := 0
+	for i, c := range inputs.Constraints {
+		if !c.Usable {
+			others++
+			continue
+		}
+		switch {
+		case c.Op == sqlite.IndexConstraintMatch && c.Column == 0:
+			matchIdx = i
+		case c.Op == sqlite.IndexConstraintEq && c.Column == vt.kColumn():
+			kIdx = i
+		case c.Op == sqlite.IndexConstraintEq && c.Column == vt.efSearchColumn():
+			efIdx = i
+		case c.Op == sqlite.IndexConstraintLimit:
+			limitIdx = i
+		case c.Op == sqlite.IndexConstraintOffset:
+			offsetIdx = i
+		default:
+			if c.Op == sqlite.IndexConstraintEq && c.Column == -1 {
+				rowIDIdx = i
+			}
+			others++
+		}
+	}
+	usage := make([]sqlite.IndexConstraintUsage, len(inputs.Constraints))
+	outputs := &sqlite.IndexOutputs{
+		ConstraintUsage: usage,
+		ID:              sqlite.IndexID{Num: vecPlanScan},
+		EstimatedCost:   1e12,
+		EstimatedRows:   1e6,
+	}
+	switch {
+	case matchIdx >= 0:
+		var args []byte
+		use := func(i int, code byte, omit bool) {
+			args = append(args, code)
+			usage[i] = sqlite.IndexConstraintUsage{ArgvIndex: len(args), Omit: omit}
+		}
+		use(matchIdx, 'q', true)
+		plan := sqlite.IndexID{Num: vecPlanKNN}
+		switch {
+		case kIdx >= 0:
+			use(kIdx, 'k', true)
+		case limitIdx >= 0:
+			if offsetIdx >= 0 {
+				use(offsetIdx, 'o', false)
+			}
+			use(limitIdx, 'l', false)
+		case others > 0:
+			plan.Num = vecPlanKNNNoLimit
+		}
+		if efIdx >= 0 {
+			use(efIdx, 'e', true)
+		}
+		plan.String = string(args)
+		outputs.ID = plan
+		outputs.EstimatedCost = 1e6
+		if vt.spec.index == "hnsw" {
+			outputs.EstimatedCost = 1e3
+		}
+		outputs.EstimatedRows = 10
+		if len(inputs.OrderBy) == 1 && inputs.OrderBy[0].Column == vt.distanceColumn() && !inputs.OrderBy[0].Desc {
+			outputs.OrderByConsumed = true
+		}
+	case rowIDIdx >= 0:
+		usage[rowIDIdx] = sqlite.IndexConstraintUsage{ArgvIndex: 1, Omit: true}
+		outputs.ID = sqlite.IndexID{Num: vecPlanRowID}
+		outputs.EstimatedCost = 1
+		outputs.EstimatedRows = 1
+		outputs.IndexFlags = sqlite.IndexScanUnique
+	}
+	return outputs, nil
+}
+
+func (vt *vecTable) Open() (sqlite.VTableCursor, error) {
+	return &vecCursor{vtab: vt}, nil
+}
+
+func (vt *vecTable) Disconnect() error { return nil }
+
+func (vt *vecTable) Destroy() error {
+	for _, suffix := range vt.shadowSuffixes() {
+		err := sqlitex.ExecuteTransient(vt.conn, "DROP TABLE IF EXISTS "+vt.shadowName(suffix), nil)
+		if err != nil {
+			return fmt.Errorf("vector: drop shadow table: %w", err)
+		}
+	}
+	return nil
+}
+
+func (vt *vecTable) Rename(newName string) error {
+	for _, suffix := range vt.shadowSuffixes() {
+		err := sqlitex.ExecuteTransient(vt.conn,
+			fmt.Sprintf("ALTER TABLE %s RENAME TO %s", vt.shadowName(suffix), quoteIdent(newName+suffix)), nil)
+		if err != nil {
+			return fmt.Errorf("vector: rename shadow table: %w", err)
+		}
+	}
+	vt.name = newName
+	return nil
+}
+
+// vectorBlob validates a value written to or matched against the vector
+// column. Blobs must be float32 of the declared dimension; text is parsed as
+// a JSON array like vector_encode.
+func (vt *vecTable) vectorBlob(v sqlite.Value) ([]byte, error) {
+	switch v.Type() {
+	case sqlite.TypeNull:
+		return nil, fmt.Errorf("vector: %s.%s cannot be NULL", vt.name, vt.spec.column)
+	case sqlite.TypeText:
+		floats, err := parseJSONVector(v.Text())
+		if err != nil {
+			return nil, fmt.Errorf("vector: %v", err)
+		}
+		if len(floats) != vt.spec.dim {
+			return nil, fmt.Errorf("vector: expected dimension %d, got %d", vt.spec.dim, len(floats))
+		}
+		return Float32ToBlob(floats), nil
+	}
+	b := v.Blob()
+	if isQuantizedBlob(b) {
+		return nil, fmt.Errorf("vector: %s.%s stores float32 vectors, got quantized blob", vt.name, vt.spec.column)
+	}
+	if expected := vt.spec.dim * 4; len(b) != expected {
+		return nil, fmt.Errorf("vector: expected %d bytes (dim=%d), got %d", expected, vt.spec.dim, len(b))
+	}
+	return b, nil
+}
+
+func (vt *vecTable) Update(params sqlite.VTableUpdateParams) (int64, error) {
+	cols := params.Columns
+	if params.IsInsert() {
+		vec, err := vt.vectorBlob(cols[0])
+		if err != nil {
+			return 0, err
+		}
+		names := []string{"id", quoteIdent(vt.spec.column)}
+		args := []any{valueArg(params.NewRowID), vec}
+		for i, col := range vt.spec.aux {
+			names = append(names, quoteIdent(col.name))
+			args = append(args, valueArg(cols[1+i]))
+		}
+		query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+			vt.rowsTable(), strings.Join(names, ", "), placeholders(len(names)))
+		if err := sqlitex.Execute(vt.conn, query, &sqlitex.ExecOptions{Args: args}); err != nil {
+			return 0, fmt.Errorf("vector: insert: %w", err)
+		}
+		id := vt.conn.LastInsertRowID()
+		if err := vt.indexInsert(id, vec); err != nil {
+			return 0, err
+		}
+		return id, nil
+	}
+
+	oldID, newID := params.OldRowID.Int64(), params.NewRowID.Int64()
+	sets := []string{"id = ?"}
+	args := []any{newID}
+	var vec []byte
+	if !cols[0].NoChange() {
+		var err error
+		if vec, err = vt.vectorBlob(cols[0]); err != nil {
+			return 0, err
+		}
+		sets = append(sets, quoteIdent(vt.spec.column)+" = ?")
+		args = append(args, vec)
+	}
+	reindex := vt.spec.index != "" && (vec != nil || oldID != newID)
+	if reindex {
+		if err := vt.indexRemove(oldID); err != nil {
+			return 0, err
+		}
+	}
+	for i, col := range vt.spec.aux {
+		if cols[1+i].NoChange() {
+			continue
+		}
+		sets = append(sets, quoteIdent(col.name)+" = ?")
+		args = append(args, valueArg(cols[1+i]))
+	}
+	args = append(args, oldID)
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE id = ?", vt.rowsTable(), strings.Join(sets, ", "))
+	if err := sqlitex.Execute(vt.conn, query, &sqlitex.ExecOptions{Args: args}); err != nil {
+		return 0, fmt.Errorf("vector: update: %w", err)
+	}
+	if reindex {
+		if vec == nil {
+			v, err := vt.fetchRow(newID)
+			if err != nil {
+				return 0, err
+			}
+			vec = v[0].Blob()
+		}
+		if err := vt.indexInsert(newID, vec); err != nil {
+			return 0, err
+		}
+	}
+	return newID, nil
+}
+
+func (vt *vecTable) DeleteRow(rowID sqlite.Value) error {
+	id := rowID.Int64()
+	if err := vt.indexRemove(id); err != nil {
+		return err
+	}
+	err := sqlitex.Execute(vt.conn, "DELETE FROM "+vt.rowsTable()+" WHERE id = ?",
+		&sqlitex.ExecOptions{Args: []any{id}})
+	if err != nil {
+		return fmt.Errorf("vector: delete: %w", err)
+	}
+	return nil
+}
+
+func (vt *vecTable) indexInsert(id int64, vec []byte) error {
+	if vt.spec.index != "hnsw" {
+		return nil
+	}
+	v, _ := BlobToFloat32(vec)
+	if err := vt.hnswSession().insert(id, v); err != nil {
+		return fmt.Errorf("vector: hnsw insert: %w", err)
+	}
+	return nil
+}
+
+func (vt *vecTable) indexRemove(id int64) error {
+	if vt.spec.index != "hnsw" {
+		return nil
+	}
+	if err := vt.hnswSession().remove(id); err != nil {
+		return fmt.Errorf("vector: hnsw delete: %w", err)
+	}
+	return nil
+}
+
+// limitK returns the number of nearest rows needed to satisfy LIMIT limit
+// OFFSET offset, which SQLite still applies to the rows returned. A
+// negative limit means no limit, so every row is needed.
+func (vt *vecTable) limitK(limit, offset int64) (int64, error) {
+	if limit < 0 {
+		var n int64
+		err := sqlitex.ExecuteTransient(vt.conn, "SELECT count(*) FROM "+vt.rowsTable(), &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				n = stmt.ColumnInt64(0)
+				return nil
+			},
+		})
+		return n, err
+	}
+	if offset <= 0 {
+		return limit, nil
+	}
+	if limit > math.MaxInt64-offset {
+		return math.MaxInt64, nil
+	}
+	return limit + offset, nil
+}
+
+// knn returns the k nearest rows to query, searching the table's index if
+// it has one and scanning every row otherwise.
+func (vt *vecTable) knn(query []float32, k, efSearch int) ([]neighbor, error) {
+	if vt.spec.index == "hnsw" {
+		return vt.hnswSession().search(query, k, efSearch)
+	}
+	return vt.scanDistances(query, k)
+}
+
+// scanDistances computes the distance from query to every stored vector and
+// returns the k nearest in ascending order.
+func (vt *vecTable) scanDistances(query []float32, k int) ([]neighbor, error) {
+	stmt, err := prepareTransient(vt.conn, fmt.Sprintf("SELECT id, %s FROM %s", quoteIdent(vt.spec.column), vt.rowsTable()))
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Finalize()
+	top := newTopK(k)
+	buf := make([]byte, vt.spec.dim*4)
+	vec := make([]float32, vt.spec.dim)
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+		if !hasRow {
+			break
+		}
+		if stmt.ColumnLen(1) != len(buf) {
+			continue
+		}
+		stmt.ColumnBytes(1, buf)
+		decodeFloat32(vec, buf)
+		top.push(stmt.ColumnInt64(0), vt.spec.metric.distance(query, vec))
+	}
+	return top.sorted(), nil
+}
+
+func (vt *vecTable) fetchRow(id int64) ([]sqlite.Value, error) {
+	var values []sqlite.Value
+	err := sqlitex.Execute(vt.conn,
+		fmt.Sprintf("SELECT %s FROM %s WHERE id = ?", vt.selectColumns(), vt.rowsTable()),
+		&sqlitex.ExecOptions{
+			Args: []any{id},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				values = make([]sqlite.Value, stmt.ColumnCount()-1)
+				for i := range values {
+					values[i] = stmtValue(stmt, i+1)
+				}
+				return nil
+			},
+		})
+	if err != nil {
+		return nil, err
+	}
+	if values == nil {
+		return nil, fmt.Errorf("vector: row %d disappeared during query", id)
+	}
+	return values, nil
+}
+
+type vecResult struct {
+	id       int64
+	distance float64
+	values   []sqlite.Value
+}
+
+type vecCursor struct {
+	vtab *vecTable
+
+	// Scan and row ID plans step a live statement of their own, prepared
+	// outside the connection's cache so that another cursor on the table,
+	// or fetchRow, cannot reset it.
+	stmt *sqlite.Stmt
+	eof  bool
+
+	// k-NN plans materialize their results.
+	knn      bool
+	k        int64
+	efSearch int64
+	results  []vecResult
+	pos      int
+}
+
+func (cur *vecCursor) Filter(id sqlite.IndexID, argv []sqlite.Value) error {
+	cur.reset()
+	vt := cur.vtab
+	switch id.Num {
+	case vecPlanKNN, vecPlanKNNNoLimit:
+		cur.knn = true
+		var query, k, limit, offset, ef sqlite.Value
+		for i, code := range []byte(id.String) {
+			switch code {
+			case 'q':
+				query = argv[i]
+			case 'k':
+				k = argv[i]
+			case 'l':
+				limit = argv[i]
+			case 'o':
+				offset = argv[i]
+			case 'e':
+				ef = argv[i]
+			}
+		}
+		if k.Type() == sqlite.TypeNull && limit.Type() == sqlite.TypeNull {
+			if id.Num == vecPlanKNNNoLimit {
+				return fmt.Errorf("vector: k-NN query on %s requires a k = ? constraint; "+
+					"the LIMIT cannot be used because the query has other WHERE terms on the table", vt.name)
+			}
+			return fmt.Errorf("vector: k-NN query on %s requires a k = ? constraint or LIMIT", vt.name)
+		}
+		if query.Type() == sqlite.TypeNull {
+			return nil
+		}
+		q, err := vt.vectorBlob(query)
+		if err != nil {
+			return err
+		}
+		if k.Type() != sqlite.TypeNull {
+			cur.k = k.Int64()
+			if cur.k < 0 {
+				return fmt.Errorf("vector: k must be >= 0, got %d", cur.k)
+			}
+		} else if cur.k, err = vt.limitK(limit.Int64(), offset.Int64()); err != nil {
+			return fmt.Errorf("vector: %w", err)
+		}
+		cur.efSearch = int64(vt.spec.hnsw.efSearch)
+		if ef.Type() != sqlite.TypeNull {
+			if cur.efSearch = ef.Int64(); cur.efSearch < 1 {
+				return fmt.Errorf("vector: ef_search must be >= 1, got %d", cur.efSearch)
+			}
+		}
+		floats, _ := BlobToFloat32(q)
+		neighbors, err := vt.knn(floats, int(cur.k), int(cur.efSearch))
+		if err != nil {
+			return fmt.Errorf("vector: %w", err)
+		}
+		return cur.materialize(neighbors)
+	case vecPlanRowID:
+		stmt, err := prepareTransient(vt.conn, fmt.Sprintf("SELECT %s FROM %s WHERE id = ?", vt.selectColumns(), vt.rowsTable()))
+		if err != nil {
+			return fmt.Errorf("vector: %w", err)
+		}
+		stmt.BindInt64(1, argv[0].Int64())
+		cur.stmt = stmt
+	default:
+		stmt, err := prepareTransient(vt.conn, fmt.Sprintf("SELECT %s FROM %s ORDER BY id", vt.selectColumns(), vt.rowsTable()))
+		if err != nil {
+			return fmt.Errorf("vector: %w", err)
+		}
+		cur.stmt = stmt
+	}
+	return cur.Next()
+}
+
+func (cur *vecCursor) materialize(neighbors []neighbor) error {
+	cur.results = make([]vecResult, len(neighbors))
+	for i, n := range neighbors {
+		values, err := cur.vtab.fetchRow(n.id)
+		if err != nil {
+			return err
+		}
+		cur.results[i] = vecResult{id: n.id, distance: n.distance, values: values}
+	}
+	return nil
+}
+
+func (cur *vecCursor) reset() {
+	if cur.stmt != nil {
+		cur.stmt.Finalize()
+		cur.stmt = nil
+	}
+	cur.eof = false
+	cur.knn = false
+	cur.k = 0
+	cur.efSearch = 0
+	cur.results = nil
+	cur.pos = 0
+}
+
+func (cur *vecCursor) Next() error {
+	if cur.knn {
+		cur.pos++
+		return nil
+	}
+	hasRow, err := cur.stmt.Step()
+	if err != nil {
+		return fmt.Errorf("vector: %w", err)
+	}
+	cur.eof = !hasRow
+	return nil
+}
+
+func (cur *vecCursor) Column(i int, noChange bool) (sqlite.Value, error) {
+	vt := cur.vtab
+	switch i {
+	case vt.distanceColumn():
+		if cur.knn {
+			return sqlite.FloatValue(cur.results[cur.pos].distance), nil
+		}
+		return sqlite.Value{}, nil
+	case vt.kColumn():
+		if cur.knn {
+			return sqlite.IntegerValue(cur.k), nil
+		}
+		return sqlite.Value{}, nil
+	case vt.efSearchColumn():
+		if cur.knn && vt.spec.index == "hnsw" {
+			return sqlite.IntegerValue(cur.efSearch), nil
+		}
+		return sqlite.Value{}, nil
+	}
+	if noChange {
+		return sqlite.Unchanged(), nil
+	}
+	if cur.knn {
+		return cur.results[cur.pos].values[i], nil
+	}
+	return stmtValue(cur.stmt, i+1), nil
+}
+
+func (cur *vecCursor) RowID() (int64, error) {
+	if cur.knn {
+		return cur.results[cur.pos].id, nil
+	}
+	return cur.stmt.ColumnInt64(0), nil
+}
+
+func (cur *vecCursor) EOF() bool {
+	if cur.knn {
+		return cur.pos >= len(cur.results)
+	}
+	return cur.eof
+}
+
+func (cur *vecCursor) Close() error {
+	cur.reset()
+	return nil
+}
+
+// neighbor is a candidate row and its distance from a query.
+type neighbor struct {
+	id       int64
+	distance float64
+}
+
+// neighborHeap is a max-heap on distance, so the farthest of the current
+// candidates is at the root and can be evicted in O(log k).
+type neighborHeap []neighbor
+
+func (h neighborHeap) Len() int           { return len(h) }
+func (h neighborHeap) Less(i, j int) bool { return h[i].distance > h[j].distance }
+func (h neighborHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *neighborHeap) Push(x any)        { *h = append(*h, x.(neighbor)) }
+func (h *neighborHeap) Pop() any {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
+
+// topK keeps the k nearest neighbors pushed into it.
+type topK struct {
+	k int
+	h neighborHeap
+}
+
+// maxTopKPrealloc bounds the capacity a search reserves up front. k and
+// ef_search come from SQL, so reserving all of it would let a query exhaust
+// memory before a single row is read; beyond this storage grows as rows
+// arrive.
+const maxTopKPrealloc = 1024
+
+func newTopK(k int) *topK {
+	return &topK{k: k, h: make(neighborHeap, 0, min(max(k, 0), maxTopKPrealloc))}
+}
+
+func (t *topK) push(id int64, distance float64) {
+	if t.k <= 0 {
+		return
+	}
+	if len(t.h) < t.k {
+		heap.Push(&t.h, neighbor{id: id, distance: distance})
+		return
+	}
+	if distance < t.h[0].distance {
+		t.h[0] = neighbor{id: id, distance: distance}
+		heap.Fix(&t.h, 0)
+	}
+}
+
+// sorted returns the kept neighbors nearest first. Ties are broken by row ID
+// so results are deterministic.
+func (t *topK) sorted() []neighbor {
+	out := make([]neighbor, len(t.h))
+	copy(out, t.h)
+	sortNeighbors(out)
+	return out
+}
+
+// stmtValue copies column col of the current row of stmt into a Value.
+func stmtValue(stmt *sqlite.Stmt, col int) sqlite.Value {
+	switch stmt.ColumnType(col) {
+	case sqlite.TypeInteger:
+		return sqlite.IntegerValue(stmt.ColumnInt64(col))
+	case sqlite.TypeFloat:
+		return sqlite.FloatValue(stmt.ColumnFloat(col))
+	case sqlite.TypeText:
+		return sqlite.TextValue(stmt.ColumnText(col))
+	case sqlite.TypeBlob:
+		b := make([]byte, stmt.ColumnLen(col))
+		stmt.ColumnBytes(col, b)
+		return sqlite.BlobValue(b)
+	default:
+		return sqlite.Value{}
+	}
+}
+
+// valueArg converts v to an argument for sqlitex.ExecOptions.Args.
+func valueArg(v sqlite.Value) any {
+	switch v.Type() {
+	case sqlite.TypeInteger:
+		return v.Int64()
+	case sqlite.TypeFloat:
+		return v.Float()
+	case sqlite.TypeText:
+		return v.Text()
+	case sqlite.TypeBlob:
+		return v.Blob()
+	default:
+		return nil
+	}
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
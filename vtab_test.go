@@ -0,0 +1,483 @@
+package vector
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestParseVecTableArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    vecTableSpec
+		wantErr bool
+	}{
+		{
+			name: "vector column only",
+			args: []string{"embedding float[768]"},
+			want: vecTableSpec{column: "embedding", dim: 768},
+		},
+		{
+			name: "aux columns and metric",
+			args: []string{" title TEXT", "embedding FLOAT[3] ", "distance_metric = 'cosine'", "n"},
+			want: vecTableSpec{
+				column: "embedding",
+				dim:    3,
+				metric: MetricCosine,
+				aux:    []vecAuxColumn{{name: "title", typ: "TEXT"}, {name: "n"}},
+			},
+		},
+		{name: "missing vector column", args: []string{"title TEXT"}, wantErr: true},
+		{name: "two vector columns", args: []string{"a float[3]", "b float[3]"}, wantErr: true},
+		{name: "zero dimension", args: []string{"a float[0]"}, wantErr: true},
+		{name: "unknown option", args: []string{"a float[3]", "foo=bar"}, wantErr: true},
+		{name: "unknown metric", args: []string{"a float[3]", "distance_metric=manhattan"}, wantErr: true},
+		{name: "reserved column", args: []string{"a float[3]", "distance REAL"}, wantErr: true},
+		{name: "duplicate column", args: []string{"a float[3]", "A TEXT"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseVecTableArgs(tt.args, MetricL2)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseVecTableArgs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.column != tt.want.column || got.dim != tt.want.dim || got.metric != tt.want.metric {
+				t.Errorf("parseVecTableArgs() = %+v, want %+v", *got, tt.want)
+			}
+			if len(got.aux) != len(tt.want.aux) {
+				t.Fatalf("aux = %v, want %v", got.aux, tt.want.aux)
+			}
+			for i := range got.aux {
+				if got.aux[i] != tt.want.aux[i] {
+					t.Errorf("aux[%d] = %v, want %v", i, got.aux[i], tt.want.aux[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTopK(t *testing.T) {
+	top := newTopK(3)
+	for i, d := range []float64{5, 1, 4, 2, 3, 0.5} {
+		top.push(int64(i), d)
+	}
+	got := top.sorted()
+	want := []neighbor{{id: 5, distance: 0.5}, {id: 1, distance: 1}, {id: 3, distance: 2}}
+	if len(got) != len(want) {
+		t.Fatalf("got %d neighbors, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("neighbor[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	if got := newTopK(0); len(got.sorted()) != 0 {
+		t.Error("k=0 kept neighbors")
+	}
+}
+
+func setupVecTable(t *testing.T, conn *sqlite.Conn) {
+	t.Helper()
+	if err := sqlitex.ExecuteTransient(conn, "CREATE VIRTUAL TABLE docs USING vector(embedding float[3], content TEXT)", nil); err != nil {
+		t.Fatal(err)
+	}
+	setupVecTableRows(t, conn)
+}
+
+// setupVecTableRows fills a docs table with five 3-dimensional rows.
+func setupVecTableRows(t *testing.T, conn *sqlite.Conn) {
+	t.Helper()
+	if err := sqlitex.ExecuteScript(conn, `
+		INSERT INTO docs (rowid, content, embedding) VALUES (1, 'a', vector_encode('[1.0, 0.0, 0.0]'));
+		INSERT INTO docs (rowid, content, embedding) VALUES (2, 'b', vector_encode('[0.0, 1.0, 0.0]'));
+		INSERT INTO docs (rowid, content, embedding) VALUES (3, 'c', vector_encode('[0.0, 0.0, 1.0]'));
+		INSERT INTO docs (rowid, content, embedding) VALUES (4, 'd', vector_encode('[1.0, 1.0, 0.0]'));
+		INSERT INTO docs (rowid, content, embedding) VALUES (5, 'e', '[0.5, 0.5, 0.5]');
+	`, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVecTableKNN(t *testing.T) {
+	conn := openTestConn(t)
+	if err := Register(conn, 3); err != nil {
+		t.Fatal(err)
+	}
+	setupVecTable(t, conn)
+
+	t.Run("MATCH with k", func(t *testing.T) {
+		var contents []string
+		var distances []float64
+		err := sqlitex.Execute(conn,
+			"SELECT content, distance FROM docs WHERE embedding MATCH ?1 AND k = 3 ORDER BY distance",
+			&sqlitex.ExecOptions{
+				Args: []any{Float32ToBlob([]float32{1, 0, 0})},
+				ResultFunc: func(stmt *sqlite.Stmt) error {
+					contents = append(contents, stmt.ColumnText(0))
+					distances = append(distances, stmt.ColumnFloat(1))
+					return nil
+				},
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"a", "e", "d"}
+		wantDist := []float64{0, 0.75, 1}
+		if len(contents) != len(want) {
+			t.Fatalf("got %v, want %v", contents, want)
+		}
+		for i := range want {
+			if contents[i] != want[i] {
+				t.Errorf("nearest[%d] = %q, want %q", i, contents[i], want[i])
+			}
+			if distances[i] != wantDist[i] {
+				t.Errorf("distance[%d] = %v, want %v", i, distances[i], wantDist[i])
+			}
+		}
+	})
+
+	t.Run("MATCH with LIMIT and JSON query", func(t *testing.T) {
+		var rowids []int64
+		err := sqlitex.Execute(conn,
+			"SELECT rowid FROM docs WHERE embedding MATCH '[0, 0, 1]' ORDER BY distance LIMIT 2",
+			&sqlitex.ExecOptions{
+				ResultFunc: func(stmt *sqlite.Stmt) error {
+					rowids = append(rowids, stmt.ColumnInt64(0))
+					return nil
+				},
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rowids) != 2 || rowids[0] != 3 || rowids[1] != 5 {
+			t.Errorf("rowids = %v, want [3 5]", rowids)
+		}
+	})
+
+	t.Run("MATCH with LIMIT and OFFSET", func(t *testing.T) {
+		got := queryKNN(t, conn, "SELECT rowid FROM docs WHERE embedding MATCH '[1, 0, 0]' ORDER BY distance LIMIT 2 OFFSET 1")
+		if want := []int64{5, 4}; !slices.Equal(got, want) {
+			t.Errorf("rowids = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("MATCH with LIMIT -1", func(t *testing.T) {
+		got := queryKNN(t, conn, "SELECT rowid FROM docs WHERE embedding MATCH '[1, 0, 0]' ORDER BY distance LIMIT -1")
+		if want := []int64{1, 5, 4, 2, 3}; !slices.Equal(got, want) {
+			t.Errorf("rowids = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("MATCH with huge k or LIMIT", func(t *testing.T) {
+		tests := []struct {
+			query string
+			want  int
+		}{
+			{"SELECT rowid FROM docs WHERE embedding MATCH '[1, 0, 0]' AND k = 100000000000", 5},
+			{"SELECT rowid FROM docs WHERE embedding MATCH '[1, 0, 0]' LIMIT 100000000000 OFFSET 1", 4},
+			{"SELECT rowid FROM docs WHERE embedding MATCH '[1, 0, 0]' LIMIT 9223372036854775807 OFFSET 9223372036854775807", 0},
+		}
+		for _, tt := range tests {
+			if got := queryKNN(t, conn, tt.query); len(got) != tt.want {
+				t.Errorf("%s returned %d rows, want %d", tt.query, len(got), tt.want)
+			}
+		}
+	})
+
+	t.Run("MATCH with other WHERE terms and LIMIT", func(t *testing.T) {
+		err := sqlitex.Execute(conn, "SELECT rowid FROM docs WHERE embedding MATCH '[1, 0, 0]' AND content = 'a' LIMIT 5", nil)
+		if err == nil || !strings.Contains(err.Error(), "other WHERE terms") {
+			t.Errorf("err = %v, want one explaining why the LIMIT was not used", err)
+		}
+		got := queryKNN(t, conn, "SELECT rowid FROM docs WHERE embedding MATCH '[1, 0, 0]' AND k = 5 AND content = 'e' LIMIT 5")
+		if want := []int64{5}; !slices.Equal(got, want) {
+			t.Errorf("with k: rowids = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("MATCH without k or LIMIT", func(t *testing.T) {
+		err := sqlitex.Execute(conn, "SELECT rowid FROM docs WHERE embedding MATCH '[0, 0, 1]'", nil)
+		if err == nil {
+			t.Fatal("expected error for k-NN query without k")
+		}
+	})
+
+	t.Run("MATCH wrong dimension", func(t *testing.T) {
+		err := sqlitex.Execute(conn, "SELECT rowid FROM docs WHERE embedding MATCH '[0, 1]' AND k = 1", nil)
+		if err == nil {
+			t.Fatal("expected error for wrong query dimension")
+		}
+	})
+
+	t.Run("k larger than table", func(t *testing.T) {
+		var count int
+		err := sqlitex.Execute(conn,
+			"SELECT rowid FROM docs WHERE embedding MATCH '[0, 0, 1]' AND k = 100",
+			&sqlitex.ExecOptions{
+				ResultFunc: func(stmt *sqlite.Stmt) error {
+					count++
+					return nil
+				},
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 5 {
+			t.Errorf("got %d rows, want 5", count)
+		}
+	})
+}
+
+func TestVecTableSelfJoin(t *testing.T) {
+	conn := openTestConn(t)
+	if err := Register(conn, 3); err != nil {
+		t.Fatal(err)
+	}
+	setupVecTable(t, conn)
+	pairs := func(query string) []string {
+		t.Helper()
+		var got []string
+		err := sqlitex.ExecuteTransient(conn, query, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				got = append(got, stmt.ColumnText(0)+stmt.ColumnText(1))
+				return nil
+			},
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		return got
+	}
+
+	got := pairs("SELECT a.content, b.content FROM docs AS a, docs AS b WHERE a.rowid < b.rowid")
+	want := []string{"ab", "ac", "ad", "ae", "bc", "bd", "be", "cd", "ce", "de"}
+	if !slices.Equal(got, want) {
+		t.Errorf("scan self-join = %v, want %v", got, want)
+	}
+
+	got = pairs("SELECT a.content, b.content FROM docs AS a JOIN docs AS b ON b.rowid = a.rowid + 1")
+	if want := []string{"ab", "bc", "cd", "de"}; !slices.Equal(got, want) {
+		t.Errorf("row ID self-join = %v, want %v", got, want)
+	}
+
+	// A k-NN query per row of a row ID lookup on the same table.
+	got = pairs(`SELECT a.content, (SELECT group_concat(b.content, '') FROM docs AS b WHERE b.embedding MATCH a.embedding AND k = 2)
+		FROM docs AS a WHERE a.rowid IN (1, 3)`)
+	if want := []string{"aae", "cce"}; !slices.Equal(got, want) {
+		t.Errorf("k-NN inside row ID lookup = %v, want %v", got, want)
+	}
+}
+
+func TestVecTableConcurrentCursors(t *testing.T) {
+	conn := openTestConn(t)
+	if err := Register(conn, 3); err != nil {
+		t.Fatal(err)
+	}
+	setupVecTable(t, conn)
+	var stmts [2]*sqlite.Stmt
+	for i := range stmts {
+		stmt, _, err := conn.PrepareTransient("SELECT content FROM docs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stmt.Finalize()
+		stmts[i] = stmt
+	}
+	// Step the two statements in lockstep, one row apart.
+	if _, err := stmts[0].Step(); err != nil {
+		t.Fatal(err)
+	}
+	var got [2]string
+	for {
+		row0, err := stmts[0].Step()
+		if err != nil {
+			t.Fatal(err)
+		}
+		row1, err := stmts[1].Step()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !row0 {
+			break
+		}
+		if !row1 {
+			t.Fatal("second cursor ended before the first")
+		}
+		got[0] += stmts[0].ColumnText(0)
+		got[1] += stmts[1].ColumnText(0)
+	}
+	if got[0] != "bcde" || got[1] != "abcd" {
+		t.Errorf("interleaved cursors read %q and %q, want \"bcde\" and \"abcd\"", got[0], got[1])
+	}
+}
+
+func TestVecTableWrites(t *testing.T) {
+	conn := openTestConn(t)
+	if err := Register(conn, 3); err != nil {
+		t.Fatal(err)
+	}
+	setupVecTable(t, conn)
+
+	if err := sqlitex.ExecuteScript(conn, `
+		UPDATE docs SET content = 'a2' WHERE rowid = 1;
+		UPDATE docs SET embedding = '[0.0, 0.0, 0.9]' WHERE rowid = 2;
+		DELETE FROM docs WHERE rowid = 3;
+	`, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	err := sqlitex.Execute(conn, "SELECT COUNT(*) FROM docs", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			count = stmt.ColumnInt(0)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("count = %d, want 4", count)
+	}
+
+	var content string
+	err = sqlitex.Execute(conn, "SELECT content FROM docs WHERE rowid = 1", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			content = stmt.ColumnText(0)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != "a2" {
+		t.Errorf("content = %q, want 'a2'", content)
+	}
+
+	var nearest string
+	err = sqlitex.Execute(conn, "SELECT content FROM docs WHERE embedding MATCH '[0, 0, 1]' AND k = 1", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			nearest = stmt.ColumnText(0)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nearest != "b" {
+		t.Errorf("nearest = %q, want 'b'", nearest)
+	}
+
+	t.Run("insert rejects wrong dimension", func(t *testing.T) {
+		err := sqlitex.Execute(conn, "INSERT INTO docs (content, embedding) VALUES ('x', ?1)",
+			&sqlitex.ExecOptions{Args: []any{Float32ToBlob([]float32{1, 2})}})
+		if err == nil {
+			t.Fatal("expected error for wrong dimension")
+		}
+	})
+
+	t.Run("insert rejects NULL vector", func(t *testing.T) {
+		err := sqlitex.Execute(conn, "INSERT INTO docs (content, embedding) VALUES ('x', NULL)", nil)
+		if err == nil {
+			t.Fatal("expected error for NULL vector")
+		}
+	})
+
+	t.Run("insert rejects quantized blob", func(t *testing.T) {
+		err := sqlitex.Execute(conn, "INSERT INTO docs (content, embedding) VALUES ('x', ?1)",
+			&sqlitex.ExecOptions{Args: []any{[]byte{0x00, 0x01, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}}})
+		if err == nil {
+			t.Fatal("expected error for quantized blob")
+		}
+	})
+}
+
+func TestVecTableCosine(t *testing.T) {
+	conn := openTestConn(t)
+	if err := Register(conn, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlitex.ExecuteScript(conn, `
+		CREATE VIRTUAL TABLE docs USING vector(embedding float[3], content TEXT, distance_metric=cosine);
+		INSERT INTO docs (content, embedding) VALUES ('long', '[10.0, 1.0, 0.0]');
+		INSERT INTO docs (content, embedding) VALUES ('near', '[0.5, 0.5, 0.0]');
+	`, nil); err != nil {
+		t.Fatal(err)
+	}
+	var nearest string
+	err := sqlitex.Execute(conn, "SELECT content FROM docs WHERE embedding MATCH '[1, 0, 0]' AND k = 1", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			nearest = stmt.ColumnText(0)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nearest != "long" {
+		t.Errorf("nearest = %q, want 'long'", nearest)
+	}
+}
+
+func TestVecTablePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vec.db")
+	conn, err := sqlite.OpenConn(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Register(conn, 3); err != nil {
+		t.Fatal(err)
+	}
+	setupVecTable(t, conn)
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err = sqlite.OpenConn(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := Register(conn, 3); err != nil {
+		t.Fatal(err)
+	}
+	var nearest string
+	err = sqlitex.Execute(conn, "SELECT content FROM docs WHERE embedding MATCH '[0, 1, 0]' AND k = 1", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			nearest = stmt.ColumnText(0)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nearest != "b" {
+		t.Errorf("nearest after reopen = %q, want 'b'", nearest)
+	}
+
+	if err := sqlitex.ExecuteTransient(conn, "DROP TABLE docs", nil); err != nil {
+		t.Fatal(err)
+	}
+	var shadows int
+	err = sqlitex.Execute(conn, "SELECT COUNT(*) FROM sqlite_schema WHERE name LIKE 'docs%'", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			shadows = stmt.ColumnInt(0)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shadows != 0 {
+		t.Errorf("%d schema objects remain after DROP TABLE", shadows)
+	}
+}
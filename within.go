@@ -0,0 +1,81 @@
+package vector
+
+import (
+	"fmt"
+	"math"
+
+	"zombiezen.com/go/sqlite"
+)
+
+// l2AbandonStride is how many dimensions l2SquaredWithin adds between checks
+// of the partial sum, so the check costs little next to the arithmetic.
+const l2AbandonStride = 16
+
+// l2SquaredWithin returns the squared L2 distance between a and b and
+// whether it is at most r. Every term is non-negative, so it stops as soon
+// as the partial sum exceeds r; the returned distance is then only a lower
+// bound.
+func l2SquaredWithin(a, b []float32, r float64) (float64, bool) {
+	var sum float64
+	for start := 0; start < len(a); start += l2AbandonStride {
+		end := min(start+l2AbandonStride, len(a))
+		for i := start; i < end; i++ {
+			d := float64(a[i]) - float64(b[i])
+			sum += d * d
+		}
+		if sum > r {
+			return sum, false
+		}
+	}
+	return sum, true
+}
+
+// within reports whether the distance from a to b under m is at most r and
+// returns the distance when it is. Squared L2 abandons early; the other
+// metrics can shrink as terms are added, so they compute the full distance.
+func (m Metric) within(a, b []float32, r float64) (float64, bool) {
+	if m == MetricL2 {
+		return l2SquaredWithin(a, b, r)
+	}
+	d := m.distance(a, b)
+	return d, d <= r
+}
+
+// withinFunc returns the vector_within table-valued function, which returns
+// every row within a distance radius of the query, nearest first.
+func withinFunc(conn *sqlite.Conn, cfg *config) *tableFunc {
+	return &tableFunc{
+		name:     cfg.funcName("_within"),
+		columns:  []string{"id INTEGER", "distance REAL"},
+		params:   []string{"table_name", "column_name", "query", "radius", "filter"},
+		required: 4,
+		run: func(params []sqlite.Value) ([]tableFuncRow, error) {
+			if params[2].Type() == sqlite.TypeNull || params[3].Type() == sqlite.TypeNull {
+				return nil, nil
+			}
+			q, model, err := scanQuery(cfg, params[2])
+			if err != nil {
+				return nil, fmt.Errorf("query: %v", err)
+			}
+			r := params[3].Float()
+			if math.IsNaN(r) {
+				return nil, fmt.Errorf("radius must be a number")
+			}
+			var filter string
+			if params[4].Type() != sqlite.TypeNull {
+				filter = params[4].Text()
+			}
+			var neighbors []neighbor
+			err = scanVectors(conn, cfg, params[0].Text(), params[1].Text(), filter, model, func(id int64, vec []float32) {
+				if d, ok := cfg.metric.within(q, vec, r); ok {
+					neighbors = append(neighbors, neighbor{id: id, distance: d})
+				}
+			})
+			if err != nil {
+				return nil, err
+			}
+			sortNeighbors(neighbors)
+			return neighborRows(neighbors), nil
+		},
+	}
+}
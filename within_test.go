@@ -0,0 +1,80 @@
+package vector
+
+import (
+	"slices"
+	"testing"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestL2SquaredWithin(t *testing.T) {
+	for _, dim := range []int{1, 15, 16, 17, 100} {
+		a, b := randomFloat32s(dim), randomFloat32s(dim)
+		full := l2Squared(a, b)
+		if d, ok := l2SquaredWithin(a, b, full); !ok || d != full {
+			t.Errorf("dim %d: l2SquaredWithin(r = distance) = %v, %v, want %v, true", dim, d, ok, full)
+		}
+		if d, ok := l2SquaredWithin(a, b, full/2); ok || d > full {
+			t.Errorf("dim %d: l2SquaredWithin(r < distance) = %v, %v, want a lower bound and false", dim, d, ok)
+		}
+	}
+}
+
+func TestVectorWithin(t *testing.T) {
+	for _, m := range []Metric{MetricL2, MetricCosine, MetricDot} {
+		t.Run(m.String(), func(t *testing.T) {
+			conn, vectors := setupIVFTable(t, 200, 32, WithMetric(m))
+			q := vectors[5]
+			const r = 0.5
+			var want []neighbor
+			for id, v := range vectors {
+				if d := m.distance(q, v); d <= r {
+					want = append(want, neighbor{id: id, distance: d})
+				}
+			}
+			sortNeighbors(want)
+			var got []neighbor
+			err := sqlitex.Execute(conn, "SELECT id, distance FROM vector_within('items', 'embedding', ?, ?)",
+				&sqlitex.ExecOptions{
+					Args: []any{Float32ToBlob(q), r},
+					ResultFunc: func(stmt *sqlite.Stmt) error {
+						got = append(got, neighbor{id: stmt.ColumnInt64(0), distance: stmt.ColumnFloat(1)})
+						return nil
+					},
+				})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(want) == 0 || !slices.Equal(got, want) {
+				t.Errorf("vector_within = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestVectorWithinFilter(t *testing.T) {
+	conn, vectors := setupIVFTable(t, 50, 4)
+	got := queryKNN(t, conn, "SELECT id FROM vector_within('items', 'embedding', ?, 100, 'rowid <= 10')", Float32ToBlob(vectors[1]))
+	if len(got) != 10 || got[0] != 1 {
+		t.Errorf("filtered vector_within = %v, want rows 1-10 starting with 1", got)
+	}
+	if got := queryKNN(t, conn, "SELECT id FROM vector_within('items', 'embedding', ?, NULL)", Float32ToBlob(vectors[1])); len(got) != 0 {
+		t.Errorf("NULL radius returned %v", got)
+	}
+	if got := queryKNN(t, conn, "SELECT id FROM vector_within('items', 'embedding', ?, 0)", Float32ToBlob(vectors[1])); !slices.Equal(got, []int64{1}) {
+		t.Errorf("radius 0 returned %v, want [1]", got)
+	}
+}
+
+func TestVectorWithinSelfJoin(t *testing.T) {
+	conn, _ := setupIVFTable(t, 20, 4)
+	err := sqlitex.ExecuteTransient(conn, "INSERT INTO items (rowid, embedding) SELECT 100 + rowid, embedding FROM items WHERE rowid <= 3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := queryKNN(t, conn, `SELECT s.id FROM items AS d, vector_within('items', 'embedding', d.embedding, 0, 'rowid > ' || d.rowid) AS s ORDER BY s.id`)
+	if want := []int64{101, 102, 103}; !slices.Equal(got, want) {
+		t.Errorf("duplicates = %v, want %v", got, want)
+	}
+}